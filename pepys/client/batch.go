@@ -0,0 +1,272 @@
+package client
+
+import "os"
+import "bytes"
+import "pepys"
+
+// A Batch collects operations and sends them in as few groups as the
+// session allows, saving the round trips 9P would need. Operations may use
+// the fids of earlier operations in the same batch. The server stops at the
+// first operation that fails, and so does the batch: everything after it is
+// left undone.
+type Batch struct {
+	conn *Conn
+	ops []*Future
+}
+
+// The result of an operation in a Batch, available once the batch is sent
+type Future struct {
+	// The fid made by Attach and Open, to use in later operations
+	Fid *Fid
+
+	// private
+	msg interface{}
+	resp interface{}
+	err os.Error
+	done chan bool
+}
+
+// Returned for the operations of a batch after one that failed
+var Eskipped = os.NewError("not done, an earlier operation in the batch failed")
+
+func (c *Conn) Batch() *Batch {
+	b := new(Batch)
+	b.conn = c
+	return b
+}
+
+func (b *Batch) add(msg interface{}, fid *Fid) *Future {
+	fu := new(Future)
+	fu.Fid = fid
+	fu.msg = msg
+	fu.done = make(chan bool, 1)
+
+	ops := make([]*Future, len(b.ops) + 1)
+	copy(ops, b.ops)
+	ops[len(b.ops)] = fu
+	b.ops = ops
+	return fu
+}
+
+func (b *Batch) Attach(aname string) *Future {
+	f := b.conn.newFid()
+	at := new(pepys.Tattach)
+	at.Fid = f.num
+	at.Afid = pepys.Nofid
+	at.Uname = b.conn.Uname
+	at.Aname = aname
+	return b.add(at, f)
+}
+
+func (b *Batch) Open(dir *Fid, path string, mode string) *Future {
+	f := b.conn.newFid()
+	op := new(pepys.Topen)
+	op.Fid = dir.num
+	op.Nfid = f.num
+	op.Path = path
+	op.Mode = mode
+	return b.add(op, f)
+}
+
+// As with Tcreate, the directory fid becomes the new file. Open the
+// directory again with path "." first if it is still needed.
+func (b *Batch) Create(dir *Fid, name string, perm uint32, mode string) *Future {
+	cr := new(pepys.Tcreate)
+	cr.Fid = dir.num
+	cr.Name = name
+	cr.Perm = perm
+	cr.Mode = mode
+	return b.add(cr, dir)
+}
+
+func (b *Batch) Read(f *Fid, offset uint64, count uint32) *Future {
+	rd := new(pepys.Tread)
+	rd.Fid = f.num
+	rd.Offset = offset
+	rd.Count = count
+	return b.add(rd, f)
+}
+
+func (b *Batch) Write(f *Fid, offset uint64, dat []byte) *Future {
+	wr := new(pepys.Twrite)
+	wr.Fid = f.num
+	wr.Offset = offset
+	wr.Dat = dat
+	return b.add(wr, f)
+}
+
+func (b *Batch) Remove(f *Fid) *Future {
+	rm := new(pepys.Tremove)
+	rm.Fid = f.num
+	return b.add(rm, f)
+}
+
+func (b *Batch) Clunk(f *Fid) *Future {
+	cl := new(pepys.Tclunk)
+	cl.Fid = f.num
+	cl.Version = f.Version
+	return b.add(cl, f)
+}
+
+func (b *Batch) Stat(f *Fid) *Future {
+	st := new(pepys.Tstat)
+	st.Fid = f.num
+	return b.add(st, f)
+}
+
+func (b *Batch) Wstat(f *Fid, wst *pepys.Twstat) *Future {
+	wst.Fid = f.num
+	return b.add(wst, f)
+}
+
+// How much room a message takes in a group, and how much its response may
+// take at most
+func sizes(msg interface{}) (int, int) {
+	pkt := new(pepys.Packet)
+	pkt.Add(msg)
+	buf := new(bytes.Buffer)
+	pkt.Send(buf)
+	tsize := buf.Len() - 12
+
+	rsize := 64
+	switch m := msg.(type) {
+	case *pepys.Tread:
+		rsize += int(m.Count)
+	case *pepys.Tstat:
+		rsize += 1024
+	}
+	return tsize, rsize
+}
+
+// Split the operations into groups that respect Nmsgs and Msize both ways
+func (b *Batch) groups() [][]*Future {
+	groups := make([][]*Future, 0, len(b.ops))
+	start, tsize, rsize := 0, 12, 12
+	for i, fu := range b.ops {
+		t, r := sizes(fu.msg)
+		full := i - start == int(b.conn.Nmsgs)
+		full = full || tsize + t > int(b.conn.Msize) || rsize + r > int(b.conn.Msize)
+		if i > start && full {
+			groups = groups[0:len(groups) + 1]
+			groups[len(groups) - 1] = b.ops[start:i]
+			start, tsize, rsize = i, 12, 12
+		}
+		tsize += t
+		rsize += r
+	}
+	if start < len(b.ops) {
+		groups = groups[0:len(groups) + 1]
+		groups[len(groups) - 1] = b.ops[start:]
+	}
+	return groups
+}
+
+// Send the operations, returning the error of the first one that failed.
+// If ctx is done first, the group being sent is flushed: unless the server
+// answered it anyway, its operations fail with ctx.Err() and their fids are
+// gone, as Rpc describes, while those after it are skipped.
+func (b *Batch) Send(ctx Context) os.Error {
+	var err os.Error
+	for _, group := range b.groups() {
+		if err != nil {
+			for _, fu := range group {
+				fu.finish(nil, Eskipped)
+			}
+			continue
+		}
+
+		msgs := make([]interface{}, len(group))
+		for i, fu := range group {
+			msgs[i] = fu.msg
+		}
+		var resp []interface{}
+		resp, err = b.conn.Rpc(ctx, msgs...)
+		flushed := err != nil && err == ctx.Err()
+		for i, fu := range group {
+			switch {
+			case flushed:
+				fu.finish(nil, err)
+			case i < len(resp):
+				fu.finish(resp[i], nil)
+			case i == len(resp) && err != nil:
+				fu.finish(nil, err)
+			default:
+				fu.finish(nil, Eskipped)
+			}
+		}
+	}
+	b.ops = nil
+	return err
+}
+
+// Record the outcome of an operation and keep the fids straight
+func (fu *Future) finish(resp interface{}, err os.Error) {
+	fu.resp = resp
+	fu.err = err
+
+	switch r := resp.(type) {
+	case *pepys.Ropen:
+		fu.Fid.Iounit = r.Iounit
+		fu.Fid.Ftype = r.Ftype
+		fu.Fid.Version = r.Version
+	case *pepys.Rcreate:
+		fu.Fid.Iounit = r.Iounit
+		fu.Fid.Version = r.Version
+		if fu.msg.(*pepys.Tcreate).Perm & pepys.Pdir != 0 {
+			fu.Fid.Ftype = pepys.Fdir
+		}
+	}
+
+	switch fu.msg.(type) {
+	case *pepys.Tattach, *pepys.Topen:
+		// the fid never came to be
+		if err != nil {
+			fu.Fid.release()
+		}
+	case *pepys.Tclunk, *pepys.Tremove:
+		// the fid is gone unless the server never got to it
+		if err != Eskipped {
+			fu.Fid.release()
+		}
+	}
+	fu.done <- true
+}
+
+// Wait for the batch to be sent and return the response to the operation
+func (fu *Future) Wait() (interface{}, os.Error) {
+	<-fu.done
+	fu.done <- true
+	return fu.resp, fu.err
+}
+
+func (fu *Future) Err() os.Error {
+	_, err := fu.Wait()
+	return err
+}
+
+// The data of a Read
+func (fu *Future) Data() ([]byte, os.Error) {
+	resp, err := fu.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pepys.Rread).Dat, nil
+}
+
+// The count of a Write
+func (fu *Future) Count() (uint32, os.Error) {
+	resp, err := fu.Wait()
+	if err != nil {
+		return 0, err
+	}
+	return resp.(*pepys.Rwrite).Count, nil
+}
+
+// The metadata of a Stat
+func (fu *Future) Stat() (*pepys.Rstat, os.Error) {
+	resp, err := fu.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pepys.Rstat), nil
+}
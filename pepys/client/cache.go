@@ -0,0 +1,338 @@
+package client
+
+import "os"
+import "fmt"
+import "path"
+import "sync"
+import "bytes"
+import "pepys"
+import "crypto/sha1"
+import "io/ioutil"
+
+// A Cache keeps the contents and metadata of the files of one attached tree
+// that are read through it, in memory and optionally in a local directory.
+// Entries are kept by path and Version: each open asks the server for the
+// file, and if its Version is the one kept, the reads are served locally.
+// Only files the server marks Fversioned are kept, as the Version of other
+// files may not change when their contents do.
+type Cache struct {
+	root *Fid
+	max int64
+	dir string
+
+	// private
+	lock sync.Mutex	// protects what follows
+	ents map[string]*cacheEntry
+	size int64	// bytes kept in memory
+	tick uint64	// for finding the least recently used entry
+	stats CacheStats
+}
+
+type CacheStats struct {
+	Hits uint64	// opens served from memory
+	DiskHits uint64	// opens served from the cache directory
+	Misses uint64	// opens of versioned files not in the cache
+	Uncached uint64	// opens of files that are not versioned
+	Evictions uint64	// entries dropped from memory to make room
+	Entries int	// entries in memory
+	Bytes int64	// bytes in memory
+}
+
+type cacheEntry struct {
+	key string	// the cleaned path
+	st *pepys.Rstat
+	dat []byte
+	used uint64
+}
+
+// A cache for the tree under root, keeping up to max bytes in memory and,
+// if dir is not empty, every file in dir as well. Entries on disk are only
+// known by their path, so each tree needs a directory of its own.
+func NewCache(root *Fid, max int64, dir string) *Cache {
+	c := new(Cache)
+	c.root = root
+	c.max = max
+	c.dir = dir
+	c.ents = make(map[string]*cacheEntry, 64)
+	return c
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.ents)
+	stats.Bytes = c.size
+	return stats
+}
+
+func (c *Cache) count(n *uint64) {
+	c.lock.Lock()
+	*n++
+	c.lock.Unlock()
+}
+
+// The entry for key if it is of the given version, from memory or disk
+func (c *Cache) lookup(key string, version uint64) *cacheEntry {
+	c.lock.Lock()
+	e := c.ents[key]
+	if e != nil && e.st.Version == version {
+		c.tick++
+		e.used = c.tick
+		c.stats.Hits++
+		c.lock.Unlock()
+		return e
+	}
+	c.lock.Unlock()
+
+	if e = c.load(key); e == nil || e.st.Version != version {
+		return nil
+	}
+	c.count(&c.stats.DiskHits)
+	c.keep(e)
+	return e
+}
+
+// Keep e in memory, making room for it if need be
+func (c *Cache) keep(e *cacheEntry) {
+	size := int64(len(e.dat))
+	if size > c.max {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if old := c.ents[e.key]; old != nil {
+		c.size -= int64(len(old.dat))
+		c.ents[e.key] = nil, false
+	}
+	for c.size + size > c.max {
+		var lru *cacheEntry
+		for _, x := range c.ents {
+			if lru == nil || x.used < lru.used {
+				lru = x
+			}
+		}
+		c.size -= int64(len(lru.dat))
+		c.ents[lru.key] = nil, false
+		c.stats.Evictions++
+	}
+	c.tick++
+	e.used = c.tick
+	c.ents[e.key] = e
+	c.size += size
+}
+
+// Where the entry for key lives on disk
+func (c *Cache) file(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%s/%x", c.dir, h.Sum())
+}
+
+// Entries on disk are the Rstat encoded as in a directory, then the data
+func (c *Cache) load(key string) *cacheEntry {
+	if c.dir == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(c.file(key))
+	if err != nil {
+		return nil
+	}
+	e := new(cacheEntry)
+	e.key = key
+	rd := bytes.NewBuffer(buf)
+	e.st = pepys.DecodeDir(rd)
+	e.dat = rd.Bytes()
+	if uint64(len(e.dat)) != e.st.Length {
+		// cut short, perhaps by a crash
+		return nil
+	}
+	return e
+}
+
+func (c *Cache) store(e *cacheEntry) {
+	if c.dir == "" {
+		return
+	}
+	buf := new(bytes.Buffer)
+	pepys.EncodeDir(e.st, buf)
+	buf.Write(e.dat)
+
+	// write it out of the way first, so readers never see half an entry
+	name := c.file(e.key)
+	if ioutil.WriteFile(name + ".tmp", buf.Bytes(), 0600) == nil {
+		os.Rename(name + ".tmp", name)
+	}
+}
+
+// Open name for reading. If the cache has the version the server has, the
+// reads are served from the cache, otherwise the file is read whole and kept.
+// Files longer than the cache keeps in memory are not read on open, but as
+// they are read, from the server.
+func (c *Cache) Open(ctx Context, name string) (*CachedFile, os.Error) {
+	f, err := c.root.Open(ctx, name, "r")
+	if err != nil {
+		return nil, &os.PathError{"open", name, err}
+	}
+	key := path.Clean("/" + name)
+	cf := new(CachedFile)
+	cf.file = NewFile(f)
+	cf.file.ctx = ctx
+	if f.Ftype & pepys.Fversioned == 0 || f.Ftype & pepys.Fdir != 0 {
+		c.count(&c.stats.Uncached)
+		return cf, nil
+	}
+	if e := c.lookup(key, f.Version); e != nil {
+		cf.st = e.st
+		cf.dat = e.dat
+		return cf, nil
+	}
+
+	c.count(&c.stats.Misses)
+	e := new(cacheEntry)
+	e.key = key
+	if e.st, err = cf.file.Stat(); err != nil {
+		cf.Close()
+		return nil, &os.PathError{"open", name, err}
+	}
+	if e.st.Length > uint64(c.max) {
+		return cf, nil
+	}
+	if e.dat, err = readAll(cf.file, e.st); err != nil {
+		cf.Close()
+		return nil, &os.PathError{"open", name, err}
+	}
+	if e.st.Version == f.Version {
+		c.keep(e)
+		c.store(e)
+	}
+	cf.st = e.st
+	cf.dat = e.dat
+	return cf, nil
+}
+
+// Return the whole contents of name
+func (c *Cache) ReadFile(ctx Context, name string) ([]byte, os.Error) {
+	cf, err := c.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer cf.Close()
+	if cf.dat != nil {
+		return cf.dat, nil
+	}
+	st, err := cf.file.Stat()
+	if err != nil {
+		return nil, &os.PathError{"readfile", name, err}
+	}
+	dat, err := readAll(cf.file, st)
+	if err != nil {
+		return nil, &os.PathError{"readfile", name, err}
+	}
+	return dat, nil
+}
+
+// Read the whole contents of an open file, whose metadata is st, setting
+// its length to what was read
+func readAll(f *File, st *pepys.Rstat) ([]byte, os.Error) {
+	// the length is only a hint, go on until the end
+	dat := make([]byte, st.Length + 1)
+	n := 0
+	for {
+		m, err := f.ReadAt(dat[n:], int64(n))
+		n += m
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ndat := make([]byte, 2 * len(dat))
+		copy(ndat, dat)
+		dat = ndat
+	}
+	st.Length = uint64(n)
+	return dat[0:n], nil
+}
+
+// A file opened through a Cache. When the cache has its contents, reads are
+// served from them; otherwise they go to the server as with a File.
+type CachedFile struct {
+	file *File
+	st *pepys.Rstat
+	dat []byte
+
+	// private
+	lock sync.Mutex	// protects offset
+	offset int64
+}
+
+// Whether the contents came from the cache or were read into it on open
+func (cf *CachedFile) Cached() bool {
+	return cf.dat != nil
+}
+
+func (cf *CachedFile) Stat() (*pepys.Rstat, os.Error) {
+	if cf.st != nil {
+		return cf.st, nil
+	}
+	return cf.file.Stat()
+}
+
+func (cf *CachedFile) ReadAt(p []byte, off int64) (int, os.Error) {
+	if cf.dat == nil {
+		return cf.file.ReadAt(p, off)
+	}
+	if off < 0 {
+		return 0, os.EINVAL
+	}
+	if off >= int64(len(cf.dat)) {
+		return 0, os.EOF
+	}
+	n := copy(p, cf.dat[off:])
+	if n < len(p) {
+		return n, os.EOF
+	}
+	return n, nil
+}
+
+func (cf *CachedFile) Read(p []byte) (int, os.Error) {
+	if cf.dat == nil {
+		return cf.file.Read(p)
+	}
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	n, err := cf.ReadAt(p, cf.offset)
+	cf.offset += int64(n)
+	if n > 0 && err == os.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (cf *CachedFile) Seek(offset int64, whence int) (int64, os.Error) {
+	if cf.dat == nil {
+		return cf.file.Seek(offset, whence)
+	}
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+	switch whence {
+	case 0:
+	case 1:
+		offset += cf.offset
+	case 2:
+		offset += int64(len(cf.dat))
+	default:
+		return cf.offset, os.EINVAL
+	}
+	if offset < 0 {
+		return cf.offset, os.EINVAL
+	}
+	cf.offset = offset
+	return offset, nil
+}
+
+func (cf *CachedFile) Close() os.Error {
+	return cf.file.Close()
+}
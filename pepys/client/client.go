@@ -1,2 +1,500 @@
-// client utility methods?
+// The client side of pepys: connections, sessions and fids
 package client
+
+import "os"
+import "net"
+import "sync"
+import "pepys"
+
+// A connection to a file server, with a session established over it. It is
+// safe to use a Conn and its Fids from many goroutines at once.
+type Conn struct {
+	// as agreed with the server
+	Msize uint32
+	Nmsgs uint16
+	Ssid uint32
+	Uname string
+
+	// private
+	handle net.Conn
+	wlock sync.Mutex	// held while sending a group
+	qlock sync.Mutex	// protects what follows
+	calls map[uint32]*call	// groups waiting for a response, by tag
+	tag uint32	// the last tag handed out
+	err os.Error	// set once the connection is dead
+	groups uint64	// groups sent
+	msgs uint64	// messages sent in them
+	fids *fidPool
+}
+
+// A fid on the server
+type Fid struct {
+	// as returned by the server when the fid was opened or created
+	Iounit uint32
+	Ftype uint32
+	Version uint64
+
+	// private
+	conn *Conn
+	num uint32
+	released bool	// num is back in the pool
+}
+
+// An error returned by the server in an Rerror
+type Error struct {
+	Ename string
+}
+
+func (e *Error) String() string {
+	return e.Ename
+}
+
+// Errors with the same text as one of the pepys errors are returned as that
+// error, so that they can be compared against
+var known = []os.Error{
+	pepys.Eperm, pepys.Enotdir, pepys.Enotexist, pepys.Einuse, pepys.Eexist,
+	pepys.Eisdir, pepys.Enotowner, pepys.Eisopen, pepys.Excl, pepys.Ename,
+	pepys.Eversion, pepys.Enotempty, pepys.Ebadfid, pepys.Efidinuse,
+	pepys.Eescape, pepys.Enotimpl,
+}
+
+func rerror(r *pepys.Rerror) os.Error {
+	for _, err := range known {
+		if err.String() == r.Ename {
+			return err
+		}
+	}
+	return &Error{r.Ename}
+}
+
+// A group of messages waiting for its response
+type call struct {
+	tag uint32
+	resp *pepys.Packet
+	err os.Error
+	done chan bool
+}
+
+// Fids are handed out by the client; clunked ones are used again
+type fidPool struct {
+	lock sync.Mutex
+	next uint32
+	free []uint32
+}
+
+func (fp *fidPool) get() uint32 {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+
+	if n := len(fp.free); n > 0 {
+		num := fp.free[n - 1]
+		fp.free = fp.free[0:n - 1]
+		return num
+	}
+	fp.next++
+	return fp.next
+}
+
+func (fp *fidPool) put(num uint32) {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+
+	if len(fp.free) == cap(fp.free) {
+		free := make([]uint32, len(fp.free), 2 * cap(fp.free) + 8)
+		copy(free, fp.free)
+		fp.free = free
+	}
+	fp.free = fp.free[0:len(fp.free) + 1]
+	fp.free[len(fp.free) - 1] = num
+}
+
+// Connect to the file server at addr, agree on the protocol and start a
+// session as uname
+func Dial(ctx Context, network string, addr string, uname string) (*Conn, os.Error) {
+	handle, err := net.Dial(network, "", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(Conn)
+	c.handle = handle
+	c.calls = make(map[uint32]*call, 16)
+	c.fids = new(fidPool)
+	go c.read()
+
+	proto := new(pepys.Tproto)
+	proto.Msize = pepys.Msize
+	proto.Nmsgs = pepys.Nmsgs
+	resp, err := c.Rpc(ctx, proto)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	rproto := resp[0].(*pepys.Rproto)
+	if rproto.Msize > proto.Msize || rproto.Nmsgs > proto.Nmsgs || rproto.Nmsgs == 0 {
+		c.Close()
+		return nil, pepys.Eversion
+	}
+	c.Msize = rproto.Msize
+	c.Nmsgs = rproto.Nmsgs
+
+	session := new(pepys.Tsession)
+	session.Csid = 0x1
+	session.Uname = uname
+	session.Afid = pepys.Nofid
+	if resp, err = c.Rpc(ctx, session); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.Ssid = resp[0].(*pepys.Rsession).Ssid
+	c.Uname = uname
+	return c, nil
+}
+
+func (c *Conn) Close() os.Error {
+	return c.handle.Close()
+}
+
+// Read responses and hand them to whoever is waiting for their tag
+func (c *Conn) read() {
+	for {
+		// the server may agree on less than what Dial asks for, never more
+		pkt, err := pepys.NewPacket(c.handle, pepys.Msize)
+
+		c.qlock.Lock()
+		if err != nil {
+			c.err = err
+			for _, cl := range c.calls {
+				cl.err = err
+				cl.done <- true
+			}
+			c.calls = make(map[uint32]*call)
+			c.qlock.Unlock()
+			return
+		}
+		cl, ok := c.calls[pkt.Tag]
+		if !ok {
+			// nobody asked for this, or they gave up on it
+			c.qlock.Unlock()
+			continue
+		}
+		c.calls[pkt.Tag] = nil, false
+		c.qlock.Unlock()
+
+		cl.resp = pkt
+		cl.done <- true
+	}
+}
+
+// Send a group and return the call to wait on
+func (c *Conn) send(msgs []interface{}) (*call, os.Error) {
+	pkt := new(pepys.Packet)
+	pkt.Msgs = msgs
+	if len(msgs) > int(c.Nmsgs) && c.Nmsgs != 0 {
+		return nil, os.NewError("too many messages in group")
+	}
+
+	cl := new(call)
+	cl.done = make(chan bool, 1)
+
+	c.wlock.Lock()
+	c.qlock.Lock()
+	if c.err != nil {
+		c.qlock.Unlock()
+		c.wlock.Unlock()
+		return nil, c.err
+	}
+	for {
+		c.tag++
+		if c.tag == pepys.Notag {
+			continue
+		}
+		if _, busy := c.calls[c.tag]; !busy {
+			break
+		}
+	}
+	cl.tag = c.tag
+	pkt.Tag = c.tag
+	c.calls[cl.tag] = cl
+	c.groups++
+	c.msgs += uint64(len(msgs))
+	c.qlock.Unlock()
+	err := pkt.Send(c.handle)
+	c.wlock.Unlock()
+	if err != nil {
+		// the reader will notice the connection is gone and wake us
+		c.Close()
+	}
+	return cl, nil
+}
+
+// The responses to a group that went through
+func (cl *call) result(n int) ([]interface{}, os.Error) {
+	if cl.err != nil {
+		return nil, cl.err
+	}
+	resp := cl.resp.Msgs
+	if m := len(resp); m > 0 {
+		if r, ok := resp[m - 1].(*pepys.Rerror); ok {
+			return resp[0:m - 1], rerror(r)
+		}
+	}
+	if len(resp) != n {
+		return resp, os.NewError("short response from server")
+	}
+	return resp, nil
+}
+
+// Send a group of T messages and wait for the response. The R messages of
+// the operations that succeeded are returned; if the server gave up on one
+// of them, the error it gave is returned too and the group was cut short
+// there.
+//
+// If ctx is done first, the group is flushed. If the server answered it
+// all the same, the group took effect and its responses are returned as
+// usual. Otherwise ctx.Err() is returned with no responses: the server
+// never started the group, so it made no fids, and the fids of its Tclunk
+// and Tremove messages are clunked, so that they are gone either way.
+func (c *Conn) Rpc(ctx Context, msgs ...interface{}) ([]interface{}, os.Error) {
+	cl, err := c.send(msgs)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-cl.done:
+		return cl.result(len(msgs))
+	case <-ctx.Done():
+	}
+	// when both are ready select picks either, and the response may
+	// have been there all along
+	select {
+	case <-cl.done:
+		return cl.result(len(msgs))
+	default:
+	}
+	if c.flush(cl, msgs) {
+		return cl.result(len(msgs))
+	}
+	return nil, ctx.Err()
+}
+
+// Flush the group of cl and tidy up after it, unless the server answered
+// the group before the flush: then it says so and cl has the responses.
+func (c *Conn) flush(cl *call, msgs []interface{}) bool {
+	tf := new(pepys.Tflush)
+	tf.Oldtag = cl.tag
+	fl, err := c.send([]interface{}{tf})
+	if err != nil {
+		return false
+	}
+	<-fl.done
+
+	// The server answers a group it started before the Rflush, and one it
+	// never started not at all, so by now we know which it was
+	c.qlock.Lock()
+	c.calls[cl.tag] = nil, false
+	c.qlock.Unlock()
+	select {
+	case <-cl.done:
+		// done before the flush, with the fids gone if the connection is
+		return cl.err == nil
+	default:
+	}
+	if fl.err != nil {
+		return false
+	}
+	c.undo(msgs)
+	return false
+}
+
+// Let go of the fids of a group the server never started: those it would
+// have clunked or removed. It made none.
+func (c *Conn) undo(msgs []interface{}) {
+	for _, msg := range msgs {
+		fid := pepys.Nofid
+		switch m := msg.(type) {
+		case *pepys.Tclunk:
+			fid = m.Fid
+		case *pepys.Tremove:
+			fid = m.Fid
+		}
+		if fid != pepys.Nofid {
+			cl := new(pepys.Tclunk)
+			cl.Fid = fid
+			c.Rpc(Background(), cl)
+		}
+	}
+}
+
+// How many groups have been sent so far, and how many messages were in them;
+// without groups each message would have been a round trip of its own
+func (c *Conn) Stats() (groups uint64, msgs uint64) {
+	c.qlock.Lock()
+	defer c.qlock.Unlock()
+	return c.groups, c.msgs
+}
+
+func (c *Conn) newFid() *Fid {
+	f := new(Fid)
+	f.conn = c
+	f.num = c.fids.get()
+	return f
+}
+
+// Give the number of f back to the pool, once: a batch may have both
+// made f and clunked it, and the two fail together when flushed
+func (f *Fid) release() {
+	if !f.released {
+		f.released = true
+		f.conn.fids.put(f.num)
+	}
+}
+
+// Attach to the tree called aname, returning a fid for its root
+func (c *Conn) Attach(ctx Context, aname string) (*Fid, os.Error) {
+	f := c.newFid()
+	at := new(pepys.Tattach)
+	at.Fid = f.num
+	at.Afid = pepys.Nofid
+	at.Uname = c.Uname
+	at.Aname = aname
+	if _, err := c.Rpc(ctx, at); err != nil {
+		c.fids.put(f.num)
+		return nil, err
+	}
+	return f, nil
+}
+
+// Return the number of the fid, for those who build messages themselves
+func (f *Fid) Num() uint32 {
+	return f.num
+}
+
+func (f *Fid) Conn() *Conn {
+	return f.conn
+}
+
+// Open the file at path, relative to the directory f, with the given mode.
+// An empty mode just makes a new fid for the file.
+func (f *Fid) Open(ctx Context, path string, mode string) (*Fid, os.Error) {
+	nf := f.conn.newFid()
+	op := new(pepys.Topen)
+	op.Fid = f.num
+	op.Nfid = nf.num
+	op.Path = path
+	op.Mode = mode
+	resp, err := f.conn.Rpc(ctx, op)
+	if err != nil {
+		f.conn.fids.put(nf.num)
+		return nil, err
+	}
+	ro := resp[0].(*pepys.Ropen)
+	nf.Iounit = ro.Iounit
+	nf.Ftype = ro.Ftype
+	nf.Version = ro.Version
+	return nf, nil
+}
+
+// Create the file name, opened with the given mode, in the directory f.
+// The perm bits may include pepys.Pdir to make a directory.
+func (f *Fid) Create(ctx Context, name string, perm uint32, mode string) (*Fid, os.Error) {
+	// a Tcreate turns the fid into the new file, so make a new fid for the
+	// directory first, all in one group
+	nf := f.conn.newFid()
+	op := new(pepys.Topen)
+	op.Fid = f.num
+	op.Nfid = nf.num
+	op.Path = "."
+	cr := new(pepys.Tcreate)
+	cr.Fid = nf.num
+	cr.Name = name
+	cr.Perm = perm
+	cr.Mode = mode
+	resp, err := f.conn.Rpc(ctx, op, cr)
+	if err != nil {
+		if len(resp) > 0 {
+			// the new fid exists, but not the file
+			nf.Clunk(Background())
+		} else {
+			f.conn.fids.put(nf.num)
+		}
+		return nil, err
+	}
+	rc := resp[1].(*pepys.Rcreate)
+	nf.Iounit = rc.Iounit
+	nf.Version = rc.Version
+	if perm & pepys.Pdir != 0 {
+		nf.Ftype = pepys.Fdir
+	}
+	return nf, nil
+}
+
+// Read at most count bytes at offset
+func (f *Fid) Read(ctx Context, offset uint64, count uint32) ([]byte, os.Error) {
+	rd := new(pepys.Tread)
+	rd.Fid = f.num
+	rd.Offset = offset
+	rd.Count = count
+	resp, err := f.conn.Rpc(ctx, rd)
+	if err != nil {
+		return nil, err
+	}
+	return resp[0].(*pepys.Rread).Dat, nil
+}
+
+// Write dat at offset, returning how much the server took
+func (f *Fid) Write(ctx Context, offset uint64, dat []byte) (uint32, os.Error) {
+	wr := new(pepys.Twrite)
+	wr.Fid = f.num
+	wr.Offset = offset
+	wr.Dat = dat
+	resp, err := f.conn.Rpc(ctx, wr)
+	if err != nil {
+		return 0, err
+	}
+	return resp[0].(*pepys.Rwrite).Count, nil
+}
+
+// Remove the file; the fid is gone afterwards, even if that failed
+func (f *Fid) Remove(ctx Context) os.Error {
+	rm := new(pepys.Tremove)
+	rm.Fid = f.num
+	_, err := f.conn.Rpc(ctx, rm)
+	f.release()
+	return err
+}
+
+// Let go of the fid
+func (f *Fid) Clunk(ctx Context) os.Error {
+	cl := new(pepys.Tclunk)
+	cl.Fid = f.num
+	cl.Version = f.Version
+	_, err := f.conn.Rpc(ctx, cl)
+	f.release()
+	return err
+}
+
+func (f *Fid) Stat(ctx Context) (*pepys.Rstat, os.Error) {
+	st := new(pepys.Tstat)
+	st.Fid = f.num
+	resp, err := f.conn.Rpc(ctx, st)
+	if err != nil {
+		return nil, err
+	}
+	return resp[0].(*pepys.Rstat), nil
+}
+
+// Return a Twstat that changes nothing, to fill in and pass to Wstat
+func NewWstat() *pepys.Twstat {
+	wst := new(pepys.Twstat)
+	wst.Perm = pepys.Noperm
+	wst.Length = pepys.Nolength
+	wst.Mtime = pepys.Notime
+	return wst
+}
+
+func (f *Fid) Wstat(ctx Context, wst *pepys.Twstat) os.Error {
+	wst.Fid = f.num
+	_, err := f.conn.Rpc(ctx, wst)
+	return err
+}
@@ -0,0 +1,88 @@
+package client
+
+import "os"
+import "sync"
+import "time"
+
+// A Context lets a caller give up on an operation. Done returns a channel
+// that is closed once the operation should be abandoned, or nil if that
+// never happens; Err then says why.
+type Context interface {
+	Done() <-chan bool
+	Err() os.Error
+}
+
+var (
+	Canceled = os.NewError("context canceled")
+	DeadlineExceeded = os.NewError("context deadline exceeded")
+)
+
+type background int
+
+func (background) Done() <-chan bool {
+	return nil
+}
+func (background) Err() os.Error {
+	return nil
+}
+
+// A Context that is never done
+func Background() Context {
+	return background(0)
+}
+
+type cancelCtx struct {
+	done chan bool
+	lock sync.Mutex	// protects err
+	err os.Error
+}
+
+func (c *cancelCtx) Done() <-chan bool {
+	return c.done
+}
+
+func (c *cancelCtx) Err() os.Error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+func (c *cancelCtx) cancel(err os.Error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+	}
+}
+
+// Done as soon as parent is, or when the returned function is called
+func WithCancel(parent Context) (Context, func()) {
+	c := new(cancelCtx)
+	c.done = make(chan bool)
+	if pd := parent.Done(); pd != nil {
+		go func() {
+			select {
+			case <-pd:
+				c.cancel(parent.Err())
+			case <-c.done:
+			}
+		}()
+	}
+	return c, func() { c.cancel(Canceled) }
+}
+
+// Done after ns nanoseconds, as soon as parent is, or when the returned
+// function is called
+func WithTimeout(parent Context, ns int64) (Context, func()) {
+	ctx, cancel := WithCancel(parent)
+	c := ctx.(*cancelCtx)
+	go func() {
+		select {
+		case <-time.After(ns):
+			c.cancel(DeadlineExceeded)
+		case <-c.done:
+		}
+	}()
+	return ctx, cancel
+}
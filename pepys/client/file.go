@@ -0,0 +1,222 @@
+package client
+
+import "io"
+import "os"
+import "sync"
+import "pepys"
+
+// How many reads or writes a File keeps in flight at once
+var Depth = 8
+
+// An open fid that fits the io interfaces. Large reads and writes are cut
+// into pieces of Iounit bytes that are sent without waiting for each other,
+// but for writes to append-only files, which go one after the other.
+// As the io interfaces have no room for a Context, a File has one of its own.
+type File struct {
+	fid *Fid
+	ctx Context
+
+	// private
+	lock sync.Mutex	// protects what follows
+	offset int64
+	ents []*pepys.Rstat	// directory entries read but not returned yet
+}
+
+func NewFile(fid *Fid) *File {
+	f := new(File)
+	f.fid = fid
+	f.ctx = Background()
+	return f
+}
+
+// Use ctx for the operations of f from now on
+func (f *File) SetContext(ctx Context) {
+	f.ctx = ctx
+}
+
+// Open the file at path, relative to the directory f, for use with io
+func (f *Fid) OpenFile(ctx Context, path string, mode string) (*File, os.Error) {
+	nf, err := f.Open(ctx, path, mode)
+	if err != nil {
+		return nil, err
+	}
+	file := NewFile(nf)
+	file.ctx = ctx
+	return file, nil
+}
+
+// Create the file name in the directory f, for use with io
+func (f *Fid) CreateFile(ctx Context, name string, perm uint32, mode string) (*File, os.Error) {
+	nf, err := f.Create(ctx, name, perm, mode)
+	if err != nil {
+		return nil, err
+	}
+	file := NewFile(nf)
+	file.ctx = ctx
+	return file, nil
+}
+
+func (f *File) Fid() *Fid {
+	return f.fid
+}
+
+func (f *File) Stat() (*pepys.Rstat, os.Error) {
+	return f.fid.Stat(f.ctx)
+}
+
+// The largest piece of data one message may carry
+func (f *File) iounit() int {
+	max := f.fid.conn.Msize - pepys.Iohdrsz
+	if f.fid.Iounit == 0 || f.fid.Iounit > max {
+		return int(max)
+	}
+	return int(f.fid.Iounit)
+}
+
+// Call op for the pieces 0 to n-1, with up to depth of them at once
+func pipeline(n int, depth int, op func(i int)) {
+	if depth < 1 {
+		depth = 1
+	}
+	slots := make(chan bool, depth)
+	done := make(chan bool, n)
+	for i := 0; i < n; i++ {
+		slots <- true
+		go func(i int) {
+			op(i)
+			<-slots
+			done <- true
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		<-done
+	}
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, os.Error) {
+	if off < 0 {
+		return 0, os.EINVAL
+	}
+	iounit := f.iounit()
+	pieces := (len(p) + iounit - 1) / iounit
+	counts := make([]int, pieces)
+	errs := make([]os.Error, pieces)
+	pipeline(pieces, Depth, func(i int) {
+		lo := i * iounit
+		hi := lo + iounit
+		if hi > len(p) {
+			hi = len(p)
+		}
+		dat, err := f.fid.Read(f.ctx, uint64(off) + uint64(lo), uint32(hi - lo))
+		counts[i] = copy(p[lo:hi], dat)
+		errs[i] = err
+	})
+
+	// the data is good up to the first error or short read
+	n := 0
+	for i := range counts {
+		if errs[i] != nil {
+			return n, errs[i]
+		}
+		n += counts[i]
+		if counts[i] < iounit {
+			break
+		}
+	}
+	if n < len(p) {
+		return n, os.EOF
+	}
+	return n, nil
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, os.Error) {
+	if off < 0 {
+		return 0, os.EINVAL
+	}
+	iounit := f.iounit()
+	pieces := (len(p) + iounit - 1) / iounit
+	counts := make([]int, pieces)
+	errs := make([]os.Error, pieces)
+	depth := Depth
+	if f.fid.Ftype & pepys.Fappend != 0 {
+		// the server puts each piece at the end, whatever the offset, so
+		// they must get there in order
+		depth = 1
+	}
+	pipeline(pieces, depth, func(i int) {
+		lo := i * iounit
+		hi := lo + iounit
+		if hi > len(p) {
+			hi = len(p)
+		}
+		count, err := f.fid.Write(f.ctx, uint64(off) + uint64(lo), p[lo:hi])
+		counts[i] = int(count)
+		errs[i] = err
+	})
+
+	n := 0
+	for i := range counts {
+		if errs[i] != nil {
+			return n, errs[i]
+		}
+		n += counts[i]
+		if counts[i] < iounit && n < len(p) {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+func (f *File) Read(p []byte) (int, os.Error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if n > 0 && err == os.EOF {
+		// the next read will say so
+		err = nil
+	}
+	return n, err
+}
+
+func (f *File) Write(p []byte) (int, os.Error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, os.Error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch whence {
+	case 0:
+	case 1:
+		offset += f.offset
+	case 2:
+		st, err := f.fid.Stat(f.ctx)
+		if err != nil {
+			return f.offset, err
+		}
+		offset += int64(st.Length)
+	default:
+		return f.offset, os.EINVAL
+	}
+	if offset < 0 {
+		return f.offset, os.EINVAL
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Close lets go of the fid even once the Context of f is done
+func (f *File) Close() os.Error {
+	return f.fid.Clunk(Background())
+}
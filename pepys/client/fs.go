@@ -0,0 +1,213 @@
+package client
+
+import "os"
+import "sort"
+import "bytes"
+import "pepys"
+import "strings"
+
+// An FS is an attached tree seen as a file system with Open, Stat, ReadFile
+// and ReadDir: names are slash separated paths from the root, without a
+// leading slash, and "." is the root itself.
+type FS struct {
+	root *Fid
+	ctx Context
+}
+
+func NewFS(root *Fid) *FS {
+	fsys := new(FS)
+	fsys.root = root
+	fsys.ctx = Background()
+	return fsys
+}
+
+// Use ctx for the operations of fsys, and the Files it opens, from now on
+func (fsys *FS) SetContext(ctx Context) {
+	fsys.ctx = ctx
+}
+
+// Attach to the tree called aname and return it as an FS
+func (c *Conn) FS(ctx Context, aname string) (*FS, os.Error) {
+	root, err := c.Attach(ctx, aname)
+	if err != nil {
+		return nil, err
+	}
+	fsys := NewFS(root)
+	fsys.ctx = ctx
+	return fsys, nil
+}
+
+func (fsys *FS) file(f *Fid) *File {
+	file := NewFile(f)
+	file.ctx = fsys.ctx
+	return file
+}
+
+// Check a name the way fs.ValidPath does
+func validPath(name string) bool {
+	if name == "." {
+		return true
+	}
+	for _, elem := range strings.Split(name, "/", -1) {
+		if elem == "" || elem == "." || elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func (fsys *FS) open(op string, name string, mode string) (*Fid, os.Error) {
+	if !validPath(name) {
+		return nil, &os.PathError{op, name, os.EINVAL}
+	}
+	f, err := fsys.root.Open(fsys.ctx, name, mode)
+	if err != nil {
+		return nil, &os.PathError{op, name, err}
+	}
+	return f, nil
+}
+
+// Open name for reading
+func (fsys *FS) Open(name string) (*File, os.Error) {
+	f, err := fsys.open("open", name, "r")
+	if err != nil {
+		return nil, err
+	}
+	return fsys.file(f), nil
+}
+
+func (fsys *FS) Stat(name string) (*pepys.Rstat, os.Error) {
+	if !validPath(name) {
+		return nil, &os.PathError{"stat", name, os.EINVAL}
+	}
+	// open, stat and clunk in one round trip
+	b := fsys.root.conn.Batch()
+	op := b.Open(fsys.root, name, "")
+	st := b.Stat(op.Fid)
+	cl := b.Clunk(op.Fid)
+	if err := b.Send(fsys.ctx); err != nil {
+		if op.Err() == nil && cl.Err() == Eskipped {
+			op.Fid.Clunk(Background())
+		}
+		return nil, &os.PathError{"stat", name, err}
+	}
+	return st.Stat()
+}
+
+// Return the whole contents of name
+func (fsys *FS) ReadFile(name string) ([]byte, os.Error) {
+	if !validPath(name) {
+		return nil, &os.PathError{"readfile", name, os.EINVAL}
+	}
+	// open and find out how much there is in one round trip
+	b := fsys.root.conn.Batch()
+	op := b.Open(fsys.root, name, "r")
+	st := b.Stat(op.Fid)
+	if err := b.Send(fsys.ctx); err != nil {
+		if op.Err() == nil {
+			op.Fid.Clunk(Background())
+		}
+		return nil, &os.PathError{"readfile", name, err}
+	}
+	f := fsys.file(op.Fid)
+	defer f.Close()
+
+	rst, _ := st.Stat()
+	if rst.Ftype & pepys.Fdir != 0 {
+		return nil, &os.PathError{"readfile", name, pepys.Eisdir}
+	}
+
+	// the length may be out of date by the time we read, or not known at
+	// all for synthetic files, so go on until the end
+	dat := make([]byte, rst.Length + 1)
+	n := 0
+	for {
+		m, err := f.ReadAt(dat[n:], int64(n))
+		n += m
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &os.PathError{"readfile", name, err}
+		}
+		ndat := make([]byte, 2 * len(dat))
+		copy(ndat, dat)
+		dat = ndat
+	}
+	return dat[0:n], nil
+}
+
+// Return the entries of the directory name, sorted by name
+func (fsys *FS) ReadDir(name string) ([]*pepys.Rstat, os.Error) {
+	fid, err := fsys.open("readdir", name, "r")
+	if err != nil {
+		return nil, err
+	}
+	f := fsys.file(fid)
+	defer f.Close()
+
+	ents, err := f.Readdir(-1)
+	if err != nil {
+		return nil, &os.PathError{"readdir", name, err}
+	}
+	sort.Sort(byName(ents))
+	return ents, nil
+}
+
+type byName []*pepys.Rstat
+
+func (s byName) Len() int {
+	return len(s)
+}
+func (s byName) Less(i, j int) bool {
+	return s[i].Name < s[j].Name
+}
+func (s byName) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// Return the next n entries of a directory opened for reading, or all the
+// ones left if n <= 0. As with os.File.Readdir, reading past the last entry
+// returns os.EOF when n > 0.
+func (f *File) Readdir(n int) ([]*pepys.Rstat, os.Error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for n <= 0 || len(f.ents) < n {
+		dat, err := f.fid.Read(f.ctx, uint64(f.offset), uint32(f.iounit()))
+		if err != nil {
+			return nil, err
+		}
+		if len(dat) == 0 {
+			break
+		}
+		f.offset += int64(len(dat))
+		buf := bytes.NewBuffer(dat)
+		for buf.Len() > 0 {
+			f.ents = push(f.ents, pepys.DecodeDir(buf))
+		}
+	}
+
+	m := n
+	if m <= 0 || m > len(f.ents) {
+		m = len(f.ents)
+	}
+	ents := make([]*pepys.Rstat, m)
+	copy(ents, f.ents[0:m])
+	f.ents = f.ents[m:]
+	if n > 0 && m == 0 {
+		return ents, os.EOF
+	}
+	return ents, nil
+}
+
+func push(ents []*pepys.Rstat, ent *pepys.Rstat) []*pepys.Rstat {
+	if len(ents) == cap(ents) {
+		nents := make([]*pepys.Rstat, len(ents), 2 * cap(ents) + 8)
+		copy(nents, ents)
+		ents = nents
+	}
+	ents = ents[0:len(ents) + 1]
+	ents[len(ents) - 1] = ent
+	return ents
+}
@@ -0,0 +1,172 @@
+package client
+
+import "os"
+import "fmt"
+import "pepys"
+import "reflect"
+import "strconv"
+import "strings"
+
+// Messages written out as text, for tools that let people talk to a server
+// directly: the message name is followed by Field=value pairs, such as
+//
+//	Topen Fid=1 Nfid=2 Path="/a b" Mode=r
+//
+// Fields left out are zero, numbers may be given as ~0 for all ones, and
+// values with spaces are quoted as in Go.
+
+// A new, zero T message called name
+func NewMsg(name string) (interface{}, os.Error) {
+	switch name {
+	case "Tproto":
+		return new(pepys.Tproto), nil
+	case "Tsession":
+		return new(pepys.Tsession), nil
+	case "Tattach":
+		return new(pepys.Tattach), nil
+	case "Tflush":
+		return new(pepys.Tflush), nil
+	case "Topen":
+		return new(pepys.Topen), nil
+	case "Tcreate":
+		return new(pepys.Tcreate), nil
+	case "Tread":
+		return new(pepys.Tread), nil
+	case "Twrite":
+		return new(pepys.Twrite), nil
+	case "Tclunk":
+		return new(pepys.Tclunk), nil
+	case "Tremove":
+		return new(pepys.Tremove), nil
+	case "Tstat":
+		return new(pepys.Tstat), nil
+	case "Twstat":
+		return new(pepys.Twstat), nil
+	}
+	return nil, os.NewError("unknown message " + name)
+}
+
+// Split a line into words, keeping quoted values whole
+func words(line string) ([]string, os.Error) {
+	ws := make([]string, 0, 8)
+	for {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return ws, nil
+		}
+		end := 0
+		quoted := false
+		for ; end < len(line); end++ {
+			c := line[end]
+			if c == '\\' && quoted {
+				end++
+			} else if c == '"' {
+				quoted = !quoted
+			} else if (c == ' ' || c == '\t') && !quoted {
+				break
+			}
+		}
+		if quoted {
+			return nil, os.NewError("unterminated quote")
+		}
+		if len(ws) == cap(ws) {
+			nws := make([]string, len(ws), 2 * cap(ws))
+			copy(nws, ws)
+			ws = nws
+		}
+		ws = ws[0:len(ws) + 1]
+		ws[len(ws) - 1] = line[0:end]
+		line = line[end:]
+	}
+	return ws, nil
+}
+
+// Parse a T message written out as text
+func ParseMsg(line string) (interface{}, os.Error) {
+	ws, err := words(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(ws) == 0 {
+		return nil, os.NewError("empty message")
+	}
+	msg, err := NewMsg(ws[0])
+	if err != nil {
+		return nil, err
+	}
+	sv := reflect.NewValue(msg).(*reflect.PtrValue).Elem().(*reflect.StructValue)
+	for _, w := range ws[1:] {
+		eq := strings.Index(w, "=")
+		if eq < 0 {
+			return nil, os.NewError("expected Field=value, got " + w)
+		}
+		name, val := w[0:eq], w[eq+1:]
+		if len(val) > 0 && val[0] == '"' {
+			if val, err = strconv.Unquote(val); err != nil {
+				return nil, os.NewError("bad quoted value for " + name)
+			}
+		}
+		switch f := sv.FieldByName(name).(type) {
+		case *reflect.UintValue:
+			var n uint64
+			if val == "~0" {
+				n = ^uint64(0)
+			} else if n, err = strconv.Btoui64(val, 0); err != nil {
+				return nil, os.NewError("bad number for " + name + ": " + val)
+			}
+			f.Set(n)
+		case *reflect.StringValue:
+			f.Set(val)
+		case *reflect.SliceValue:
+			f.SetValue(reflect.NewValue([]byte(val)))
+		default:
+			return nil, os.NewError(ws[0] + " has no field " + name)
+		}
+	}
+	return msg, nil
+}
+
+// Write out any message as text, the way ParseMsg reads it
+func FormatMsg(msg interface{}) string {
+	pv, ok := reflect.NewValue(msg).(*reflect.PtrValue)
+	if !ok {
+		return fmt.Sprintf("%v", msg)
+	}
+	sv, ok := pv.Elem().(*reflect.StructValue)
+	if !ok {
+		return fmt.Sprintf("%v", msg)
+	}
+	st := sv.Type().(*reflect.StructType)
+	s := st.Name()
+	for i := 0; i < sv.NumField(); i++ {
+		s += " " + st.Field(i).Name + "="
+		switch f := sv.Field(i).(type) {
+		case *reflect.UintValue:
+			s += strconv.Uitoa64(f.Get())
+		case *reflect.StringValue:
+			s += quote(f.Get())
+		case *reflect.SliceValue:
+			s += quote(string(f.Interface().([]byte)))
+		default:
+			s += fmt.Sprintf("%v", f.Interface())
+		}
+	}
+	return s
+}
+
+func quote(s string) string {
+	if s == "" || !plain(s) {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// Whether s reads back as itself without quotes
+func plain(s string) bool {
+	for _, c := range s {
+		if c <= ' ' || c == '"' || c == '\\' || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
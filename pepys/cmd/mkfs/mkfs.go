@@ -0,0 +1,174 @@
+// mkfs lays out a pepys file system on a disk or disk image
+package main
+
+import "os"
+import "fmt"
+import "flag"
+import "strconv"
+import "pepys/disk"
+
+var size = flag.String("s", "", "create the image, sparse, with this size")
+var bsize = flag.String("b", "512", "block size")
+var asize = flag.String("a", "1G", "arena size")
+var files = flag.String("f", "0", "files the index must hold, 0 to size it by the disk")
+var config = flag.String("c", "8M", "size of the config area")
+var dryrun = flag.Bool("n", false, "print the layout without writing anything")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: mkfs [flags] image\n\n")
+	fmt.Fprintf(os.Stderr, "sizes may end in K, M or G\n\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// Parse a number of bytes, possibly with a K, M or G suffix
+func parseSize(s string) (uint64, os.Error) {
+	mul := uint64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k', 'K':
+			mul = disk.K
+		case 'm', 'M':
+			mul = disk.M
+		case 'g', 'G':
+			mul = disk.G
+		}
+		if mul != 1 {
+			s = s[0 : n-1]
+		}
+	}
+	v, err := strconv.Btoui64(s, 0)
+	if err != nil {
+		return 0, err
+	}
+	if v*mul/mul != v {
+		return 0, os.ERANGE
+	}
+	return v * mul, nil
+}
+
+func mustBytes(name string, s string) uint64 {
+	v, err := parseSize(s)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mkfs: bad %s %q\n", name, s)
+		usage()
+	}
+	return v
+}
+
+// A size the way people read it
+func human(n uint64) string {
+	switch {
+	case n >= disk.G && n%disk.G == 0:
+		return fmt.Sprintf("%d GB", n/disk.G)
+	case n >= disk.M && n%disk.M == 0:
+		return fmt.Sprintf("%d MB", n/disk.M)
+	case n >= disk.K && n%disk.K == 0:
+		return fmt.Sprintf("%d KB", n/disk.K)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+func area(name string, addr uint64, size uint64) {
+	fmt.Printf("%-10s %#14x %#14x  %s\n", name, addr, size, human(size))
+}
+
+// Print where everything is on the disk, in disk order
+func layout(s *disk.Super) {
+	fmt.Printf("size %d (%s), block size %d, %d arenas of %s\n",
+		s.Size, human(s.Size), s.Bsize, s.Narena, human(s.Asize))
+	fmt.Printf("index holds %d entries\n\n", s.Maxvids())
+	fmt.Printf("%-10s %14s %14s\n", "area", "address", "size")
+	addr := s.Addr()
+	area("config", 0, s.Config)
+	area("super", addr[0], disk.Supersize)
+	area("vidx", s.Vidx[0], s.Vids)
+	area("atab", s.Atab, s.Atas)
+	arenas := s.Asize * uint64(s.Narena)
+	area("arenas", s.Arenas, arenas)
+	if end := s.Arenas + arenas; end < s.Vidx[1] {
+		area("unused", end, s.Vidx[1]-end)
+	}
+	area("vidx", s.Vidx[1], s.Vids)
+	area("super", addr[1], disk.Supersize)
+	if end := addr[1] + disk.Supersize; end < s.Size {
+		area("unused", end, s.Size-end)
+	}
+}
+
+// Make a sparse image of the given size, keeping what is in it already
+func create(name string, size uint64) os.Error {
+	f, err := os.Open(name, os.O_RDWR|os.O_CREAT, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Truncate(int64(size))
+}
+
+// How big an image or a device is
+func imageSize(name string) (uint64, os.Error) {
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.Seek(0, 2)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(n), nil
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+	}
+	name := flag.Arg(0)
+
+	g := new(disk.Geometry)
+	g.Bsize = int(mustBytes("block size", *bsize))
+	g.Asize = mustBytes("arena size", *asize)
+	g.Files = mustBytes("file count", *files)
+	g.Config = mustBytes("config size", *config)
+
+	var n uint64
+	if *size != "" {
+		n = mustBytes("image size", *size)
+	} else {
+		var err os.Error
+		if n, err = imageSize(name); err != nil {
+			fmt.Fprintf(os.Stderr, "mkfs: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	s, err := disk.NewSuper(n, g)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mkfs: %s: %s\n", name, err)
+		os.Exit(1)
+	}
+	layout(s)
+	if *dryrun {
+		return
+	}
+
+	if *size != "" {
+		if err = create(name, n); err != nil {
+			fmt.Fprintf(os.Stderr, "mkfs: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	dk, err := disk.New(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mkfs: %s\n", err)
+		os.Exit(1)
+	}
+	defer dk.Close()
+	if err = dk.CreateSuper(g); err != nil {
+		fmt.Fprintf(os.Stderr, "mkfs: %s\n", err)
+		os.Exit(1)
+	}
+}
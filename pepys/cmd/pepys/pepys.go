@@ -0,0 +1,434 @@
+// pepys talks to a file server from the command line
+package main
+
+import "io"
+import "os"
+import "fmt"
+import "flag"
+import "path"
+import "time"
+import "bufio"
+import "pepys"
+import "strings"
+import "pepys/client"
+
+var addr = flag.String("a", "localhost:5640", "address of the server")
+var uname = flag.String("u", os.Getenv("USER"), "user to start the session as")
+var aname = flag.String("n", "/", "tree to attach to")
+var timeout = flag.Int64("t", 0, "give up after this many seconds, never if 0")
+
+// Done once the timeout is up
+var ctx = client.Background()
+
+// Exit codes. Errors from the server that are one of the pepys errors get a
+// code of their own, other server errors exit with Eserver.
+const (
+	Eok = 0
+	Eserver = 1
+	Eusage = 2
+	Edial = 3
+	Elocal = 4
+)
+
+var codes = []os.Error{
+	pepys.Enotexist,	// 10
+	pepys.Eperm,
+	pepys.Eexist,
+	pepys.Enotdir,
+	pepys.Eisdir,
+	pepys.Enotempty,
+	pepys.Einuse,
+	pepys.Eisopen,
+	pepys.Excl,
+	pepys.Ename,
+	pepys.Enotowner,
+	pepys.Ebadfid,
+	pepys.Efidinuse,
+	pepys.Eescape,
+	pepys.Eversion,
+	pepys.Enotimpl,
+}
+
+func exitCode(err os.Error) int {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Error
+	}
+	for i, e := range codes {
+		if err == e {
+			return 10 + i
+		}
+	}
+	if _, ok := err.(*client.Error); ok {
+		return Eserver
+	}
+	return Elocal
+}
+
+// The first error decides how we exit
+var status = Eok
+
+func fail(name string, err os.Error) {
+	fmt.Fprintf(os.Stderr, "pepys: %s: %s\n", name, err)
+	if status == Eok {
+		status = exitCode(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: pepys [flags] command [args]\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	fmt.Fprintf(os.Stderr, "\tls [-l] [path...]\tlist files or directories\n")
+	fmt.Fprintf(os.Stderr, "\tcat path...\t\twrite files to standard output\n")
+	fmt.Fprintf(os.Stderr, "\twrite path\t\tcopy standard input to a file\n")
+	fmt.Fprintf(os.Stderr, "\tput local path\t\tcopy a local file to the server\n")
+	fmt.Fprintf(os.Stderr, "\tget path [local]\tcopy a file from the server\n")
+	fmt.Fprintf(os.Stderr, "\tstat path...\t\tshow everything about files\n")
+	fmt.Fprintf(os.Stderr, "\trm path...\t\tremove files\n")
+	fmt.Fprintf(os.Stderr, "\tmkdir path...\t\tmake directories\n")
+	fmt.Fprintf(os.Stderr, "\traw [msg...]\t\tsend messages as one group, or groups\n")
+	fmt.Fprintf(os.Stderr, "\t\t\t\tread one per line with messages split by ;\n\n")
+	fmt.Fprintf(os.Stderr, "flags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nexit status: 0 ok, 1 other server error, 2 usage, 3 no connection,\n")
+	fmt.Fprintf(os.Stderr, "4 local error, 10 and up the server error:\n")
+	for i, e := range codes {
+		fmt.Fprintf(os.Stderr, "\t%d\t%s\n", 10 + i, e)
+	}
+	os.Exit(Eusage)
+}
+
+// Names on the command line may start with a slash, FS names do not
+func fsName(name string) string {
+	name = path.Clean(name)
+	for strings.HasPrefix(name, "/") {
+		name = name[1:]
+	}
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func fsNames(names []string) []string {
+	fsn := make([]string, len(names))
+	for i, name := range names {
+		fsn[i] = fsName(name)
+	}
+	return fsn
+}
+
+func permString(st *pepys.Rstat) string {
+	s := "-"
+	if st.Ftype & pepys.Fdir != 0 {
+		s = "d"
+	} else if st.Ftype & pepys.Fappend != 0 {
+		s = "a"
+	}
+	for shift := uint(6); ; shift -= 3 {
+		p := st.Perm >> shift
+		for i, c := range "rwx" {
+			if p & (4 >> uint(i)) != 0 {
+				s += string(c)
+			} else {
+				s += "-"
+			}
+		}
+		if shift == 0 {
+			break
+		}
+	}
+	return s
+}
+
+func timeString(ns uint64) string {
+	return time.SecondsToLocalTime(int64(ns / 1e9)).Format("Jan _2 15:04")
+}
+
+func lsLine(st *pepys.Rstat, long bool, name string) {
+	if st.Ftype & pepys.Fdir != 0 && !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	if !long {
+		fmt.Printf("%s\n", name)
+		return
+	}
+	fmt.Printf("%s %-8s %-8s %10d %s %s\n", permString(st), st.Uid, st.Gid, st.Length, timeString(st.Mtime), name)
+}
+
+func ls(fsys *client.FS, args []string) {
+	long := false
+	if len(args) > 0 && args[0] == "-l" {
+		long = true
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	for _, name := range args {
+		st, err := fsys.Stat(name)
+		if err != nil {
+			fail(name, err)
+			continue
+		}
+		if st.Ftype & pepys.Fdir == 0 {
+			lsLine(st, long, name)
+			continue
+		}
+		ents, err := fsys.ReadDir(name)
+		if err != nil {
+			fail(name, err)
+			continue
+		}
+		if len(args) > 1 {
+			fmt.Printf("%s:\n", name)
+		}
+		for _, ent := range ents {
+			lsLine(ent, long, ent.Name)
+		}
+	}
+}
+
+func cat(fsys *client.FS, args []string) {
+	for _, name := range args {
+		f, err := fsys.Open(name)
+		if err != nil {
+			fail(name, err)
+			continue
+		}
+		if _, err = io.Copy(os.Stdout, f); err != nil {
+			fail(name, err)
+		}
+		f.Close()
+	}
+}
+
+// Open name for writing from the start, creating it if need be
+func create(root *client.Fid, name string) (*client.File, os.Error) {
+	f, err := root.OpenFile(ctx, name, "wt")
+	if err != pepys.Enotexist {
+		return f, err
+	}
+	dir, file := path.Split(name)
+	if dir == "" {
+		dir = "."
+	}
+	d, err := root.Open(ctx, dir, "")
+	if err != nil {
+		return nil, err
+	}
+	defer d.Clunk(client.Background())
+	return d.CreateFile(ctx, file, 0666, "w")
+}
+
+func put(root *client.Fid, src io.Reader, name string) {
+	f, err := create(root, name)
+	if err != nil {
+		fail(name, err)
+		return
+	}
+	if _, err = io.Copy(f, src); err != nil {
+		fail(name, err)
+	}
+	if err = f.Close(); err != nil {
+		fail(name, err)
+	}
+}
+
+func get(fsys *client.FS, name string, local string) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		fail(name, err)
+		return
+	}
+	defer f.Close()
+	out, err := os.Open(local, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0666)
+	if err != nil {
+		fail(local, err)
+		return
+	}
+	if _, err = io.Copy(out, f); err != nil {
+		fail(name, err)
+	}
+	if err = out.Close(); err != nil {
+		fail(local, err)
+	}
+}
+
+func stat(fsys *client.FS, args []string) {
+	for _, name := range args {
+		st, err := fsys.Stat(name)
+		if err != nil {
+			fail(name, err)
+			continue
+		}
+		fmt.Printf("%s\n", client.FormatMsg(st))
+	}
+}
+
+func rm(root *client.Fid, args []string) {
+	for _, name := range args {
+		f, err := root.Open(ctx, name, "")
+		if err == nil {
+			err = f.Remove(ctx)
+		}
+		if err != nil {
+			fail(name, err)
+		}
+	}
+}
+
+func mkdir(root *client.Fid, args []string) {
+	for _, name := range args {
+		dir, file := path.Split(path.Clean(name))
+		if dir == "" {
+			dir = "."
+		}
+		d, err := root.Open(ctx, dir, "")
+		if err != nil {
+			fail(name, err)
+			continue
+		}
+		f, err := d.Create(ctx, file, pepys.Pdir | 0777, "r")
+		d.Clunk(client.Background())
+		if err != nil {
+			fail(name, err)
+			continue
+		}
+		f.Clunk(client.Background())
+	}
+}
+
+// Send one group of messages written out as text, and print what came back
+func rawGroup(conn *client.Conn, lines []string) {
+	msgs := make([]interface{}, 0, len(lines))
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		msg, err := client.ParseMsg(line)
+		if err != nil {
+			fail("raw", err)
+			return
+		}
+		msgs = msgs[0:len(msgs) + 1]
+		msgs[len(msgs) - 1] = msg
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	resp, err := conn.Rpc(ctx, msgs...)
+	for _, r := range resp {
+		fmt.Printf("%s\n", client.FormatMsg(r))
+	}
+	if err != nil {
+		fmt.Printf("Rerror Ename=%q\n", err.String())
+		fail("raw", err)
+	}
+}
+
+func raw(conn *client.Conn, args []string) {
+	if len(args) > 0 {
+		rawGroup(conn, args)
+		return
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		line, err := in.ReadString('\n')
+		if line != "" {
+			rawGroup(conn, strings.Split(line, ";", -1))
+		}
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			fail("stdin", err)
+			break
+		}
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "ls", "raw":
+	case "write":
+		if len(args) != 1 {
+			usage()
+		}
+	case "put":
+		if len(args) != 2 {
+			usage()
+		}
+	case "get":
+		if len(args) != 1 && len(args) != 2 {
+			usage()
+		}
+	case "cat", "stat", "rm", "mkdir":
+		if len(args) == 0 {
+			usage()
+		}
+	default:
+		usage()
+	}
+
+	if *timeout > 0 {
+		ctx, _ = client.WithTimeout(ctx, *timeout * 1e9)
+	}
+	conn, err := client.Dial(ctx, "tcp", *addr, *uname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pepys: %s: %s\n", *addr, err)
+		os.Exit(Edial)
+	}
+
+	// raw mode does everything itself, fids included
+	if cmd == "raw" {
+		raw(conn, args)
+		os.Exit(status)
+	}
+
+	root, err := conn.Attach(ctx, *aname)
+	if err != nil {
+		fail(*aname, err)
+		os.Exit(status)
+	}
+	fsys := client.NewFS(root)
+	fsys.SetContext(ctx)
+
+	switch cmd {
+	case "ls":
+		ls(fsys, fsNames(args))
+	case "cat":
+		cat(fsys, fsNames(args))
+	case "write":
+		put(root, os.Stdin, args[0])
+	case "put":
+		src, err := os.Open(args[0], os.O_RDONLY, 0)
+		if err != nil {
+			fail(args[0], err)
+			break
+		}
+		put(root, src, args[1])
+		src.Close()
+	case "get":
+		_, local := path.Split(fsName(args[0]))
+		if len(args) == 2 {
+			local = args[1]
+		}
+		get(fsys, fsName(args[0]), local)
+	case "stat":
+		stat(fsys, fsNames(args))
+	case "rm":
+		rm(root, args)
+	case "mkdir":
+		mkdir(root, args)
+	}
+	root.Clunk(client.Background())
+	conn.Close()
+	os.Exit(status)
+}
@@ -0,0 +1,1195 @@
+// pepysfs serves a file system kept on a pepys disk, made with mkfs
+package main
+
+import "os"
+import "fmt"
+import "flag"
+import "sync"
+import "time"
+import "bytes"
+import "pepys"
+import "strconv"
+import "encoding/binary"
+import "pepys/disk"
+import "pepys/server"
+
+var addr = flag.String("a", "localhost:5640", "address to listen on")
+var owner = flag.String("u", "pepysfs", "owner of the root directory, when a new disk gets one")
+var serverid = flag.Uint64("i", 1, "server id of the files made here")
+var maxfile = flag.Uint64("m", 64 * 1024 * 1024, "largest a file can get, in bytes; open files are kept in memory whole")
+var checkpoint = flag.Int("c", 100, "changes between checkpoints of the index; more make a crash slower to recover from")
+
+var be = binary.BigEndian
+
+var Ebadmeta = os.NewError("bad file metadata")
+var Etoobig = os.NewError("file too big")
+
+/*
+ * Every file is known by its Xid, and every change to it is a new
+ * version of it in the log of the disk: a write, once the fid that
+ * did it is clunked, a Twstat, or, for a directory, a file made,
+ * removed or renamed in it.  The newest version of a file is the one
+ * with the highest VersionID in the index.
+ *
+ * Besides the data, a version has in the Aux of its Meta:
+ *
+ *	uint32		permissions
+ *	uint16		length, then the name of the owner
+ *	...		and of the group, and of the last to change it
+ *	uint64		when the version was made, in nanoseconds
+ *
+ * That time is kept apart from the Time of the Meta, the mtime, which
+ * a Twstat may set to anything.  Each version is made later than the
+ * one before it, even if the clock goes back.  Versions written before
+ * it was kept have only their Time.
+ *
+ * The data of a directory has an entry for each file in it:
+ *
+ *	uint64		server
+ *	uint64		file
+ *	uint16		length, then the name
+ *
+ * Names are only kept in directories, so a rename is a new version of
+ * the directory alone.
+ *
+ * The old versions stay in the log and can be read, but not changed.
+ * Attaching to "@t", with t a time in nanoseconds, gives the tree as it
+ * was then: each file as its newest version made by t.  In
+ * any directory, "name@" is a directory of the versions of name, one
+ * entry for each, named by its number; a directory version in there
+ * holds its files as they were when it was made.
+ */
+type Pepysfs struct {
+	dk *disk.Disk
+	root *node
+	server disk.ServerID	// of the files made here
+	nextfile disk.FileID	// for the next file made
+
+	lock sync.Mutex	// protects the disk and the counters
+	ssid uint32
+	nsync int	// changes since the last checkpoint
+}
+
+// A file, as a Fid refers to it
+type node struct {
+	xid disk.Xid
+	name string	// in its directory, "/" for the root
+	parent *node	// nil for the root
+
+	// nodes in the past are read only
+	at int64	// the time the tree is seen as of, 0 for now
+	vers disk.VersionID	// the version, if a fixed one
+	hist bool	// the directory of the versions of xid
+}
+
+// What is known of a version of a file
+type file struct {
+	vid disk.Vid
+	dir bool
+	perm uint32
+	uid string
+	gid string
+	muid string
+	mtime int64
+	ctime int64	// when the version was made
+	length uint64
+}
+
+// An entry in a directory
+type dirent struct {
+	xid disk.Xid
+	name string
+}
+
+// The state of an open fid, kept in its Aux
+type pfsFid struct {
+	mode int
+	vid disk.Vid	// the version opened
+	dir bool
+
+	// the data of the version, read when first needed; writes go
+	// here, and make a new version when the fid is clunked
+	dat []byte
+	loaded bool
+	written bool
+
+	// directory reads
+	dr server.DirReader
+}
+
+func putstr(buf *bytes.Buffer, s string) {
+	var n [2]byte
+	be.PutUint16(n[0:], uint16(len(s)))
+	buf.Write(n[0:])
+	buf.WriteString(s)
+}
+
+func getstr(buf []byte) (string, []byte, bool) {
+	if len(buf) < 2 {
+		return "", nil, false
+	}
+	n := int(be.Uint16(buf))
+	if len(buf) < 2 + n {
+		return "", nil, false
+	}
+	return string(buf[2:2 + n]), buf[2 + n:], true
+}
+
+func (f *file) aux() []byte {
+	buf := new(bytes.Buffer)
+	var perm [4]byte
+	be.PutUint32(perm[0:], f.perm)
+	buf.Write(perm[0:])
+	putstr(buf, f.uid)
+	putstr(buf, f.gid)
+	putstr(buf, f.muid)
+	var ctime [8]byte
+	be.PutUint64(ctime[0:], uint64(f.ctime))
+	buf.Write(ctime[0:])
+	return buf.Bytes()
+}
+
+func decodeFile(m *disk.Meta) (*file, os.Error) {
+	f := new(file)
+	f.vid = m.Vid
+	f.dir = m.Type == disk.Mdir
+	f.mtime = m.Time
+	f.ctime = m.Time
+	f.length = m.Length
+	buf := m.Aux
+	if len(buf) < 4 {
+		return nil, Ebadmeta
+	}
+	f.perm = be.Uint32(buf)
+	ok := true
+	if f.uid, buf, ok = getstr(buf[4:]); !ok {
+		return nil, Ebadmeta
+	}
+	if f.gid, buf, ok = getstr(buf); !ok {
+		return nil, Ebadmeta
+	}
+	if f.muid, buf, ok = getstr(buf); !ok {
+		return nil, Ebadmeta
+	}
+	if len(buf) >= 8 {
+		f.ctime = int64(be.Uint64(buf))
+	}
+	return f, nil
+}
+
+func readDir(dat []byte) ([]dirent, os.Error) {
+	n := 0
+	for buf := dat; len(buf) > 0; n++ {
+		if len(buf) < 16 {
+			return nil, Ebadmeta
+		}
+		_, rest, ok := getstr(buf[16:])
+		if !ok {
+			return nil, Ebadmeta
+		}
+		buf = rest
+	}
+	ents := make([]dirent, n)
+	buf := dat
+	for i := range ents {
+		ents[i].xid.Server = disk.ServerID(be.Uint64(buf[0:]))
+		ents[i].xid.File = disk.FileID(be.Uint64(buf[8:]))
+		ents[i].name, buf, _ = getstr(buf[16:])
+	}
+	return ents, nil
+}
+
+func writeDir(ents []dirent) []byte {
+	buf := new(bytes.Buffer)
+	var xid [16]byte
+	for _, e := range ents {
+		be.PutUint64(xid[0:], uint64(e.xid.Server))
+		be.PutUint64(xid[8:], uint64(e.xid.File))
+		buf.Write(xid[0:])
+		putstr(buf, e.name)
+	}
+	return buf.Bytes()
+}
+
+// Where name is in ents, -1 if it isn't
+func lookup(ents []dirent, name string) int {
+	for i, e := range ents {
+		if e.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Where the entry of xid is in ents, -1 if it isn't; names change, so
+// this is how a node finds itself
+func find(ents []dirent, xid disk.Xid) int {
+	for i, e := range ents {
+		if sameXid(e.xid, xid) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Check whether uname is allowed the access in want (Prm bits) to f
+func (f *file) allowed(uname string, want uint32) bool {
+	perm := f.perm & 7
+	if uname == f.uid {
+		perm |= (f.perm >> 6) & 7
+	}
+	if uname == f.gid {
+		perm |= (f.perm >> 3) & 7
+	}
+	return perm & want == want
+}
+
+func (f *file) ftype() uint32 {
+	if f.dir {
+		return pepys.Fdir
+	}
+	return pepys.Fversioned
+}
+
+func (f *file) stat(name string) *pepys.Rstat {
+	st := new(pepys.Rstat)
+	st.Ftype = f.ftype()
+	st.Version = uint64(f.vid.Version)
+	st.Perm = f.perm
+	st.Uid = f.uid
+	st.Gid = f.gid
+	st.Muid = f.muid
+	if !f.dir {
+		st.Length = f.length
+	}
+	st.Atime = uint64(f.mtime)
+	st.Mtime = uint64(f.mtime)
+	st.Name = name
+	return st
+}
+
+func sameXid(a disk.Xid, b disk.Xid) bool {
+	return a.Server == b.Server && a.File == b.File
+}
+
+// The newest version of xid and where it is
+func (p *Pepysfs) latest(xid disk.Xid) (disk.Vid, disk.Metaaddr, bool) {
+	var last disk.Indexelem
+	found := false
+	p.dk.Index().Range(xid, func(e *disk.Indexelem) bool {
+		last = *e
+		found = true
+		return true
+	})
+	return last.Vid, last.Addr, found
+}
+
+// What the newest version of xid says of it
+func (p *Pepysfs) file(xid disk.Xid) (*file, os.Error) {
+	_, ma, ok := p.latest(xid)
+	if !ok {
+		return nil, pepys.Enotexist
+	}
+	m, err := p.dk.ReadMeta(ma)
+	if err != nil {
+		return nil, err
+	}
+	return decodeFile(m)
+}
+
+// The data of version vid
+func (p *Pepysfs) data(vid disk.Vid) ([]byte, os.Error) {
+	_, dat, err := p.dk.Get(vid)
+	return dat, err
+}
+
+// What is in version d of a directory
+func (p *Pepysfs) contents(d *file) ([]dirent, os.Error) {
+	if !d.dir {
+		return nil, pepys.Enotdir
+	}
+	dat, err := p.data(d.vid)
+	if err != nil {
+		return nil, err
+	}
+	return readDir(dat)
+}
+
+// The newest version of the directory xid, and what is in it
+func (p *Pepysfs) entries(xid disk.Xid) (*file, []dirent, os.Error) {
+	d, err := p.file(xid)
+	if err != nil {
+		return nil, nil, err
+	}
+	ents, err := p.contents(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, ents, nil
+}
+
+func (n *node) readonly() bool {
+	return n.at != 0 || n.vers != 0 || n.hist
+}
+
+// The versions of xid made by time t, oldest first; all of them if t is 0
+func (p *Pepysfs) versions(xid disk.Xid, t int64) ([]*file, os.Error) {
+	ms, err := p.dk.History(xid)
+	if err != nil {
+		return nil, err
+	}
+	fs := make([]*file, len(ms))
+	k := 0
+	for _, m := range ms {
+		f, err := decodeFile(m)
+		if err != nil {
+			return nil, err
+		}
+		if t == 0 || f.ctime <= t {
+			fs[k] = f
+			k++
+		}
+	}
+	return fs[0:k], nil
+}
+
+// The newest version of xid made by time t. That is when it was made,
+// whatever its mtime says. Versions are made one after the other, so
+// they are read newest first, up to the first made by t.
+func (p *Pepysfs) asof(xid disk.Xid, t int64) (*file, os.Error) {
+	n := 0
+	p.dk.Index().Range(xid, func(e *disk.Indexelem) bool {
+		n++
+		return true
+	})
+	mas := make([]disk.Metaaddr, n)
+	i := 0
+	p.dk.Index().Range(xid, func(e *disk.Indexelem) bool {
+		mas[i] = e.Addr
+		i++
+		return true
+	})
+	for i = n - 1; i >= 0; i-- {
+		m, err := p.dk.ReadMeta(mas[i])
+		if err != nil {
+			return nil, err
+		}
+		f, err := decodeFile(m)
+		if err != nil {
+			return nil, err
+		}
+		if f.ctime <= t {
+			return f, nil
+		}
+	}
+	return nil, pepys.Enotexist
+}
+
+// The history directory n: read only, and searchable by those who may
+// read the file. It looks like the newest version it lists.
+func (p *Pepysfs) histdir(n *node) (*file, os.Error) {
+	var f *file
+	var err os.Error
+	if n.at != 0 {
+		f, err = p.asof(n.xid, n.at)
+	} else {
+		f, err = p.file(n.xid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := new(file)
+	*d = *f
+	d.dir = true
+	d.perm &= 0555
+	d.perm |= (d.perm & 0444) >> 2
+	return d, nil
+}
+
+// The version of its file that n refers to
+func (p *Pepysfs) version(n *node) (*file, os.Error) {
+	switch {
+	case n.hist:
+		return p.histdir(n)
+	case n.vers != 0:
+		ma, ok := p.dk.Index().Lookup(disk.Vid{n.xid, n.vers})
+		if !ok {
+			return nil, pepys.Enotexist
+		}
+		m, err := p.dk.ReadMeta(ma)
+		if err != nil {
+			return nil, err
+		}
+		return decodeFile(m)
+	case n.at != 0:
+		return p.asof(n.xid, n.at)
+	}
+	return p.file(n.xid)
+}
+
+// The time the files in directory n are seen as of, d being the version
+// of n; a fixed version holds them as they were when it was made
+func (n *node) childat(d *file) int64 {
+	if n.vers != 0 {
+		return d.ctime
+	}
+	return n.at
+}
+
+// Append version f of a file, with dat as its data, to the log. It is
+// made now, or just after the version before it, if that is later.
+func (p *Pepysfs) put(f *file, dat []byte) os.Error {
+	if t := time.Nanoseconds(); t > f.ctime {
+		f.ctime = t
+	} else {
+		f.ctime++
+	}
+	m := new(disk.Meta)
+	m.Vid = f.vid
+	m.Type = disk.Mfile
+	if f.dir {
+		m.Type = disk.Mdir
+	}
+	m.State = disk.Mclean
+	m.Time = f.mtime
+	m.Aux = f.aux()
+	if _, err := p.dk.Append(m, dat); err != nil {
+		return err
+	}
+	f.length = m.Length
+	return nil
+}
+
+// How long f can get: no more than the log takes in one version with its
+// metadata, nor than -m, as the data is kept in memory while open
+func (p *Pepysfs) maxlength(f *file) uint64 {
+	max := p.dk.MaxLength(len(f.aux()))
+	if max > *maxfile {
+		max = *maxfile
+	}
+	if max > uint64(^uint(0) >> 1) {
+		max = uint64(^uint(0) >> 1)
+	}
+	return max
+}
+
+// Make a new version of directory d, changed by uname to hold ents
+func (p *Pepysfs) putDir(d *file, ents []dirent, uname string) os.Error {
+	d.vid.Version++
+	d.muid = uname
+	d.mtime = time.Nanoseconds()
+	return p.put(d, writeDir(ents))
+}
+
+// The file behind a fid and its state if it is open
+func (p *Pepysfs) fid(conn *server.Connection, num uint32) (*node, *pfsFid, os.Error) {
+	fid := conn.GetFid(num)
+	if fid == nil {
+		return nil, nil, pepys.Ebadfid
+	}
+	pf, _ := fid.Aux.(*pfsFid)
+	return fid.Node.(*node), pf, nil
+}
+
+// Names ending in @ are left for histories
+func goodname(name string) bool {
+	return server.GoodName(name) && name[len(name) - 1] != '@'
+}
+
+func (p *Pepysfs) Root(conn *server.Connection, aname string) (interface{}, os.Error) {
+	if aname == "" || aname == "/" {
+		return p.root, nil
+	}
+	if aname[0] != '@' {
+		return nil, pepys.Enotexist
+	}
+	t, err := strconv.Atoi64(aname[1:])
+	if err != nil || t <= 0 {
+		return nil, pepys.Enotexist
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	n := &node{p.root.xid, "/", nil, t, 0, false}
+	if _, err = p.version(n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (p *Pepysfs) Walk(conn *server.Connection, dir interface{}, name string) (interface{}, os.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	d := dir.(*node)
+	df, err := p.version(d)
+	if err != nil {
+		return nil, err
+	}
+	if !df.dir {
+		return nil, pepys.Enotdir
+	}
+	if !df.allowed(conn.Uname, pepys.Prmexec) {
+		return nil, pepys.Eperm
+	}
+	if d.hist {
+		// the name is the version, made by the time d is seen as of
+		v, err := strconv.Atoi64(name)
+		if err != nil || v <= 0 || strconv.Itoa64(v) != name {
+			return nil, pepys.Enotexist
+		}
+		n := &node{d.xid, name, d, d.at, disk.VersionID(v), false}
+		f, err := p.version(n)
+		if err != nil {
+			return nil, err
+		}
+		if d.at != 0 && f.ctime > d.at {
+			return nil, pepys.Enotexist
+		}
+		return n, nil
+	}
+	ents, err := p.contents(df)
+	if err != nil {
+		return nil, err
+	}
+	at := d.childat(df)
+	if i := lookup(ents, name); i >= 0 {
+		return &node{ents[i].xid, name, d, at, 0, false}, nil
+	}
+	if len(name) > 1 && name[len(name) - 1] == '@' {
+		if i := lookup(ents, name[0:len(name) - 1]); i >= 0 {
+			return &node{ents[i].xid, name, d, at, 0, true}, nil
+		}
+	}
+	return nil, pepys.Enotexist
+}
+
+func (p *Pepysfs) Proto(conn *server.Connection, arg *pepys.Tproto) (*pepys.Rproto, os.Error) {
+	// no options supported
+	return server.Negotiate(conn, arg)
+}
+
+func (p *Pepysfs) Session(conn *server.Connection, arg *pepys.Tsession) (*pepys.Rsession, os.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.ssid++
+	resp := new(pepys.Rsession)
+	resp.Ssid = p.ssid
+	return resp, nil
+}
+
+func (p *Pepysfs) Attach(conn *server.Connection, arg *pepys.Tattach) (*pepys.Rattach, os.Error) {
+	// the library binds the fid to Root
+	return new(pepys.Rattach), nil
+}
+
+func (p *Pepysfs) Flush(conn *server.Connection, arg *pepys.Tflush) (*pepys.Rflush, os.Error) {
+	// called while a group is being flushed; nothing here blocks for
+	// long, so it may as well finish
+	return new(pepys.Rflush), nil
+}
+
+func (p *Pepysfs) Open(conn *server.Connection, arg *pepys.Topen) (*pepys.Ropen, os.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	m, err := pepys.ParseMode(arg.Mode)
+	if err != nil {
+		return nil, err
+	}
+	fid := conn.GetFid(arg.Nfid)
+	n := fid.Node.(*node)
+	f, err := p.version(n)
+	if err != nil {
+		return nil, err
+	}
+	if n.readonly() && m & (pepys.Owrite | pepys.Otrunc | pepys.Orclose) != 0 {
+		return nil, pepys.Eperm
+	}
+	want := uint32(0)
+	if m & pepys.Oread != 0 {
+		want |= pepys.Prmread
+	}
+	if m & pepys.Owrite != 0 || m & pepys.Otrunc != 0 {
+		if f.dir {
+			return nil, pepys.Eisdir
+		}
+		want |= pepys.Prmwrite
+	}
+	if m & pepys.Oexec == pepys.Oexec {
+		want |= pepys.Prmexec
+	}
+	if !f.allowed(conn.Uname, want) {
+		return nil, pepys.Eperm
+	}
+	if m & pepys.Orclose != 0 {
+		if n.parent == nil {
+			return nil, pepys.Eperm
+		}
+		if df, err := p.file(n.parent.xid); err != nil || !df.allowed(conn.Uname, pepys.Prmwrite) {
+			return nil, pepys.Eperm
+		}
+	}
+
+	pf := new(pfsFid)
+	pf.mode = m
+	pf.vid = f.vid
+	pf.dir = f.dir
+	if m & pepys.Otrunc != 0 {
+		// the new version, empty, is made on clunk
+		pf.dat = []byte{}
+		pf.loaded = true
+		pf.written = true
+	}
+	fid.Aux = pf
+
+	resp := new(pepys.Ropen)
+	resp.Iounit = server.Iounit(conn)
+	resp.Ftype = f.ftype()
+	resp.Version = uint64(f.vid.Version)
+	return resp, nil
+}
+
+func (p *Pepysfs) Create(conn *server.Connection, arg *pepys.Tcreate) (*pepys.Rcreate, os.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	fid := conn.GetFid(arg.Fid)
+	if fid == nil {
+		return nil, pepys.Ebadfid
+	}
+	if fid.Aux != nil {
+		return nil, pepys.Eisopen
+	}
+	d := fid.Node.(*node)
+	if d.readonly() {
+		return nil, pepys.Eperm
+	}
+	if !goodname(arg.Name) {
+		return nil, pepys.Ename
+	}
+	m, err := pepys.ParseMode(arg.Mode)
+	if err != nil {
+		return nil, err
+	}
+	df, ents, err := p.entries(d.xid)
+	if err != nil {
+		return nil, err
+	}
+	if lookup(ents, arg.Name) >= 0 {
+		return nil, pepys.Eexist
+	}
+	if !df.allowed(conn.Uname, pepys.Prmwrite) {
+		return nil, pepys.Eperm
+	}
+	isdir := arg.Perm & pepys.Pdir != 0
+	if isdir && m & (pepys.Owrite | pepys.Otrunc) != 0 {
+		return nil, pepys.Eisdir
+	}
+
+	// as in 9P, directories lend their group and restrict the permissions
+	perm := arg.Perm & (^uint32(0666) | df.perm & 0666)
+	if isdir {
+		perm = arg.Perm & (^uint32(0777) | df.perm & 0777)
+	}
+	f := new(file)
+	f.vid.Server = p.server
+	f.vid.File = p.nextfile
+	f.vid.Version = 1
+	f.dir = isdir
+	f.perm = perm & 0777
+	f.uid = conn.Uname
+	f.gid = df.gid
+	f.muid = conn.Uname
+	f.mtime = time.Nanoseconds()
+	if err = p.put(f, []byte{}); err != nil {
+		return nil, err
+	}
+	p.nextfile++
+
+	nents := make([]dirent, len(ents) + 1)
+	copy(nents, ents)
+	nents[len(ents)] = dirent{f.vid.Xid, arg.Name}
+	if err = p.putDir(df, nents, conn.Uname); err != nil {
+		return nil, err
+	}
+	if err = p.sync(); err != nil {
+		return nil, err
+	}
+
+	// the fid now refers to the new file, open with the given mode; the
+	// creator may use it whatever the permissions say
+	fid.Descend(&node{f.vid.Xid, arg.Name, d, 0, 0, false}, arg.Name)
+	pf := new(pfsFid)
+	pf.mode = m
+	pf.vid = f.vid
+	pf.dir = f.dir
+	pf.dat = []byte{}
+	pf.loaded = true
+	fid.Aux = pf
+
+	resp := new(pepys.Rcreate)
+	resp.Iounit = server.Iounit(conn)
+	resp.Version = uint64(f.vid.Version)
+	return resp, nil
+}
+
+// Read the data of the version pf opened, if not done yet
+func (p *Pepysfs) load(pf *pfsFid) os.Error {
+	if pf.loaded {
+		return nil
+	}
+	dat, err := p.data(pf.vid)
+	if err != nil {
+		return err
+	}
+	pf.dat = dat
+	pf.loaded = true
+	return nil
+}
+
+func (p *Pepysfs) Read(conn *server.Connection, arg *pepys.Tread) (*pepys.Rread, os.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n, pf, err := p.fid(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if pf == nil || pf.mode & pepys.Oread == 0 {
+		return nil, pepys.Eperm
+	}
+	if arg.Count > server.Iounit(conn) {
+		arg.Count = server.Iounit(conn)
+	}
+
+	resp := new(pepys.Rread)
+	if pf.dir {
+		resp.Dat, err = pf.dr.Read(arg.Offset, arg.Count, func() ([]*pepys.Rstat, os.Error) {
+			if n.hist {
+				return p.histents(n)
+			}
+			return p.dirents(n, pf)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+	if err = p.load(pf); err != nil {
+		return nil, err
+	}
+	if arg.Offset >= uint64(len(pf.dat)) {
+		resp.Dat = []byte{}
+		return resp, nil
+	}
+	end := arg.Offset + uint64(arg.Count)
+	if end > uint64(len(pf.dat)) {
+		end = uint64(len(pf.dat))
+	}
+	// copy, a write through another fid may change it under the reply
+	resp.Dat = make([]byte, end - arg.Offset)
+	copy(resp.Dat, pf.dat[arg.Offset:end])
+	return resp, nil
+}
+
+// The entries of the directory version pf opened, as read
+func (p *Pepysfs) dirents(n *node, pf *pfsFid) ([]*pepys.Rstat, os.Error) {
+	if err := p.load(pf); err != nil {
+		return nil, err
+	}
+	ents, err := readDir(pf.dat)
+	if err != nil {
+		return nil, err
+	}
+	at := n.at
+	if n.vers != 0 {
+		d, err := p.version(n)
+		if err != nil {
+			return nil, err
+		}
+		at = n.childat(d)
+	}
+	stats := make([]*pepys.Rstat, len(ents))
+	k := 0
+	for _, e := range ents {
+		f, err := p.version(&node{e.xid, e.name, n, at, 0, false})
+		if err == pepys.Enotexist && at != 0 {
+			// its first version says it was made later
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stats[k] = f.stat(e.name)
+		k++
+	}
+	return stats[0:k], nil
+}
+
+// The entries of a history directory, one for each version
+func (p *Pepysfs) histents(n *node) ([]*pepys.Rstat, os.Error) {
+	fs, err := p.versions(n.xid, n.at)
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]*pepys.Rstat, len(fs))
+	for i, f := range fs {
+		stats[i] = f.stat(strconv.Itoa64(int64(f.vid.Version)))
+	}
+	return stats, nil
+}
+
+func (p *Pepysfs) Write(conn *server.Connection, arg *pepys.Twrite) (*pepys.Rwrite, os.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n, pf, err := p.fid(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if pf == nil || pf.mode & pepys.Owrite == 0 {
+		return nil, pepys.Eperm
+	}
+	if err = p.load(pf); err != nil {
+		return nil, err
+	}
+	end := arg.Offset + uint64(len(arg.Dat))
+	if end < arg.Offset {
+		return nil, Etoobig
+	}
+	if end > uint64(len(pf.dat)) {
+		// as it will be when the fid is clunked
+		f, err := p.file(n.xid)
+		if err != nil {
+			return nil, err
+		}
+		f.muid = conn.Uname
+		if end > p.maxlength(f) {
+			return nil, Etoobig
+		}
+		dat := make([]byte, end)
+		copy(dat, pf.dat)
+		pf.dat = dat
+	}
+	copy(pf.dat[arg.Offset:end], arg.Dat)
+	pf.written = true
+
+	resp := new(pepys.Rwrite)
+	resp.Count = uint32(len(arg.Dat))
+	return resp, nil
+}
+
+// Make what was written through pf the newest version of its file
+func (p *Pepysfs) commit(conn *server.Connection, n *node, pf *pfsFid) os.Error {
+	// the metadata may have changed since the fid was opened
+	f, err := p.file(n.xid)
+	if err != nil {
+		return err
+	}
+	f.vid.Version++
+	f.muid = conn.Uname
+	f.mtime = time.Nanoseconds()
+	if err = p.put(f, pf.dat); err != nil {
+		return err
+	}
+	return p.sync()
+}
+
+// Make a change stick. Each one is synced in the log, which is cheap;
+// the index is only written out with a checkpoint every so many, as
+// Recover reads the log after the last one again.
+func (p *Pepysfs) sync() os.Error {
+	if err := p.dk.SyncLog(); err != nil {
+		return err
+	}
+	p.nsync++
+	if p.nsync < *checkpoint {
+		return nil
+	}
+	p.nsync = 0
+	return p.dk.Sync()
+}
+
+// Take n out of its directory. Its versions stay in the log.
+func (p *Pepysfs) remove(conn *server.Connection, n *node) os.Error {
+	if n.parent == nil || n.readonly() {
+		return pepys.Eperm
+	}
+	df, ents, err := p.entries(n.parent.xid)
+	if err != nil {
+		return err
+	}
+	if !df.allowed(conn.Uname, pepys.Prmwrite) {
+		return pepys.Eperm
+	}
+	i := find(ents, n.xid)
+	if i < 0 {
+		return pepys.Enotexist
+	}
+	f, err := p.file(n.xid)
+	if err != nil {
+		return err
+	}
+	if f.dir {
+		_, fents, err := p.entries(n.xid)
+		if err != nil {
+			return err
+		}
+		if len(fents) != 0 {
+			return pepys.Enotempty
+		}
+	}
+
+	nents := make([]dirent, len(ents) - 1)
+	copy(nents, ents[0:i])
+	copy(nents[i:], ents[i + 1:])
+	if err = p.putDir(df, nents, conn.Uname); err != nil {
+		return err
+	}
+	return p.sync()
+}
+
+func (p *Pepysfs) Remove(conn *server.Connection, arg *pepys.Tremove) (*pepys.Rremove, os.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n, _, err := p.fid(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.remove(conn, n); err != nil {
+		return nil, err
+	}
+	return new(pepys.Rremove), nil
+}
+
+func (p *Pepysfs) Clunk(conn *server.Connection, arg *pepys.Tclunk) (*pepys.Rclunk, os.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n, pf, err := p.fid(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if pf != nil {
+		if pf.written {
+			if err = p.commit(conn, n, pf); err != nil {
+				return nil, err
+			}
+		}
+		if pf.mode & pepys.Orclose != 0 {
+			if err = p.remove(conn, n); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return new(pepys.Rclunk), nil
+}
+
+func (p *Pepysfs) Stat(conn *server.Connection, arg *pepys.Tstat) (*pepys.Rstat, os.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n, _, err := p.fid(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	f, err := p.version(n)
+	if err != nil {
+		return nil, err
+	}
+	return f.stat(n.name), nil
+}
+
+func (p *Pepysfs) Wstat(conn *server.Connection, arg *pepys.Twstat) (*pepys.Rwstat, os.Error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	n, _, err := p.fid(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if n.readonly() {
+		return nil, pepys.Eperm
+	}
+	f, err := p.file(n.xid)
+	if err != nil {
+		return nil, err
+	}
+
+	// check everything first so that the changes are all made or none are
+	owner := conn.Uname == f.uid
+	var df *file
+	var ents []dirent
+	i := -1
+	if arg.Name != "" && arg.Name != n.name {
+		if n.parent == nil || !goodname(arg.Name) {
+			return nil, pepys.Ename
+		}
+		if df, ents, err = p.entries(n.parent.xid); err != nil {
+			return nil, err
+		}
+		if !df.allowed(conn.Uname, pepys.Prmwrite) {
+			return nil, pepys.Eperm
+		}
+		if lookup(ents, arg.Name) >= 0 {
+			return nil, pepys.Eexist
+		}
+		if i = find(ents, n.xid); i < 0 {
+			return nil, pepys.Enotexist
+		}
+	}
+	if arg.Perm != pepys.Noperm {
+		if !owner {
+			return nil, pepys.Enotowner
+		}
+		if arg.Perm & ^uint32(0777) != 0 {
+			return nil, os.NewError("bad permission bits")
+		}
+	}
+	if arg.Gid != "" && !owner {
+		return nil, pepys.Enotowner
+	}
+	truncate := arg.Length != pepys.Nolength && arg.Length != f.length
+	if truncate {
+		if f.dir {
+			return nil, pepys.Eisdir
+		}
+		if !f.allowed(conn.Uname, pepys.Prmwrite) {
+			return nil, pepys.Eperm
+		}
+		nf := *f
+		nf.muid = conn.Uname
+		if arg.Gid != "" {
+			nf.gid = arg.Gid
+		}
+		if arg.Length > p.maxlength(&nf) {
+			return nil, Etoobig
+		}
+	}
+	if arg.Mtime != pepys.Notime && !owner {
+		return nil, pepys.Enotowner
+	}
+
+	// a new version of the file with the new metadata, and one of its
+	// directory with the new name
+	if arg.Perm != pepys.Noperm || arg.Gid != "" || truncate || arg.Mtime != pepys.Notime {
+		dat, err := p.data(f.vid)
+		if err != nil {
+			return nil, err
+		}
+		if truncate {
+			ndat := make([]byte, arg.Length)
+			copy(ndat, dat)
+			dat = ndat
+			f.muid = conn.Uname
+			f.mtime = time.Nanoseconds()
+		}
+		if arg.Perm != pepys.Noperm {
+			f.perm = arg.Perm
+		}
+		if arg.Gid != "" {
+			f.gid = arg.Gid
+		}
+		if arg.Mtime != pepys.Notime {
+			f.mtime = int64(arg.Mtime)
+		}
+		f.vid.Version++
+		if err = p.put(f, dat); err != nil {
+			return nil, err
+		}
+	}
+	if i >= 0 {
+		ents[i].name = arg.Name
+		if err = p.putDir(df, ents, conn.Uname); err != nil {
+			return nil, err
+		}
+		conn.GetFid(arg.Fid).Rename(&node{n.xid, arg.Name, n.parent, 0, 0, false}, arg.Name)
+	}
+	if err = p.sync(); err != nil {
+		return nil, err
+	}
+	return new(pepys.Rwstat), nil
+}
+
+// Serve what is on dk, making a root directory if it has none yet
+func newPepysfs(dk *disk.Disk, id disk.ServerID, uid string) (*Pepysfs, os.Error) {
+	p := new(Pepysfs)
+	p.dk = dk
+	p.server = id
+	p.nextfile = 1
+	dk.Index().Walk(func(e *disk.Indexelem) bool {
+		if e.Vid.Server == id && e.Vid.File >= p.nextfile {
+			p.nextfile = e.Vid.File + 1
+		}
+		return true
+	})
+
+	s := dk.Super()
+	root := s.Rootvid.Xid
+	if _, _, ok := p.latest(root); !ok {
+		f := new(file)
+		f.vid.Server = id
+		f.vid.File = p.nextfile
+		f.vid.Version = 1
+		f.dir = true
+		f.perm = 0775
+		f.uid = uid
+		f.gid = uid
+		f.muid = uid
+		f.mtime = time.Nanoseconds()
+		if err := p.put(f, []byte{}); err != nil {
+			return nil, err
+		}
+		p.nextfile++
+		// Sync writes the superblock out with it
+		s.Rootvid = f.vid
+		if err := dk.Sync(); err != nil {
+			return nil, err
+		}
+		root = f.vid.Xid
+	}
+	p.root = &node{root, "/", nil, 0, 0, false}
+	return p, nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: pepysfs [flags] disk\n\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+	}
+
+	dk, err := disk.New(flag.Arg(0))
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if err = dk.Mount(); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	p, err := newPepysfs(dk, disk.ServerID(*serverid), *owner)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	srv, err := server.New(p, "tcp", *addr)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("pepysfs is serving %s on %s!\n", flag.Arg(0), *addr)
+
+	// start processing requests
+	srv.Start()
+}
@@ -0,0 +1,456 @@
+package main
+
+import "os"
+import "fmt"
+import "flag"
+import "pepys"
+import "strings"
+import "testing"
+import "time"
+import "pepys/disk"
+import "pepys/client"
+import "pepys/server"
+
+var image = flag.String("image", "/tmp/pepysfs-test.img", "scratch image for the tests")
+var port = flag.Int("port", 5660, "port of the first test server, the others take the next ones")
+
+var ctx = client.Background()
+
+// Make a fresh file system on the scratch image
+func mkfs(t *testing.T) {
+	f, err := os.Open(*image, os.O_RDWR | os.O_CREAT | os.O_TRUNC, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(8 * disk.M)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dk, err := disk.New(*image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := disk.DefaultGeometry()
+	g.Config = 0
+	g.Asize = 256 * disk.K
+	err = dk.CreateSuper(g)
+	dk.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Serve the scratch image as pepysfs does, on a port of its own, since
+// servers can't be stopped. Close the disk of the Pepysfs when done.
+func serve(t *testing.T) (*Pepysfs, string) {
+	dk, err := disk.New(*image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dk.Mount(); err != nil {
+		dk.Close()
+		t.Fatal(err)
+	}
+	p, err := newPepysfs(dk, 1, "glenda")
+	if err != nil {
+		dk.Close()
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("localhost:%d", *port)
+	*port++
+	srv, err := server.New(p, "tcp", addr)
+	if err != nil {
+		dk.Close()
+		t.Fatal(err)
+	}
+	go srv.Start()
+	return p, addr
+}
+
+// The root of the tree aname at addr, as seen by uname
+func attach(t *testing.T, addr string, uname string, aname string) *client.Fid {
+	conn, err := client.Dial(ctx, "tcp", addr, uname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := conn.Attach(ctx, aname)
+	if err != nil {
+		t.Fatalf("attach %s: %s", aname, err)
+	}
+	return root
+}
+
+// Create the directory path
+func mkdir(t *testing.T, root *client.Fid, path string) {
+	f, err := root.Create(ctx, path, pepys.Pdir | 0777, "r")
+	if err != nil {
+		t.Fatalf("mkdir %s: %s", path, err)
+	}
+	f.Clunk(ctx)
+}
+
+// Write dat to the file path, creating it if need be
+func put(t *testing.T, root *client.Fid, path string, dat string) {
+	f, err := root.Open(ctx, path, "wt")
+	if err == pepys.Enotexist {
+		dir := root
+		name := path
+		if i := strings.LastIndex(path, "/"); i >= 0 {
+			if dir, err = root.Open(ctx, path[0:i], ""); err != nil {
+				t.Fatalf("put %s: %s", path, err)
+			}
+			defer dir.Clunk(ctx)
+			name = path[i + 1:]
+		}
+		f, err = dir.Create(ctx, name, 0666, "w")
+	}
+	if err != nil {
+		t.Fatalf("put %s: %s", path, err)
+	}
+	if _, err = f.Write(ctx, 0, []byte(dat)); err != nil {
+		f.Clunk(ctx)
+		t.Fatalf("put %s: %s", path, err)
+	}
+	if err = f.Clunk(ctx); err != nil {
+		t.Fatalf("put %s: %s", path, err)
+	}
+}
+
+// Read what is in the file path, with the version opened
+func get(t *testing.T, root *client.Fid, path string) (string, uint64) {
+	f, err := root.Open(ctx, path, "r")
+	if err != nil {
+		t.Fatalf("get %s: %s", path, err)
+	}
+	defer f.Clunk(ctx)
+	dat, err := f.Read(ctx, 0, 8000)
+	if err != nil {
+		t.Fatalf("get %s: %s", path, err)
+	}
+	return string(dat), f.Version
+}
+
+func stat(t *testing.T, root *client.Fid, path string) *pepys.Rstat {
+	f, err := root.Open(ctx, path, "")
+	if err != nil {
+		t.Fatalf("stat %s: %s", path, err)
+	}
+	defer f.Clunk(ctx)
+	st, err := f.Stat(ctx)
+	if err != nil {
+		t.Fatalf("stat %s: %s", path, err)
+	}
+	return st
+}
+
+func wstat(t *testing.T, root *client.Fid, path string, wst *pepys.Twstat) os.Error {
+	f, err := root.Open(ctx, path, "")
+	if err != nil {
+		t.Fatalf("wstat %s: %s", path, err)
+	}
+	defer f.Clunk(ctx)
+	return f.Wstat(ctx, wst)
+}
+
+func exists(t *testing.T, root *client.Fid, path string) bool {
+	f, err := root.Open(ctx, path, "")
+	if err == pepys.Enotexist {
+		return false
+	}
+	if err != nil {
+		t.Fatalf("open %s: %s", path, err)
+	}
+	f.Clunk(ctx)
+	return true
+}
+
+// Files and directories are made, written, renamed and removed, and are
+// still there after the disk is mounted again
+func TestFiles(t *testing.T) {
+	defer os.Remove(*image)
+	mkfs(t)
+	p, addr := serve(t)
+	root := attach(t, addr, "glenda", "")
+
+	// a new version each time a fid written to is clunked
+	mkdir(t, root, "d")
+	put(t, root, "d/a", "hello")
+	put(t, root, "d/a", "hello, world")
+	put(t, root, "b", "bee")
+	if s, v := get(t, root, "d/a"); s != "hello, world" || v != 3 {
+		t.Fatalf("d/a: read %q, version %d", s, v)
+	}
+	f, err := root.Open(ctx, "b", "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Clunk(ctx)
+	if _, v := get(t, root, "b"); v != 2 {
+		t.Fatalf("b: version %d after a clunk without writes", v)
+	}
+	if st := stat(t, root, "d"); st.Ftype & pepys.Fdir == 0 {
+		t.Fatal("d is not a directory")
+	}
+
+	// renamed and truncated in one go
+	wst := client.NewWstat()
+	wst.Name = "c"
+	wst.Length = 2
+	if err = wstat(t, root, "b", wst); err != nil {
+		t.Fatal(err)
+	}
+	if st := stat(t, root, "c"); st.Name != "c" || st.Length != 2 {
+		t.Fatalf("c: stat %v", st)
+	}
+	if s, _ := get(t, root, "c"); s != "be" {
+		t.Fatalf("c: truncated to %q", s)
+	}
+	if exists(t, root, "b") {
+		t.Fatal("b still there after the rename")
+	}
+
+	d, err := root.Open(ctx, "d", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Remove(ctx); err != pepys.Enotempty {
+		t.Fatalf("removing d with a in it: got %v", err)
+	}
+	for _, path := range []string{"d/a", "d"} {
+		if f, err = root.Open(ctx, path, ""); err == nil {
+			err = f.Remove(ctx)
+		}
+		if err != nil {
+			t.Fatalf("remove %s: %s", path, err)
+		}
+	}
+	if exists(t, root, "d") {
+		t.Fatal("d still there after remove")
+	}
+
+	other := attach(t, addr, "other", "")
+	if _, err = other.Create(ctx, "x", 0666, "w"); err != pepys.Eperm {
+		t.Fatalf("other creating in the root: got %v", err)
+	}
+	p.dk.Close()
+
+	p, addr = serve(t)
+	defer p.dk.Close()
+	root = attach(t, addr, "glenda", "")
+	if s, v := get(t, root, "c"); s != "be" || v != 3 {
+		t.Fatalf("c after mounting again: read %q, version %d", s, v)
+	}
+	if exists(t, root, "d") || exists(t, root, "b") {
+		t.Fatal("removed files back after mounting again")
+	}
+	put(t, root, "e", "new")
+	if s, _ := get(t, root, "e"); s != "new" {
+		t.Fatalf("e: read %q", s)
+	}
+}
+
+// A Twstat that can't be done in full changes nothing
+func TestWstat(t *testing.T) {
+	defer os.Remove(*image)
+	mkfs(t)
+	p, addr := serve(t)
+	defer p.dk.Close()
+	root := attach(t, addr, "glenda", "")
+	put(t, root, "a", "abc")
+	put(t, root, "b", "bee")
+	before := stat(t, root, "a")
+
+	wst := client.NewWstat()
+	wst.Name = "n"
+	wst.Perm = 01777
+	if err := wstat(t, root, "a", wst); err == nil {
+		t.Fatal("bad permission bits taken")
+	}
+	wst = client.NewWstat()
+	wst.Perm = 0600
+	wst.Name = "b"
+	if err := wstat(t, root, "a", wst); err != pepys.Eexist {
+		t.Fatalf("renaming over b: got %v", err)
+	}
+	other := attach(t, addr, "other", "")
+	wst = client.NewWstat()
+	wst.Name = "n"
+	wst.Mtime = 1
+	if err := wstat(t, other, "a", wst); err != pepys.Eperm && err != pepys.Enotowner {
+		t.Fatalf("other setting the mtime: got %v", err)
+	}
+
+	if exists(t, root, "n") {
+		t.Fatal("renamed by a Twstat that failed")
+	}
+	after := stat(t, root, "a")
+	if after.Version != before.Version || after.Perm != before.Perm || after.Mtime != before.Mtime {
+		t.Fatalf("stat %v changed to %v by a Twstat that failed", before, after)
+	}
+}
+
+// Files can't grow past what the log takes in a version
+func TestTooBig(t *testing.T) {
+	defer os.Remove(*image)
+	mkfs(t)
+	p, addr := serve(t)
+	defer p.dk.Close()
+	root := attach(t, addr, "glenda", "")
+	put(t, root, "a", "abc")
+
+	f, err := root.Open(ctx, "a", "w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []uint64{^uint64(0) - 1, 1 << 40} {
+		if _, err = f.Write(ctx, off, []byte("xyz")); err == nil || err.String() != Etoobig.String() {
+			t.Fatalf("write at %d: got %v", off, err)
+		}
+	}
+	f.Clunk(ctx)
+
+	wst := client.NewWstat()
+	wst.Name = "n"
+	wst.Length = 1 << 40
+	if err = wstat(t, root, "a", wst); err == nil || err.String() != Etoobig.String() {
+		t.Fatalf("truncating to %d: got %v", wst.Length, err)
+	}
+	if s, v := get(t, root, "a"); s != "abc" || v != 2 {
+		t.Fatalf("a: read %q, version %d", s, v)
+	}
+	if exists(t, root, "n") {
+		t.Fatal("renamed by a Twstat that failed")
+	}
+
+	// nor past -m, even where the log would take more
+	defer func(m uint64) { *maxfile = m }(*maxfile)
+	*maxfile = 4096
+	if f, err = root.Open(ctx, "a", "w"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write(ctx, 4000, make([]byte, 96)); err != nil {
+		t.Fatalf("write up to -m: %s", err)
+	}
+	if _, err = f.Write(ctx, 4000, make([]byte, 97)); err == nil || err.String() != Etoobig.String() {
+		t.Fatalf("write past -m: got %v", err)
+	}
+	f.Clunk(ctx)
+	wst = client.NewWstat()
+	wst.Length = 4097
+	if err = wstat(t, root, "a", wst); err == nil || err.String() != Etoobig.String() {
+		t.Fatalf("truncating past -m: got %v", err)
+	}
+	if st := stat(t, root, "a"); st.Length != 4096 {
+		t.Fatalf("a: %d bytes long, want 4096", st.Length)
+	}
+}
+
+// The tree as of time t
+func asof(t *testing.T, addr string, at int64) *client.Fid {
+	return attach(t, addr, "glenda", fmt.Sprintf("@%d", at))
+}
+
+// Old versions are listed in "name@" and can be read but not changed, and
+// the tree is seen as of the time given when attaching
+func TestHistory(t *testing.T) {
+	defer os.Remove(*image)
+	mkfs(t)
+	p, addr := serve(t)
+	root := attach(t, addr, "glenda", "")
+	put(t, root, "a", "one")
+	t1 := time.Nanoseconds()
+	put(t, root, "a", "two!")
+	put(t, root, "b", "bee")
+	mkdir(t, root, "d")
+	put(t, root, "d/x", "ex")
+	put(t, root, "d/x", "ex2")
+	put(t, root, "d/y", "why")
+
+	// made empty, then written twice
+	ents, err := client.NewFS(root).ReadDir("a@")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 3 || ents[1].Name != "2" || ents[1].Version != 2 || ents[1].Length != 3 {
+		t.Fatalf("a@: %d versions listed", len(ents))
+	}
+	if s, v := get(t, root, "a@/2"); s != "one" || v != 2 {
+		t.Fatalf("a@/2: read %q, version %d", s, v)
+	}
+	if _, err = root.Open(ctx, "a@/2", "w"); err != pepys.Eperm {
+		t.Fatalf("opening an old version for writing: got %v", err)
+	}
+	wst := client.NewWstat()
+	wst.Name = "z"
+	if err = wstat(t, root, "a@/2", wst); err != pepys.Eperm {
+		t.Fatalf("renaming an old version: got %v", err)
+	}
+	hist, err := root.Open(ctx, "a@", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = hist.Create(ctx, "4", 0666, "w")
+	hist.Clunk(ctx)
+	if err != pepys.Eperm {
+		t.Fatalf("making a version in a@: got %v", err)
+	}
+	if exists(t, root, "a@/9") || exists(t, root, "q@") {
+		t.Fatal("found versions of nothing")
+	}
+	if _, err = root.Create(ctx, "e@", 0666, "w"); err != pepys.Ename {
+		t.Fatalf("making e@: got %v", err)
+	}
+
+	past := asof(t, addr, t1)
+	if s, _ := get(t, past, "a"); s != "one" {
+		t.Fatalf("a as of t1: read %q", s)
+	}
+	if exists(t, past, "b") {
+		t.Fatal("b there before it was made")
+	}
+	if ents, err = client.NewFS(past).ReadDir("."); err != nil || len(ents) != 1 {
+		t.Fatalf("the root as of t1: %d entries, %v", len(ents), err)
+	}
+	if ents, err = client.NewFS(past).ReadDir("a@"); err != nil || len(ents) != 2 {
+		t.Fatalf("a@ as of t1: %d entries, %v", len(ents), err)
+	}
+	if !exists(t, past, "a@/2") || exists(t, past, "a@/3") || exists(t, root, "a@/02") {
+		t.Fatal("walked to a version not listed in a@")
+	}
+
+	// a directory version holds its files as they were when it was made
+	if ents, err = client.NewFS(root).ReadDir("d@/2"); err != nil || len(ents) != 1 || ents[0].Length != 0 {
+		t.Fatalf("d@/2: %v", err)
+	}
+	if s, _ := get(t, root, "d@/3/x"); s != "ex2" {
+		t.Fatalf("d@/3/x: read %q", s)
+	}
+	if s, _ := get(t, root, "d@/3/x@/2"); s != "ex" {
+		t.Fatalf("d@/3/x@/2: read %q", s)
+	}
+
+	// an mtime given in a Twstat doesn't move a version in time
+	wst = client.NewWstat()
+	wst.Mtime = 1
+	if err = wstat(t, root, "a", wst); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := get(t, past, "a"); s != "one" {
+		t.Fatalf("a as of t1, once its mtime is 1: read %q", s)
+	}
+	wst.Mtime = 1 << 62
+	if err = wstat(t, root, "a", wst); err != nil {
+		t.Fatal(err)
+	}
+	if _, v := get(t, asof(t, addr, time.Nanoseconds()), "a"); v != 5 {
+		t.Fatalf("a as of now, once its mtime is in the future: version %d", v)
+	}
+	p.dk.Close()
+
+	p, addr = serve(t)
+	defer p.dk.Close()
+	if s, _ := get(t, asof(t, addr, t1), "a"); s != "one" {
+		t.Fatalf("a as of t1 after mounting again: read %q", s)
+	}
+}
@@ -0,0 +1,469 @@
+// psh is an interactive shell for talking to a pepys server one message at
+// a time, for debugging servers
+package main
+
+import "os"
+import "fmt"
+import "flag"
+import "time"
+import "bufio"
+import "pepys"
+import "strconv"
+import "strings"
+import "pepys/client"
+
+var addr = flag.String("a", "localhost:5640", "address of the server")
+var uname = flag.String("u", os.Getenv("USER"), "user to start the session as")
+var aname = flag.String("n", "/", "tree to attach fid 1 to at start, none if empty")
+var script = flag.String("f", "", "run the commands in this file, then exit")
+var hfile = flag.String("h", os.Getenv("HOME") + "/.psh_history", "history file, none if empty")
+var stop = flag.Bool("e", false, "stop at the first error when running a script")
+var echo = flag.Bool("x", false, "print commands before running them")
+var timeout = flag.Int64("t", 0, "flush groups that take longer than this many milliseconds, never if 0")
+
+const help = `Messages are typed as
+	attach fid [aname]
+	open nfid path [mode [fid]]	fid is the attach fid if left out
+	create fid name perm [mode]	perm in octal, d in front for a directory
+	read fid offset count
+	write fid offset data...
+	clunk fid
+	remove fid
+	stat fid
+	wstat fid Field=value...
+	flush oldtag
+or in full, as in Topen Fid=1 Nfid=2 Path=/time Mode=r
+
+Each message is sent on its own, unless a group is started:
+	begin		queue the messages that follow
+	send		send the queued messages as one group
+	drop		forget the queued messages
+
+Other commands:
+	history		list the commands typed so far
+	!n		run command n again
+	!!		run the last command again
+	timeout [ms]	flush groups that take longer than ms, or show
+			the timeout; 0 means never
+	source file	run the commands in a file
+	help		print this
+	quit		leave
+`
+
+type shell struct {
+	conn *client.Conn
+	root uint32	// the fid of the last attach
+	group []interface{}
+	grouping bool
+	history []string
+	hist *os.File
+	failed bool	// the last command failed
+	errors int
+	timeout int64	// in milliseconds
+}
+
+// The number in s, which may be ~0 for all ones
+func number(s string, base int) (uint64, os.Error) {
+	if s == "~0" {
+		return ^uint64(0), nil
+	}
+	n, err := strconv.Btoui64(s, base)
+	if err != nil {
+		return 0, os.NewError("bad number " + s)
+	}
+	return n, nil
+}
+
+func fid(s string) (uint32, os.Error) {
+	n, err := number(s, 0)
+	return uint32(n), err
+}
+
+func nargs(args []string, min int, max int) os.Error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return os.NewError("wrong number of arguments, try help")
+	}
+	return nil
+}
+
+// Turn a command in the short form into a message
+func (sh *shell) message(cmd string, args []string) (interface{}, os.Error) {
+	var err os.Error
+	switch cmd {
+	case "attach":
+		if err = nargs(args, 1, 2); err != nil {
+			return nil, err
+		}
+		at := new(pepys.Tattach)
+		if at.Fid, err = fid(args[0]); err != nil {
+			return nil, err
+		}
+		at.Afid = pepys.Nofid
+		at.Uname = sh.conn.Uname
+		if len(args) > 1 {
+			at.Aname = args[1]
+		}
+		return at, nil
+	case "open":
+		if err = nargs(args, 2, 4); err != nil {
+			return nil, err
+		}
+		op := new(pepys.Topen)
+		op.Fid = sh.root
+		if op.Nfid, err = fid(args[0]); err != nil {
+			return nil, err
+		}
+		op.Path = args[1]
+		if len(args) > 2 {
+			op.Mode = args[2]
+		}
+		if len(args) > 3 {
+			if op.Fid, err = fid(args[3]); err != nil {
+				return nil, err
+			}
+		}
+		return op, nil
+	case "create":
+		if err = nargs(args, 3, 4); err != nil {
+			return nil, err
+		}
+		cr := new(pepys.Tcreate)
+		if cr.Fid, err = fid(args[0]); err != nil {
+			return nil, err
+		}
+		cr.Name = args[1]
+		perm := args[2]
+		if strings.HasPrefix(perm, "d") {
+			cr.Perm = pepys.Pdir
+			perm = perm[1:]
+		}
+		n, err := number(perm, 8)
+		if err != nil {
+			return nil, err
+		}
+		cr.Perm |= uint32(n)
+		if len(args) > 3 {
+			cr.Mode = args[3]
+		}
+		return cr, nil
+	case "read":
+		if err = nargs(args, 3, 3); err != nil {
+			return nil, err
+		}
+		rd := new(pepys.Tread)
+		if rd.Fid, err = fid(args[0]); err != nil {
+			return nil, err
+		}
+		if rd.Offset, err = number(args[1], 0); err != nil {
+			return nil, err
+		}
+		n, err := number(args[2], 0)
+		if err != nil {
+			return nil, err
+		}
+		rd.Count = uint32(n)
+		return rd, nil
+	case "write":
+		if err = nargs(args, 2, -1); err != nil {
+			return nil, err
+		}
+		wr := new(pepys.Twrite)
+		if wr.Fid, err = fid(args[0]); err != nil {
+			return nil, err
+		}
+		if wr.Offset, err = number(args[1], 0); err != nil {
+			return nil, err
+		}
+		wr.Dat = []byte(strings.Join(args[2:], " "))
+		return wr, nil
+	case "clunk", "remove", "stat":
+		if err = nargs(args, 1, 1); err != nil {
+			return nil, err
+		}
+		n, err := fid(args[0])
+		if err != nil {
+			return nil, err
+		}
+		switch cmd {
+		case "clunk":
+			cl := new(pepys.Tclunk)
+			cl.Fid = n
+			return cl, nil
+		case "remove":
+			rm := new(pepys.Tremove)
+			rm.Fid = n
+			return rm, nil
+		}
+		st := new(pepys.Tstat)
+		st.Fid = n
+		return st, nil
+	case "wstat":
+		if err = nargs(args, 1, -1); err != nil {
+			return nil, err
+		}
+		// start from a Twstat that changes nothing
+		line := "Twstat Fid=" + args[0] + " Perm=~0 Length=~0 Mtime=~0 " + strings.Join(args[1:], " ")
+		return client.ParseMsg(line)
+	case "flush":
+		if err = nargs(args, 1, 1); err != nil {
+			return nil, err
+		}
+		tf := new(pepys.Tflush)
+		if tf.Oldtag, err = fid(args[0]); err != nil {
+			return nil, err
+		}
+		return tf, nil
+	}
+	return nil, os.NewError("unknown command " + cmd + ", try help")
+}
+
+// Send a group and print what came back, and how long it took
+func (sh *shell) send(msgs []interface{}) {
+	ctx := client.Background()
+	cancel := func() {}
+	if sh.timeout > 0 {
+		ctx, cancel = client.WithTimeout(ctx, sh.timeout * 1e6)
+	}
+	defer cancel()
+	start := time.Nanoseconds()
+	resp, err := sh.conn.Rpc(ctx, msgs...)
+	took := time.Nanoseconds() - start
+	for _, r := range resp {
+		fmt.Printf("%s\n", client.FormatMsg(r))
+	}
+	if err != nil {
+		if err == ctx.Err() {
+			fmt.Printf("flushed: %s\n", err)
+		} else if _, ok := err.(*client.Error); ok || len(resp) < len(msgs) {
+			fmt.Printf("Rerror Ename=%q\n", err.String())
+		} else {
+			fmt.Printf("error: %s\n", err)
+		}
+		sh.failed = true
+		sh.errors++
+	}
+	fmt.Printf("(%d of %d messages in %.3fms)\n", len(resp), len(msgs), float64(took) / 1e6)
+
+	// later opens start from the last fid attached
+	for i, r := range resp {
+		if _, ok := r.(*pepys.Rattach); ok {
+			sh.root = msgs[i].(*pepys.Tattach).Fid
+		}
+	}
+}
+
+func (sh *shell) queue(msg interface{}) {
+	if len(sh.group) == cap(sh.group) {
+		group := make([]interface{}, len(sh.group), 2 * cap(sh.group) + 4)
+		copy(group, sh.group)
+		sh.group = group
+	}
+	sh.group = sh.group[0:len(sh.group) + 1]
+	sh.group[len(sh.group) - 1] = msg
+}
+
+func (sh *shell) remember(line string) {
+	if len(sh.history) == cap(sh.history) {
+		history := make([]string, len(sh.history), 2 * cap(sh.history) + 16)
+		copy(history, sh.history)
+		sh.history = history
+	}
+	sh.history = sh.history[0:len(sh.history) + 1]
+	sh.history[len(sh.history) - 1] = line
+}
+
+func (sh *shell) complain(err os.Error) {
+	fmt.Printf("error: %s\n", err)
+	sh.failed = true
+	sh.errors++
+}
+
+// Run one line; typed lines go into the history
+func (sh *shell) run(line string, typed bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return
+	}
+	if line[0] == '!' {
+		n := len(sh.history)
+		if line != "!!" {
+			var err os.Error
+			if n, err = strconv.Atoi(line[1:]); err != nil {
+				sh.complain(os.NewError("bad history number " + line[1:]))
+				return
+			}
+		}
+		if n < 1 || n > len(sh.history) {
+			sh.complain(os.NewError("no such command in history"))
+			return
+		}
+		line = sh.history[n - 1]
+		fmt.Printf("%s\n", line)
+	}
+	if typed {
+		sh.remember(line)
+		if sh.hist != nil {
+			sh.hist.WriteString(line + "\n")
+		}
+	}
+	if *echo {
+		fmt.Printf("> %s\n", line)
+	}
+
+	f := strings.Fields(line)
+	cmd, args := f[0], f[1:]
+	switch cmd {
+	case "help":
+		fmt.Printf("%s", help)
+		return
+	case "quit", "exit":
+		os.Exit(0)
+	case "history":
+		for i, h := range sh.history {
+			fmt.Printf("%4d  %s\n", i + 1, h)
+		}
+		return
+	case "source", ".":
+		if len(args) != 1 {
+			sh.complain(os.NewError("source takes a file name"))
+			return
+		}
+		sh.source(args[0])
+		return
+	case "timeout":
+		if len(args) == 0 {
+			fmt.Printf("%dms\n", sh.timeout)
+			return
+		}
+		n, err := strconv.Atoi64(args[0])
+		if err != nil || n < 0 {
+			sh.complain(os.NewError("bad timeout " + args[0]))
+			return
+		}
+		sh.timeout = n
+		return
+	case "begin":
+		sh.grouping = true
+		return
+	case "send":
+		if len(sh.group) > 0 {
+			sh.send(sh.group)
+		}
+		sh.group = nil
+		sh.grouping = false
+		return
+	case "drop":
+		sh.group = nil
+		sh.grouping = false
+		return
+	}
+
+	var msg interface{}
+	var err os.Error
+	if strings.HasPrefix(cmd, "T") {
+		msg, err = client.ParseMsg(line)
+	} else {
+		msg, err = sh.message(cmd, args)
+	}
+	if err != nil {
+		sh.complain(err)
+		return
+	}
+	if sh.grouping {
+		sh.queue(msg)
+		fmt.Printf("(%d queued)\n", len(sh.group))
+		return
+	}
+	sh.send([]interface{}{msg})
+}
+
+// Run the commands in a file
+func (sh *shell) source(name string) {
+	file, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		sh.complain(err)
+		return
+	}
+	defer file.Close()
+	in := bufio.NewReader(file)
+	for {
+		line, err := in.ReadString('\n')
+		sh.failed = false
+		sh.run(line, false)
+		if sh.failed && *stop {
+			fmt.Fprintf(os.Stderr, "psh: %s: stopped at %s\n", name, strings.TrimSpace(line))
+			os.Exit(1)
+		}
+		if err != nil {
+			break
+		}
+	}
+}
+
+// Load the history left by earlier runs
+func (sh *shell) loadHistory() {
+	file, err := os.Open(*hfile, os.O_RDONLY, 0)
+	if err == nil {
+		in := bufio.NewReader(file)
+		for {
+			line, err := in.ReadString('\n')
+			if line = strings.TrimSpace(line); line != "" {
+				sh.remember(line)
+			}
+			if err != nil {
+				break
+			}
+		}
+		file.Close()
+	}
+	sh.hist, _ = os.Open(*hfile, os.O_WRONLY | os.O_CREAT | os.O_APPEND, 0600)
+}
+
+func main() {
+	flag.Parse()
+
+	conn, err := client.Dial(client.Background(), "tcp", *addr, *uname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "psh: %s: %s\n", *addr, err)
+		os.Exit(1)
+	}
+	sh := new(shell)
+	sh.conn = conn
+	sh.root = 1
+	sh.timeout = *timeout
+
+	if *script != "" {
+		if *aname != "" {
+			sh.run("attach 1 " + *aname, false)
+		}
+		sh.source(*script)
+		if sh.errors > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	fmt.Printf("connected to %s, msize %d nmsgs %d ssid %d; type help for help\n",
+		*addr, conn.Msize, conn.Nmsgs, conn.Ssid)
+	if *hfile != "" {
+		sh.loadHistory()
+	}
+	if *aname != "" {
+		sh.run("attach 1 " + *aname, false)
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		if sh.grouping {
+			fmt.Printf("psh+ ")
+		} else {
+			fmt.Printf("psh> ")
+		}
+		line, err := in.ReadString('\n')
+		sh.run(line, true)
+		if err != nil {
+			fmt.Printf("\n")
+			break
+		}
+	}
+	conn.Close()
+}
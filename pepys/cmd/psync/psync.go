@@ -0,0 +1,610 @@
+// psync copies a tree to another, local or on a pepys server, skipping the
+// files that have not changed since the last time
+package main
+
+import "os"
+import "fmt"
+import "flag"
+import "path"
+import "time"
+import "bufio"
+import "pepys"
+import "strconv"
+import "strings"
+import "pepys/client"
+
+var uname = flag.String("u", os.Getenv("USER"), "user to start sessions as")
+var aname = flag.String("n", "/", "tree to attach to on servers")
+var state = flag.String("s", os.Getenv("HOME") + "/.psync", "file keeping the versions of the last sync, none if empty")
+var workers = flag.Int("p", 4, "files to copy at once")
+var bsize = flag.Int("b", 1 << 20, "bytes to read and write at a time")
+var verbose = flag.Bool("v", false, "print the files copied")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: psync [flags] from to\n\n")
+	fmt.Fprintf(os.Stderr, "from and to are local paths, or host:port:path for a pepys server\n\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// A file in a tree, as far as syncing goes
+type entry struct {
+	name string
+	dir bool
+	length uint64
+	version uint64
+	perm uint32
+}
+
+type reader interface {
+	ReadAt(p []byte, off int64) (int, os.Error)
+	Close() os.Error
+}
+
+type writer interface {
+	WriteAt(p []byte, off int64) (int, os.Error)
+	Close() os.Error
+}
+
+// One end of a sync. Names are relative to the top of the tree, with "."
+// for the top itself.
+type tree interface {
+	String() string
+	list(dir string) ([]*entry, os.Error)
+	mkdir(name string, perm uint32) os.Error
+	// open many files at once, for reading or to write them from the start;
+	// exists says which of them are there already
+	readers(names []string) ([]reader, []os.Error)
+	writers(names []string, perms []uint32, exists []bool) ([]writer, []os.Error)
+}
+
+func join(dir string, name string) string {
+	if dir == "." {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// A local tree
+type local string
+
+func (t local) String() string {
+	return string(t)
+}
+
+func (t local) path(name string) string {
+	return path.Join(string(t), name)
+}
+
+func (t local) list(dir string) ([]*entry, os.Error) {
+	f, err := os.Open(t.path(dir), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	ents := make([]*entry, 0, len(fis))
+	for i := range fis {
+		fi := &fis[i]
+		if !fi.IsDirectory() && !fi.IsRegular() {
+			continue
+		}
+		e := new(entry)
+		e.name = fi.Name
+		e.dir = fi.IsDirectory()
+		e.length = uint64(fi.Size)
+		e.version = uint64(fi.Mtime_ns) ^ uint64(fi.Size) << 48
+		e.perm = fi.Mode & 0777
+		ents = ents[0:len(ents) + 1]
+		ents[len(ents) - 1] = e
+	}
+	return ents, nil
+}
+
+func (t local) mkdir(name string, perm uint32) os.Error {
+	return os.Mkdir(t.path(name), perm)
+}
+
+func (t local) readers(names []string) ([]reader, []os.Error) {
+	rs := make([]reader, len(names))
+	errs := make([]os.Error, len(names))
+	for i, name := range names {
+		f, err := os.Open(t.path(name), os.O_RDONLY, 0)
+		if err == nil {
+			rs[i] = f
+		}
+		errs[i] = err
+	}
+	return rs, errs
+}
+
+func (t local) writers(names []string, perms []uint32, exists []bool) ([]writer, []os.Error) {
+	ws := make([]writer, len(names))
+	errs := make([]os.Error, len(names))
+	for i, name := range names {
+		f, err := os.Open(t.path(name), os.O_WRONLY | os.O_CREAT | os.O_TRUNC, perms[i])
+		if err == nil {
+			ws[i] = f
+		}
+		errs[i] = err
+	}
+	return ws, errs
+}
+
+// Nothing is given up on
+var ctx = client.Background()
+
+// A tree on a pepys server. Files are opened and created many at a time,
+// in as few groups as the session allows.
+type remote struct {
+	addr string
+	top string
+	conn *client.Conn
+	root *client.Fid
+	fsys *client.FS
+}
+
+func dial(addr string, top string) (*remote, os.Error) {
+	t := new(remote)
+	t.addr = addr
+	top = path.Clean("/" + top)
+	if top == "/" {
+		t.top = "."
+	} else {
+		t.top = top[1:]
+	}
+	var err os.Error
+	if t.conn, err = client.Dial(ctx, "tcp", addr, *uname); err != nil {
+		return nil, err
+	}
+	if t.root, err = t.conn.Attach(ctx, *aname); err != nil {
+		t.conn.Close()
+		return nil, err
+	}
+	t.fsys = client.NewFS(t.root)
+	return t, nil
+}
+
+func (t *remote) String() string {
+	if t.top == "." {
+		return t.addr + ":/"
+	}
+	return t.addr + ":/" + t.top
+}
+
+func (t *remote) path(name string) string {
+	if name == "." {
+		return t.top
+	}
+	return join(t.top, name)
+}
+
+func (t *remote) list(dir string) ([]*entry, os.Error) {
+	sts, err := t.fsys.ReadDir(t.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	ents := make([]*entry, len(sts))
+	for i, st := range sts {
+		e := new(entry)
+		e.name = st.Name
+		e.dir = st.Ftype & pepys.Fdir != 0
+		e.length = st.Length
+		e.version = st.Version
+		e.perm = st.Perm & 0777
+		ents[i] = e
+	}
+	return ents, nil
+}
+
+func (t *remote) mkdir(name string, perm uint32) os.Error {
+	dir, file := path.Split(t.path(name))
+	if dir == "" {
+		dir = "."
+	}
+	d, err := t.root.Open(ctx, dir, "")
+	if err != nil {
+		return err
+	}
+	f, err := d.Create(ctx, file, pepys.Pdir | perm, "r")
+	d.Clunk(ctx)
+	if err != nil {
+		return err
+	}
+	return f.Clunk(ctx)
+}
+
+func (t *remote) readers(names []string) ([]reader, []os.Error) {
+	rs := make([]reader, len(names))
+	errs := make([]os.Error, len(names))
+	b := t.conn.Batch()
+	ops := make([]*client.Future, len(names))
+	for i, name := range names {
+		ops[i] = b.Open(t.root, t.path(name), "r")
+	}
+	b.Send(ctx)
+	for i, op := range ops {
+		f := op.Fid
+		err := op.Err()
+		if err == client.Eskipped {
+			// stuck behind one that failed, try again on its own
+			f, err = t.root.Open(ctx, t.path(names[i]), "r")
+		}
+		if err == nil {
+			rs[i] = client.NewFile(f)
+		}
+		errs[i] = err
+	}
+	return rs, errs
+}
+
+func (t *remote) writers(names []string, perms []uint32, exists []bool) ([]writer, []os.Error) {
+	ws := make([]writer, len(names))
+	errs := make([]os.Error, len(names))
+	b := t.conn.Batch()
+	dirs := make([]*client.Future, len(names))
+	ops := make([]*client.Future, len(names))
+	for i, name := range names {
+		if exists[i] {
+			ops[i] = b.Open(t.root, t.path(name), "wt")
+			continue
+		}
+		// creating turns a fid for the directory into the file
+		dir, file := path.Split(t.path(name))
+		if dir == "" {
+			dir = "."
+		}
+		dirs[i] = b.Open(t.root, dir, "")
+		ops[i] = b.Create(dirs[i].Fid, file, perms[i], "w")
+	}
+	b.Send(ctx)
+	for i, op := range ops {
+		err := op.Err()
+		if err == nil {
+			ws[i] = client.NewFile(op.Fid)
+			continue
+		}
+		if dirs[i] != nil && dirs[i].Err() == nil {
+			// the directory fid is still a directory
+			dirs[i].Fid.Clunk(ctx)
+		}
+		if err == client.Eskipped {
+			ws[i], err = t.create(names[i], perms[i], exists[i])
+		}
+		errs[i] = err
+	}
+	return ws, errs
+}
+
+// Open or create one file for writing, the slow way
+func (t *remote) create(name string, perm uint32, exists bool) (writer, os.Error) {
+	var f *client.File
+	var err os.Error
+	if exists {
+		f, err = t.root.OpenFile(ctx, t.path(name), "wt")
+	} else {
+		dir, file := path.Split(t.path(name))
+		if dir == "" {
+			dir = "."
+		}
+		var d *client.Fid
+		if d, err = t.root.Open(ctx, dir, ""); err != nil {
+			return nil, err
+		}
+		f, err = d.CreateFile(ctx, file, perm, "w")
+		d.Clunk(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Where a spec names a tree on a server, it has the address in front
+func open(spec string) (tree, os.Error) {
+	i := strings.Index(spec, ":")
+	if i < 0 {
+		return local(spec), nil
+	}
+	j := strings.Index(spec[i+1:], ":")
+	if j < 0 {
+		return local(spec), nil
+	}
+	return dial(spec[0:i+1+j], spec[i+2+j:])
+}
+
+// The versions of both ends of each file after the last sync, by the names
+// of both ends
+type syncState struct {
+	name string
+	vers map[string][2]uint64
+}
+
+func loadState(name string) *syncState {
+	s := new(syncState)
+	s.name = name
+	s.vers = make(map[string][2]uint64, 1024)
+	if name == "" {
+		return s
+	}
+	f, err := os.Open(name, os.O_RDONLY, 0)
+	if err != nil {
+		return s
+	}
+	defer f.Close()
+	in := bufio.NewReader(f)
+	for {
+		line, err := in.ReadString('\n')
+		fields := strings.Split(strings.TrimRight(line, "\n"), "\t", 3)
+		if len(fields) == 3 {
+			sv, err1 := strconv.Btoui64(fields[0], 10)
+			dv, err2 := strconv.Btoui64(fields[1], 10)
+			if err1 == nil && err2 == nil {
+				s.vers[fields[2]] = [2]uint64{sv, dv}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return s
+}
+
+func (s *syncState) save() os.Error {
+	if s.name == "" {
+		return nil
+	}
+	f, err := os.Open(s.name + ".new", os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(f)
+	for key, v := range s.vers {
+		fmt.Fprintf(out, "%d\t%d\t%s\n", v[0], v[1], key)
+	}
+	if err = out.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(s.name + ".new", s.name)
+}
+
+// The sync going on
+type syncer struct {
+	src tree
+	dst tree
+	state *syncState
+
+	// totals, only touched between directories
+	files int
+	skipped int
+	bytes int64
+	errors int
+}
+
+func (s *syncer) fail(name string, err os.Error) {
+	fmt.Fprintf(os.Stderr, "psync: %s: %s\n", name, err)
+	s.errors++
+}
+
+func (s *syncer) key(name string) string {
+	return s.src.String() + "/" + name + "\t" + s.dst.String() + "/" + name
+}
+
+// Call op for 0 to n-1, with up to *workers of them at once
+func parallel(n int, op func(i int)) {
+	slots := make(chan bool, *workers)
+	done := make(chan bool, n)
+	for i := 0; i < n; i++ {
+		slots <- true
+		go func(i int) {
+			op(i)
+			<-slots
+			done <- true
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		<-done
+	}
+}
+
+func copyFile(r reader, w writer) (int64, os.Error) {
+	buf := make([]byte, *bsize)
+	var off int64
+	for {
+		n, err := r.ReadAt(buf, off)
+		if n > 0 {
+			if _, werr := w.WriteAt(buf[0:n], off); werr != nil {
+				return off, werr
+			}
+			off += int64(n)
+		}
+		if err == os.EOF {
+			return off, nil
+		}
+		if err != nil {
+			return off, err
+		}
+	}
+	return off, nil
+}
+
+func byName(ents []*entry) map[string]*entry {
+	m := make(map[string]*entry, len(ents))
+	for _, e := range ents {
+		m[e.name] = e
+	}
+	return m
+}
+
+// Sync the directory dir and everything below it
+func (s *syncer) sync(dir string) {
+	sents, err := s.src.list(dir)
+	if err != nil {
+		s.fail(s.src.String() + "/" + dir, err)
+		return
+	}
+	dents, err := s.dst.list(dir)
+	if err != nil {
+		s.fail(s.dst.String() + "/" + dir, err)
+		return
+	}
+	dst := byName(dents)
+
+	// find what changed since the last time
+	n := 0
+	names := make([]string, len(sents))
+	perms := make([]uint32, len(sents))
+	exists := make([]bool, len(sents))
+	srcs := make([]*entry, len(sents))
+	for _, e := range sents {
+		if e.dir {
+			continue
+		}
+		name := join(dir, e.name)
+		d := dst[e.name]
+		if d != nil && d.dir {
+			s.fail(s.dst.String() + "/" + name, pepys.Eisdir)
+			continue
+		}
+		v, ok := s.state.vers[s.key(name)]
+		if ok && d != nil && v[0] == e.version && v[1] == d.version {
+			s.skipped++
+			continue
+		}
+		names[n] = name
+		perms[n] = e.perm
+		exists[n] = d != nil
+		srcs[n] = e
+		n++
+	}
+	names = names[0:n]
+
+	// open as many as are copied at once, copy them, and on to the next
+	// lot, so no more than *workers files are open on either side
+	if n > 0 {
+		counts := make([]int64, n)
+		errs := make([]os.Error, n)
+		for lo := 0; lo < n; lo += *workers {
+			hi := lo + *workers
+			if hi > n {
+				hi = n
+			}
+			rs, rerrs := s.src.readers(names[lo:hi])
+			ws, werrs := s.dst.writers(names[lo:hi], perms[lo:hi], exists[lo:hi])
+			parallel(hi - lo, func(i int) {
+				j := lo + i
+				if rerrs[i] != nil {
+					errs[j] = rerrs[i]
+				} else if werrs[i] != nil {
+					errs[j] = werrs[i]
+				} else {
+					counts[j], errs[j] = copyFile(rs[i], ws[i])
+				}
+				if rs[i] != nil {
+					rs[i].Close()
+				}
+				if ws[i] != nil {
+					if err := ws[i].Close(); errs[j] == nil {
+						errs[j] = err
+					}
+				}
+			})
+		}
+
+		// the new versions of what was written, in one listing
+		if dents, err = s.dst.list(dir); err != nil {
+			s.fail(s.dst.String() + "/" + dir, err)
+			return
+		}
+		dst = byName(dents)
+		for i, name := range names {
+			s.bytes += counts[i]
+			if errs[i] != nil {
+				s.fail(name, errs[i])
+				continue
+			}
+			s.files++
+			if *verbose {
+				fmt.Printf("%s\n", name)
+			}
+			_, file := path.Split(name)
+			if d := dst[file]; d != nil {
+				s.state.vers[s.key(name)] = [2]uint64{srcs[i].version, d.version}
+			}
+		}
+	}
+
+	for _, e := range sents {
+		if !e.dir {
+			continue
+		}
+		name := join(dir, e.name)
+		if d := dst[e.name]; d == nil {
+			if err = s.dst.mkdir(name, e.perm); err != nil {
+				s.fail(s.dst.String() + "/" + name, err)
+				continue
+			}
+		} else if !d.dir {
+			s.fail(s.dst.String() + "/" + name, pepys.Enotdir)
+			continue
+		}
+		s.sync(name)
+	}
+}
+
+func report(t tree) {
+	r, ok := t.(*remote)
+	if !ok {
+		return
+	}
+	groups, msgs := r.conn.Stats()
+	fmt.Printf("%s: %d messages in %d groups, 9P would have needed %d round trips\n", r.addr, msgs, groups, msgs)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 2 || *workers < 1 || *bsize < 1 {
+		usage()
+	}
+
+	src, err := open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "psync: %s: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+	dst, err := open(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "psync: %s: %s\n", flag.Arg(1), err)
+		os.Exit(1)
+	}
+
+	s := new(syncer)
+	s.src = src
+	s.dst = dst
+	s.state = loadState(*state)
+	start := time.Nanoseconds()
+	s.sync(".")
+	took := float64(time.Nanoseconds() - start) / 1e9
+	if err = s.state.save(); err != nil {
+		s.fail(*state, err)
+	}
+
+	fmt.Printf("%d files copied, %d unchanged, %d bytes in %.2fs", s.files, s.skipped, s.bytes, took)
+	if took > 0 {
+		fmt.Printf(", %.2f MB/s", float64(s.bytes) / took / 1e6)
+	}
+	fmt.Printf("\n")
+	report(src)
+	report(dst)
+	if s.errors > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,689 @@
+// ufs exports a local directory tree over pepys
+package main
+
+import "os"
+import "fmt"
+import "flag"
+import "path"
+import "pepys"
+import "strings"
+import "strconv"
+import "io/ioutil"
+import "pepys/server"
+
+var addr = flag.String("a", "localhost:5640", "address to listen on")
+var root = flag.String("r", ".", "directory to export")
+var umap = flag.String("u", "", "file mapping remote user names to local ones")
+var nobody = flag.String("n", "nobody", "local user for remote users without a mapping (refused if empty)")
+
+// A local user, as far as permission checks go
+type user struct {
+	name string
+	uid int
+	gids []int
+}
+
+type Ufs struct {
+	root string
+
+	users map[string]*user	// local users by name
+	names map[int]string	// local user names by uid
+	groups map[int]string	// local group names by gid
+	gids map[string]int	// local group ids by name
+	remote map[string]string	// remote user name to local one
+}
+
+// The state of an open fid, kept in its Aux
+type ufsFid struct {
+	file *os.File
+	mode int
+	dir bool
+
+	// directory reads
+	dr server.DirReader
+}
+
+// Read the lines of a colon separated file such as /etc/passwd
+func readTable(name string) ([][]string, os.Error) {
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(buf), "\n", -1)
+	table := make([][]string, 0, len(lines))
+	for _, line := range lines {
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		table = table[0:len(table) + 1]
+		table[len(table) - 1] = strings.Split(line, ":", -1)
+	}
+	return table, nil
+}
+
+// Load local users and groups, and the remote user name map
+func (u *Ufs) loadUsers(mapfile string) os.Error {
+	u.users = make(map[string]*user, 64)
+	u.names = make(map[int]string, 64)
+	u.groups = make(map[int]string, 64)
+	u.gids = make(map[string]int, 64)
+	u.remote = make(map[string]string, 16)
+
+	passwd, err := readTable("/etc/passwd")
+	if err != nil {
+		return err
+	}
+	for _, ent := range passwd {
+		if len(ent) < 4 {
+			continue
+		}
+		uid, err1 := strconv.Atoi(ent[2])
+		gid, err2 := strconv.Atoi(ent[3])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		usr := new(user)
+		usr.name = ent[0]
+		usr.uid = uid
+		usr.gids = []int{gid}
+		u.users[usr.name] = usr
+		u.names[uid] = usr.name
+	}
+
+	group, err := readTable("/etc/group")
+	if err != nil {
+		return err
+	}
+	for _, ent := range group {
+		if len(ent) < 4 {
+			continue
+		}
+		gid, err := strconv.Atoi(ent[2])
+		if err != nil {
+			continue
+		}
+		u.groups[gid] = ent[0]
+		u.gids[ent[0]] = gid
+		for _, name := range strings.Split(ent[3], ",", -1) {
+			usr, present := u.users[name]
+			if !present {
+				continue
+			}
+			gids := make([]int, len(usr.gids) + 1)
+			copy(gids, usr.gids)
+			gids[len(usr.gids)] = gid
+			usr.gids = gids
+		}
+	}
+
+	if mapfile == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(mapfile)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(buf), "\n", -1) {
+		f := strings.Fields(line)
+		if len(f) == 0 || f[0][0] == '#' {
+			continue
+		}
+		if len(f) != 2 {
+			return os.NewError(mapfile + ": bad line: " + line)
+		}
+		u.remote[f[0]] = f[1]
+	}
+	return nil
+}
+
+// Find the local user a remote user name maps to. Only the map file
+// can make a remote user a local one, the others are nobody.
+func (u *Ufs) local(uname string) *user {
+	if name, present := u.remote[uname]; present {
+		return u.users[name]
+	}
+	if usr, present := u.users[*nobody]; present && *nobody != "" && usr.uid != 0 {
+		return usr
+	}
+	return nil
+}
+
+// Check whether usr is allowed the access in want (Prm bits) to a file.
+// Remote users get no more from being root than permissions say.
+func allowed(usr *user, fi *os.FileInfo, want uint32) bool {
+	perm := fi.Mode & 7
+	if fi.Uid == usr.uid {
+		perm |= (fi.Mode >> 6) & 7
+	}
+	for _, gid := range usr.gids {
+		if fi.Gid == gid {
+			perm |= (fi.Mode >> 3) & 7
+		}
+	}
+	return perm & want == want
+}
+
+// Files are looked at without following symbolic links, which could lead out
+// of the exported tree
+func lstat(name string) (*os.FileInfo, os.Error) {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return nil, pepys.Enotexist
+	}
+	if fi.IsSymlink() {
+		return nil, pepys.Eperm
+	}
+	return fi, nil
+}
+
+// Versions change whenever the contents do
+func version(fi *os.FileInfo) uint64 {
+	return uint64(fi.Mtime_ns) ^ uint64(fi.Size) << 48
+}
+
+func (u *Ufs) stat(fi *os.FileInfo) *pepys.Rstat {
+	st := new(pepys.Rstat)
+	if fi.IsDirectory() {
+		st.Ftype = pepys.Fdir
+	} else {
+		st.Ftype = pepys.Fversioned
+		st.Length = uint64(fi.Size)
+	}
+	st.Version = version(fi)
+	st.Perm = fi.Mode & 0777
+	st.Uid = u.names[fi.Uid]
+	if st.Uid == "" {
+		st.Uid = strconv.Itoa(fi.Uid)
+	}
+	st.Gid = u.groups[fi.Gid]
+	if st.Gid == "" {
+		st.Gid = strconv.Itoa(fi.Gid)
+	}
+	st.Muid = st.Uid
+	st.Atime = uint64(fi.Atime_ns)
+	st.Mtime = uint64(fi.Mtime_ns)
+	st.Name = fi.Name
+	return st
+}
+
+// The local file behind a fid, its owner and its state if it is open
+func (u *Ufs) file(conn *server.Connection, num uint32) (string, *user, *ufsFid, os.Error) {
+	fid := conn.GetFid(num)
+	if fid == nil {
+		return "", nil, nil, pepys.Ebadfid
+	}
+	uf, _ := fid.Aux.(*ufsFid)
+	return fid.Node.(string), conn.Aux.(*user), uf, nil
+}
+
+func (u *Ufs) Root(conn *server.Connection, aname string) (interface{}, os.Error) {
+	// the attach name picks a directory in the exported tree, every step
+	// of the way is checked for symbolic links
+	name := u.root
+	for _, elem := range strings.Split(path.Clean("/" + aname), "/", -1) {
+		if elem == "" {
+			continue
+		}
+		name += "/" + elem
+		fi, err := lstat(name)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDirectory() {
+			return nil, pepys.Enotdir
+		}
+	}
+	if name == "" {
+		name = "/"
+	}
+	return name, nil
+}
+
+func (u *Ufs) Walk(conn *server.Connection, dir interface{}, name string) (interface{}, os.Error) {
+	d := dir.(string)
+	fi, err := lstat(d)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDirectory() {
+		return nil, pepys.Enotdir
+	}
+	if !allowed(conn.Aux.(*user), fi, pepys.Prmexec) {
+		return nil, pepys.Eperm
+	}
+	name = d + "/" + name
+	if _, err = lstat(name); err != nil {
+		return nil, err
+	}
+	return name, nil
+}
+
+func (u *Ufs) Proto(conn *server.Connection, arg *pepys.Tproto) (*pepys.Rproto, os.Error) {
+	// no options supported
+	return server.Negotiate(conn, arg)
+}
+
+func (u *Ufs) Session(conn *server.Connection, arg *pepys.Tsession) (*pepys.Rsession, os.Error) {
+	resp := new(pepys.Rsession)
+	resp.Ssid = arg.Csid
+	return resp, nil
+}
+
+func (u *Ufs) Attach(conn *server.Connection, arg *pepys.Tattach) (*pepys.Rattach, os.Error) {
+	uname := arg.Uname
+	if uname == "" {
+		uname = conn.Uname
+	}
+	usr := u.local(uname)
+	if usr == nil {
+		return nil, pepys.Eperm
+	}
+	conn.Aux = usr
+	fmt.Printf("%s:: %s attached as %s\n", conn.RemoteAddr, uname, usr.name)
+	return new(pepys.Rattach), nil
+}
+
+func (u *Ufs) Flush(conn *server.Connection, arg *pepys.Tflush) (*pepys.Rflush, os.Error) {
+	// called while a group is being flushed; nothing here blocks for
+	// long, so it may as well finish
+	return new(pepys.Rflush), nil
+}
+
+// Open name for usr with mode m; with no usr, whatever the permissions say
+func open(name string, usr *user, fi *os.FileInfo, m int) (*ufsFid, os.Error) {
+	want := uint32(0)
+	flags := os.O_RDONLY
+	if m & pepys.Oread != 0 {
+		want |= pepys.Prmread
+	}
+	if m & pepys.Owrite != 0 {
+		want |= pepys.Prmwrite
+		flags = os.O_WRONLY
+		if m & pepys.Oread != 0 {
+			flags = os.O_RDWR
+		}
+	}
+	if m & pepys.Otrunc != 0 {
+		want |= pepys.Prmwrite
+		flags |= os.O_TRUNC
+	}
+	if m & pepys.Oexec == pepys.Oexec {
+		want |= pepys.Prmexec
+	}
+	if fi.IsDirectory() && flags != os.O_RDONLY {
+		return nil, pepys.Eisdir
+	}
+	if usr != nil && !allowed(usr, fi, want) {
+		return nil, pepys.Eperm
+	}
+
+	file, err := os.Open(name, flags, 0)
+	if err != nil {
+		return nil, err
+	}
+	uf := new(ufsFid)
+	uf.file = file
+	uf.mode = m
+	uf.dir = fi.IsDirectory()
+	return uf, nil
+}
+
+func (u *Ufs) Open(conn *server.Connection, arg *pepys.Topen) (*pepys.Ropen, os.Error) {
+	m, err := pepys.ParseMode(arg.Mode)
+	if err != nil {
+		return nil, err
+	}
+	fid := conn.GetFid(arg.Nfid)
+	name := fid.Node.(string)
+	usr := conn.Aux.(*user)
+	fi, err := lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	if m & pepys.Orclose != 0 {
+		if dfi, err := lstat(path.Dir(name)); err != nil || !allowed(usr, dfi, pepys.Prmwrite) {
+			return nil, pepys.Eperm
+		}
+	}
+	if fid.Aux, err = open(name, usr, fi, m); err != nil {
+		return nil, err
+	}
+	if fi, err = lstat(name); err != nil {
+		return nil, err
+	}
+
+	resp := new(pepys.Ropen)
+	resp.Iounit = server.Iounit(conn)
+	resp.Ftype = u.stat(fi).Ftype
+	resp.Version = version(fi)
+	return resp, nil
+}
+
+func (u *Ufs) Create(conn *server.Connection, arg *pepys.Tcreate) (*pepys.Rcreate, os.Error) {
+	d, usr, uf, err := u.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if uf != nil {
+		return nil, pepys.Eisopen
+	}
+	if !server.GoodName(arg.Name) {
+		return nil, pepys.Ename
+	}
+	m, err := pepys.ParseMode(arg.Mode)
+	if err != nil {
+		return nil, err
+	}
+	dfi, err := lstat(d)
+	if err != nil {
+		return nil, err
+	}
+	if !dfi.IsDirectory() {
+		return nil, pepys.Enotdir
+	}
+	if !allowed(usr, dfi, pepys.Prmwrite) {
+		return nil, pepys.Eperm
+	}
+	if arg.Perm & pepys.Pdir != 0 && m & (pepys.Owrite | pepys.Otrunc) != 0 {
+		return nil, pepys.Eisdir
+	}
+
+	// as in 9P, directories restrict the permissions of what they hold
+	name := d + "/" + arg.Name
+	if arg.Perm & pepys.Pdir != 0 {
+		perm := arg.Perm & dfi.Mode & 0777
+		if err = os.Mkdir(name, perm); err != nil {
+			return nil, err
+		}
+	} else {
+		perm := arg.Perm & (^uint32(0666) | dfi.Mode & 0666) & 0777
+		file, err := os.Open(name, os.O_CREAT | os.O_EXCL | os.O_WRONLY, perm)
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+	}
+	if usr.uid != os.Getuid() && os.Getuid() == 0 {
+		if err = os.Chown(name, usr.uid, dfi.Gid); err != nil {
+			// not to leave it to the wrong owner
+			os.Remove(name)
+			return nil, err
+		}
+	}
+
+	// the fid now refers to the new file, open with the given mode; the
+	// creator may use it whatever the permissions say. If it can't be,
+	// the file goes again.
+	fi, err := lstat(name)
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	uf, err := open(name, nil, fi, m)
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	fid := conn.GetFid(arg.Fid)
+	fid.Descend(name, arg.Name)
+	fid.Aux = uf
+
+	resp := new(pepys.Rcreate)
+	resp.Iounit = server.Iounit(conn)
+	resp.Version = version(fi)
+	return resp, nil
+}
+
+func (u *Ufs) Read(conn *server.Connection, arg *pepys.Tread) (*pepys.Rread, os.Error) {
+	_, _, uf, err := u.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if uf == nil || uf.mode & pepys.Oread == 0 {
+		return nil, pepys.Eperm
+	}
+	if arg.Count > server.Iounit(conn) {
+		arg.Count = server.Iounit(conn)
+	}
+
+	resp := new(pepys.Rread)
+	if uf.dir {
+		resp.Dat, err = uf.dr.Read(arg.Offset, arg.Count, func() ([]*pepys.Rstat, os.Error) {
+			return u.dirents(uf)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	buf := make([]byte, arg.Count)
+	n, err := uf.file.ReadAt(buf, int64(arg.Offset))
+	if err != nil && err != os.EOF {
+		return nil, err
+	}
+	resp.Dat = buf[0:n]
+	return resp, nil
+}
+
+// The entries of the directory uf, but for symbolic links
+func (u *Ufs) dirents(uf *ufsFid) ([]*pepys.Rstat, os.Error) {
+	if _, err := uf.file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	fis, err := uf.file.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sts := make([]*pepys.Rstat, 0, len(fis))
+	for i := range fis {
+		if fis[i].IsSymlink() {
+			continue
+		}
+		sts = sts[0:len(sts) + 1]
+		sts[len(sts) - 1] = u.stat(&fis[i])
+	}
+	return sts, nil
+}
+
+func (u *Ufs) Write(conn *server.Connection, arg *pepys.Twrite) (*pepys.Rwrite, os.Error) {
+	_, _, uf, err := u.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if uf == nil || uf.mode & pepys.Owrite == 0 {
+		return nil, pepys.Eperm
+	}
+
+	n, err := uf.file.WriteAt(arg.Dat, int64(arg.Offset))
+	if err != nil {
+		return nil, err
+	}
+	resp := new(pepys.Rwrite)
+	resp.Count = uint32(n)
+	return resp, nil
+}
+
+// Remove name on behalf of usr
+func remove(name string, usr *user) os.Error {
+	dfi, err := lstat(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	if !allowed(usr, dfi, pepys.Prmwrite) {
+		return pepys.Eperm
+	}
+	return os.Remove(name)
+}
+
+func (u *Ufs) Remove(conn *server.Connection, arg *pepys.Tremove) (*pepys.Rremove, os.Error) {
+	name, usr, uf, err := u.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if uf != nil {
+		uf.file.Close()
+	}
+	if fid := conn.GetFid(arg.Fid); fid.Path == "/" {
+		return nil, pepys.Eperm
+	}
+	if err = remove(name, usr); err != nil {
+		return nil, err
+	}
+	return new(pepys.Rremove), nil
+}
+
+func (u *Ufs) Clunk(conn *server.Connection, arg *pepys.Tclunk) (*pepys.Rclunk, os.Error) {
+	name, usr, uf, err := u.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if uf != nil {
+		uf.file.Close()
+		if uf.mode & pepys.Orclose != 0 {
+			if err = remove(name, usr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return new(pepys.Rclunk), nil
+}
+
+func (u *Ufs) Stat(conn *server.Connection, arg *pepys.Tstat) (*pepys.Rstat, os.Error) {
+	name, _, _, err := u.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	st := u.stat(fi)
+	if conn.GetFid(arg.Fid).Path == "/" {
+		st.Name = "/"
+	}
+	return st, nil
+}
+
+func (u *Ufs) Wstat(conn *server.Connection, arg *pepys.Twstat) (*pepys.Rwstat, os.Error) {
+	name, usr, _, err := u.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	fid := conn.GetFid(arg.Fid)
+
+	// check everything first so that the changes are all made or none are
+	owner := usr.uid == fi.Uid
+	newname := ""
+	if arg.Name != "" && arg.Name != fi.Name {
+		if fid.Path == "/" || !server.GoodName(arg.Name) {
+			return nil, pepys.Ename
+		}
+		dfi, err := lstat(path.Dir(name))
+		if err != nil {
+			return nil, err
+		}
+		if !allowed(usr, dfi, pepys.Prmwrite) {
+			return nil, pepys.Eperm
+		}
+		newname = path.Dir(name) + "/" + arg.Name
+		if _, err = os.Lstat(newname); err == nil {
+			return nil, pepys.Eexist
+		}
+	}
+	if arg.Perm != pepys.Noperm {
+		if !owner {
+			return nil, pepys.Enotowner
+		}
+		if arg.Perm & ^uint32(0777) != 0 {
+			return nil, os.NewError("bad permission bits")
+		}
+	}
+	gid := -1
+	if arg.Gid != "" {
+		if !owner {
+			return nil, pepys.Enotowner
+		}
+		id, present := u.gids[arg.Gid]
+		if !present {
+			return nil, os.NewError("unknown group " + arg.Gid)
+		}
+		gid = id
+	}
+	if arg.Length != pepys.Nolength {
+		if fi.IsDirectory() {
+			return nil, pepys.Eisdir
+		}
+		if !allowed(usr, fi, pepys.Prmwrite) {
+			return nil, pepys.Eperm
+		}
+	}
+	if arg.Mtime != pepys.Notime && !owner {
+		return nil, pepys.Enotowner
+	}
+
+	// the local file system may still refuse, there is no undoing then
+	if arg.Length != pepys.Nolength {
+		if err = os.Truncate(name, int64(arg.Length)); err != nil {
+			return nil, err
+		}
+	}
+	if arg.Perm != pepys.Noperm {
+		if err = os.Chmod(name, fi.Mode & ^uint32(0777) | arg.Perm); err != nil {
+			return nil, err
+		}
+	}
+	if gid != -1 {
+		if err = os.Chown(name, -1, gid); err != nil {
+			return nil, err
+		}
+	}
+	if arg.Mtime != pepys.Notime {
+		if err = os.Chtimes(name, fi.Atime_ns, int64(arg.Mtime)); err != nil {
+			return nil, err
+		}
+	}
+	if newname != "" {
+		if err = os.Rename(name, newname); err != nil {
+			return nil, err
+		}
+		fid.Rename(newname, arg.Name)
+	}
+	return new(pepys.Rwstat), nil
+}
+
+func main() {
+	flag.Parse()
+
+	u := new(Ufs)
+	u.root = path.Clean(*root)
+	if fi, err := os.Stat(u.root); err != nil || !fi.IsDirectory() {
+		fmt.Printf("Error: %s is not a directory\n", u.root)
+		os.Exit(1)
+	}
+	if u.root == "/" {
+		u.root = ""
+	}
+	if err := u.loadUsers(*umap); err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	if usr, present := u.users[*nobody]; present && usr.uid == 0 {
+		fmt.Printf("Error: %s is root, remote users may not be\n", *nobody)
+		os.Exit(1)
+	}
+
+	srv, err := server.New(u, "tcp", *addr)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("ufs is exporting %s on %s!\n", *root, *addr)
+
+	// start processing requests
+	srv.Start()
+}
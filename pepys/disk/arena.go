@@ -0,0 +1,254 @@
+package disk
+
+import (
+	"os"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+ * Arena table layout, at Atab:
+ *
+ *	0	uchar[16]	Atabmagic
+ *	16	uint32		Atabversion
+ *	20	uint32		number of arenas
+ *	24	uint32		reserved, 0
+ *	28	uint32		CRC-32 (IEEE) of the header before it
+ *	32	an entry for each arena:
+ *		uint32		state
+ *		uint32		reserved, 0
+ *		uint64		sequence number
+ *		uint64		fill
+ *		uint32		reserved, 0
+ *		uint32		CRC-32 (IEEE) of the entry before it
+ *
+ * Entries are written one at a time, as arenas change state, so
+ * each has its own checksum.
+ *
+ * The log is made of arenas, in the order of their sequence numbers.
+ * An arena is free until the log writer gets it, active while being
+ * written, then sealed.  The cleaner makes sealed arenas free again,
+ * after copying out what is still needed.
+ */
+const Atabmagic = "pepys arena tab\n"
+const Atabversion = 1
+const Atabhdrsize = 32
+const Atabentsize = 32
+
+const (
+	Afree = iota
+	Aactive
+	Asealed
+	Acleaning
+)
+
+var statenames = []string{"free", "active", "sealed", "cleaning"}
+
+var (
+	Ebadatab    = os.NewError("bad arena table")
+	Enoarena    = os.NewError("no free arena")
+	Earenastate = os.NewError("arena in the wrong state")
+)
+
+type Arena struct {
+	State int
+	Seq   uint64 // place in the log, 0 while free
+	Fill  uint64 // bytes written
+}
+
+func (a *Arena) String() string {
+	state := "unknown"
+	if a.State >= 0 && a.State < len(statenames) {
+		state = statenames[a.State]
+	}
+	return fmt.Sprintf("%s seq %d fill %d", state, a.Seq, a.Fill)
+}
+
+// The state of every arena on a disk
+type Atab struct {
+	arenas []Arena
+	seq    uint64 // last sequence number handed out
+	next   int    // where to start looking for a free arena
+}
+
+func (at *Atab) Len() int {
+	return len(at.arenas)
+}
+
+// What is known of arena i
+func (at *Atab) Arena(i int) Arena {
+	return at.arenas[i]
+}
+
+// The arena table in use, once loaded or created
+func (disk *Disk) Atab() *Atab {
+	return disk.atab
+}
+
+// Where arena i starts on disk
+func (s *Super) Arenaaddr(i int) uint64 {
+	return s.Arenas + uint64(i)*s.Asize
+}
+
+func (a *Arena) encode(buf []byte) {
+	for i := range buf[0:Atabentsize] {
+		buf[i] = 0
+	}
+	be.PutUint32(buf[0:], uint32(a.State))
+	be.PutUint64(buf[8:], a.Seq)
+	be.PutUint64(buf[16:], a.Fill)
+	be.PutUint32(buf[28:], crc32.ChecksumIEEE(buf[0:28]))
+}
+
+func (a *Arena) decode(buf []byte) bool {
+	if be.Uint32(buf[28:]) != crc32.ChecksumIEEE(buf[0:28]) {
+		return false
+	}
+	a.State = int(be.Uint32(buf[0:]))
+	a.Seq = be.Uint64(buf[8:])
+	a.Fill = be.Uint64(buf[16:])
+	return a.State >= Afree && a.State <= Acleaning
+}
+
+// Write the entry of arena i
+func (disk *Disk) writeArena(i int) os.Error {
+	buf := make([]byte, Atabentsize)
+	disk.atab.arenas[i].encode(buf)
+	addr := disk.super.Atab + Atabhdrsize + uint64(i)*Atabentsize
+	if _, err := disk.f.WriteAt(buf, int64(addr)); err != nil {
+		return os.NewError(fmt.Sprintf("writearena: %s: write %d: %s", disk.name, addr, err.String()))
+	}
+	return nil
+}
+
+// Write the whole arena table
+func (disk *Disk) StoreAtab() os.Error {
+	at := disk.atab
+	s := disk.super
+	buf := make([]byte, Atabhdrsize+len(at.arenas)*Atabentsize)
+	copy(buf[0:16], Atabmagic)
+	be.PutUint32(buf[16:], Atabversion)
+	be.PutUint32(buf[20:], uint32(len(at.arenas)))
+	be.PutUint32(buf[28:], crc32.ChecksumIEEE(buf[0:28]))
+	for i := range at.arenas {
+		at.arenas[i].encode(buf[Atabhdrsize+i*Atabentsize:])
+	}
+	if _, err := disk.f.WriteAt(buf, int64(s.Atab)); err != nil {
+		return os.NewError(fmt.Sprintf("storeatab: %s: write %d: %s", disk.name, s.Atab, err.String()))
+	}
+	return nil
+}
+
+// Read the arena table. The superblock must have been read first.
+func (disk *Disk) LoadAtab() os.Error {
+	s := disk.super
+	bad := func(why string) os.Error {
+		return os.NewError(fmt.Sprintf("loadatab: %s: %s", disk.name, why))
+	}
+	buf := make([]byte, Atabhdrsize+int(s.Narena)*Atabentsize)
+	if _, err := disk.f.ReadAt(buf, int64(s.Atab)); err != nil {
+		return bad(err.String())
+	}
+	if string(buf[0:16]) != Atabmagic || be.Uint32(buf[16:]) != Atabversion {
+		return bad("not an arena table")
+	}
+	if be.Uint32(buf[28:]) != crc32.ChecksumIEEE(buf[0:28]) {
+		return bad("header checksum mismatch")
+	}
+	if n := be.Uint32(buf[20:]); n != s.Narena {
+		return bad(fmt.Sprintf("%d arenas, the superblock says %d", n, s.Narena))
+	}
+
+	at := new(Atab)
+	at.arenas = make([]Arena, s.Narena)
+	last := -1
+	for i := range at.arenas {
+		a := &at.arenas[i]
+		if !a.decode(buf[Atabhdrsize+i*Atabentsize:]) {
+			disk.log.Logf("loadatab: %s: arena %d: bad entry\n", disk.name, i)
+			return Ebadatab
+		}
+		if a.State != Afree && a.Seq > at.seq {
+			at.seq = a.Seq
+			last = i
+		}
+	}
+	// go on from where the log ends
+	at.next = (last + 1) % len(at.arenas)
+	disk.atab = at
+	disk.startLog()
+	return nil
+}
+
+// A table for a disk just made, with all arenas free
+func (disk *Disk) newAtab() {
+	at := new(Atab)
+	at.arenas = make([]Arena, disk.super.Narena)
+	disk.atab = at
+	disk.startLog()
+}
+
+// Hand out the next free arena for the log. It becomes active, and
+// gets the next sequence number.
+func (disk *Disk) AllocArena() (int, os.Error) {
+	at := disk.atab
+	n := len(at.arenas)
+	for j := 0; j < n; j++ {
+		i := (at.next + j) % n
+		a := &at.arenas[i]
+		if a.State != Afree {
+			continue
+		}
+		a.State = Aactive
+		a.Seq = at.seq + 1
+		a.Fill = 0
+		if err := disk.writeArena(i); err != nil {
+			a.State = Afree
+			a.Seq = 0
+			return -1, err
+		}
+		at.seq++
+		at.next = (i + 1) % n
+		return i, nil
+	}
+	return -1, Enoarena
+}
+
+// Move arena i from state from to state to, recording its fill
+func (disk *Disk) moveArena(i int, from int, to int, fill uint64) os.Error {
+	a := &disk.atab.arenas[i]
+	if a.State != from {
+		return Earenastate
+	}
+	old := *a
+	a.State = to
+	a.Fill = fill
+	if to == Afree {
+		a.Seq = 0
+	}
+	if err := disk.writeArena(i); err != nil {
+		*a = old
+		return err
+	}
+	return nil
+}
+
+// Record how much of the active arena i has been written
+func (disk *Disk) FillArena(i int, fill uint64) os.Error {
+	return disk.moveArena(i, Aactive, Aactive, fill)
+}
+
+// Arena i, which was active, is full
+func (disk *Disk) SealArena(i int, fill uint64) os.Error {
+	return disk.moveArena(i, Aactive, Asealed, fill)
+}
+
+// The sealed arena i is being cleaned
+func (disk *Disk) CleanArena(i int) os.Error {
+	return disk.moveArena(i, Asealed, Acleaning, disk.atab.arenas[i].Fill)
+}
+
+// The arena i has been cleaned, and can be used again
+func (disk *Disk) FreeArena(i int) os.Error {
+	return disk.moveArena(i, Acleaning, Afree, 0)
+}
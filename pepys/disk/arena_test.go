@@ -0,0 +1,101 @@
+package disk
+
+import (
+	"os"
+	"testing"
+)
+
+// Arenas are handed out in turn with growing sequence numbers, change
+// state only as they should, and read back as left
+func TestAtabAlloc(t *testing.T) {
+	defer os.Remove(imageName())
+	dk, err := makeImage(4*M, geometry(0, 512, 256*K, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if dk != nil {
+			dk.Close()
+		}
+	}()
+	n := dk.Atab().Len()
+	if n != int(dk.Super().Narena) {
+		t.Fatalf("%d arenas in the table, %d on disk", n, dk.Super().Narena)
+	}
+	for j := 0; j < n; j++ {
+		i, err := dk.AllocArena()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := dk.Atab().Arena(i)
+		if i != j || a.State != Aactive || a.Seq != uint64(j+1) {
+			t.Fatalf("allocation %d: arena %d, %s", j, i, a.String())
+		}
+		if j < n-1 {
+			if err = dk.SealArena(i, uint64(1000+j)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err = dk.AllocArena(); err != Enoarena {
+		t.Fatalf("allocating with none free: got %v", err)
+	}
+	if err = dk.FreeArena(2); err != Earenastate {
+		t.Fatalf("freeing a sealed arena: got %v", err)
+	}
+	if err = dk.CleanArena(2); err != nil {
+		t.Fatal(err)
+	}
+	if err = dk.FreeArena(2); err != nil {
+		t.Fatal(err)
+	}
+	if err = dk.FillArena(n-1, 77); err != nil {
+		t.Fatal(err)
+	}
+
+	dk.Close()
+	if dk, err = reopen(); err != nil {
+		t.Fatal(err)
+	}
+	at := dk.Atab()
+	for i := 0; i < n; i++ {
+		a := at.Arena(i)
+		var ok bool
+		switch {
+		case i == 2:
+			ok = a.State == Afree && a.Seq == 0
+		case i == n-1:
+			ok = a.State == Aactive && a.Fill == 77 && a.Seq == uint64(n)
+		default:
+			ok = a.State == Asealed && a.Fill == uint64(1000+i) && a.Seq == uint64(i+1)
+		}
+		if !ok {
+			t.Fatalf("arena %d read back as %s", i, a.String())
+		}
+	}
+	i, err := dk.AllocArena()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := at.Arena(i); i != 2 || a.Seq != uint64(n+1) {
+		t.Fatalf("reallocated arena %d, %s", i, a.String())
+	}
+}
+
+// A torn entry in the arena table is noticed
+func TestAtabTorn(t *testing.T) {
+	defer os.Remove(imageName())
+	dk, err := makeImage(4*M, geometry(0, 512, 256*K, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	atab := dk.Super().Atab
+	dk.Close()
+	if err = damage(atab+Atabhdrsize+3*Atabentsize+28, 4); err != nil {
+		t.Fatal(err)
+	}
+	if dk, err = reopen(); err == nil {
+		dk.Close()
+		t.Fatal("torn arena table accepted")
+	}
+}
@@ -0,0 +1,85 @@
+package disk
+
+/*
+ * A counting Bloom filter over the Vids in the index, so that looking
+ * for a Vid that isn't there seldom has to walk the tree.  Each Vid
+ * bumps bloomk counters of 4 bits; taking it out lowers them again.
+ * A counter that reaches 15 stays there, as it can't tell how many
+ * Vids it counts any more.
+ */
+const Bloomsize = 5 // bytes of filter for each Vid the index has room for
+const bloomk = 7    // counters per Vid
+
+type bloom struct {
+	c []byte // two counters per byte, the one in the low bits first
+	m uint64 // number of counters
+}
+
+// A filter sized for max Vids
+func newBloom(max uint64) *bloom {
+	b := new(bloom)
+	if max == 0 {
+		max = 1
+	}
+	b.c = make([]byte, max*Bloomsize)
+	b.m = 2 * uint64(len(b.c))
+	return b
+}
+
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// Two independent hashes of v; the counters of v are h1 + i*h2
+func bloomhash(v *Vid) (uint64, uint64) {
+	h := mix(uint64(v.Server) ^ 0x9e3779b97f4a7c15)
+	h = mix(h ^ uint64(v.File))
+	h1 := mix(h ^ uint64(v.Version))
+	h2 := mix(h1^0x9e3779b97f4a7c15) | 1
+	return h1, h2
+}
+
+func (b *bloom) get(i uint64) byte {
+	return b.c[i/2] >> (4 * (i % 2)) & 0xf
+}
+
+func (b *bloom) set(i uint64, n byte) {
+	s := 4 * (i % 2)
+	b.c[i/2] = b.c[i/2]&^(0xf<<s) | n<<s
+}
+
+func (b *bloom) add(v *Vid) {
+	h1, h2 := bloomhash(v)
+	for i := uint64(0); i < bloomk; i++ {
+		j := (h1 + i*h2) % b.m
+		if n := b.get(j); n < 15 {
+			b.set(j, n+1)
+		}
+	}
+}
+
+func (b *bloom) del(v *Vid) {
+	h1, h2 := bloomhash(v)
+	for i := uint64(0); i < bloomk; i++ {
+		j := (h1 + i*h2) % b.m
+		if n := b.get(j); n > 0 && n < 15 {
+			b.set(j, n-1)
+		}
+	}
+}
+
+// False if v was certainly never added, or taken out since
+func (b *bloom) has(v *Vid) bool {
+	h1, h2 := bloomhash(v)
+	for i := uint64(0); i < bloomk; i++ {
+		if b.get((h1+i*h2)%b.m) == 0 {
+			return false
+		}
+	}
+	return true
+}
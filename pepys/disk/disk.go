@@ -3,25 +3,26 @@ package disk
 import (
 	"os"
 	"fmt"
-	"gob"
-	"time"
 	"log"
+	"time"
+	"hash/crc32"
+	"encoding/binary"
 )
 
 const K = 1 << 10
 const M = 1 << 20
 const G = 1 << 30
 const bbits = 9
-const bsize = 1 << bbits // block size
-const asize = G          // arena size
+const bsize = 1 << bbits // default block size
+const asize = G          // default arena size
 const abits = 30
 
 /*
  *	Sizes in bytes
  */
-const DiskaddrSize = 8 // uint64
-const VidSize = 12
-const IndexelemSize = 32 // Vid+Metaaddr
+const DiskaddrSize = 8   // uint64
+const VidSize = 24       // ServerID+FileID+VersionID
+const IndexelemSize = 40 // Vid+Metaaddr
 
 /*
  * A file system that can store 10 million files needs
@@ -35,13 +36,13 @@ type FileID uint64 // Not to be confused with Fid
 type VersionID int64
 
 type Xid struct {
-	s ServerID
-	f FileID
+	Server ServerID
+	File   FileID
 }
 
 type Vid struct {
 	Xid
-	v VersionID
+	Version VersionID
 }
 
 type Indexelem struct {
@@ -51,41 +52,51 @@ type Indexelem struct {
 	 * starts up; it is written to disk every time
 	 * a Chunk fills up.
 	 * This describes a single entry of the index on disk.
-	 * The in-memory data structure is Treeelem.
+	 * The in-memory data structure is treeelem.
 	 */
-	Vid   int64
-	daddr uint64 /* where to start reading */
-	doff  int    /* where the interesting bit starts */
-	dlen  int    /* disk metadata size — if 0, not on disk */
+	Vid  Vid
+	Addr Metaaddr
 }
 
 type Super struct {
-	magic      string
-	time       int64     /* Time last written/changed */
-	fstcurrent bool      /* true: first or false: second copy was last written */
-	size       uint64    /* size of the disk */
-	vidx       [2]uint64 /* Vid index addresses */
-	vids       uint64    /* Vid index size */
-	atab       uint64    /* Arena tab address */
-	atas       uint64    /* Arena tab size */
-	arenas     uint64    /* first Arena address */
-	asize      uint64    /* Arena size */
-	narena     uint32    /* number of arenas */
-	bsize      int       /* block size */
-	rootvid    Vid       /* vid of root */
+	Time    int64     /* Time last written/changed */
+	Size    uint64    /* size of the disk */
+	Vidx    [2]uint64 /* Vid index addresses */
+	Vids    uint64    /* Vid index size */
+	Atab    uint64    /* Arena tab address */
+	Atas    uint64    /* Arena tab size */
+	Arenas  uint64    /* first Arena address */
+	Asize   uint64    /* Arena size */
+	Narena  uint32    /* number of arenas */
+	Bsize   int       /* block size */
+	Config  uint64    /* size of the config area */
+	Rootvid Vid       /* vid of root */
 
 	/* Dynamic stuff */
-	lastsnap uint64 /* Place of last snapshot */
+	Lastsnap uint64 /* Place of last snapshot: the index has the log up to here */
+
+	/* Not on disk */
+	fstcurrent bool /* true: first or false: second copy was last written */
+}
+
+// What a disk is kept on: an *os.File, or whatever stands in for one
+type File interface {
+	ReadAt(b []byte, off int64) (n int, err os.Error)
+	WriteAt(b []byte, off int64) (n int, err os.Error)
+	Seek(off int64, whence int) (ret int64, err os.Error)
+	Sync() os.Error
+	Close() os.Error
 }
 
 type Disk struct {
 	name  string
-	f     *os.File
+	f     File
 	size  uint64
 	super *Super
+	index *Index
+	atab  *Atab
+	w     *logwriter
 	log   *log.Logger
-	dec   *gob.Decoder
-	enc   *gob.Encoder
 }
 
 type Metaaddr struct {
@@ -101,9 +112,11 @@ type Metaaddr struct {
 	 * The doff field, when non-zero, indicates that
 	 * data is included in the Fileaddr.
 	 */
-	daddr uint64 // where to start reading
-	doff  int32  // where the interesting bit starts
-	dlen  uint16 // disk metadata size — if 0, not on disk
+	Daddr uint64 // where to start reading
+	Doff  int32  // where the interesting bit starts
+	Dlen  uint32 // disk metadata size — if 0, not on disk
+
+	/* Not on disk */
 	maddr uint   // memory address
 	mlen  uint16 // mem metadata size — if 0, not in memory
 }
@@ -168,12 +181,133 @@ type Metaaddr struct {
  * Second copy of Super.
  */
 
-const Configsize = 0      /* Will be 8MB, 0 for initial testing */
-const Supersize = 8 * K   /* Size of the superblock */
-const MinVidxsize = 8 * K /* Minimum allowable index size */
-const MinAtabsize = 8 * K /* Minimum arena table size */
-const MinArenas = 4       /* Minimum number of arenas */
-const MinDisk = Configsize + MinAtabsize + 2*Supersize + 2*MinVidxsize
+const Configsize = 8 * M     /* Default size of the config area */
+const MaxConfigsize = 64 * M /* Largest config area there can be */
+const Supersize = 8 * K      /* Size of the superblock */
+const MinVidxsize = 8 * K    /* Minimum allowable index size */
+const MinAtabsize = 8 * K    /* Minimum arena table size */
+const MinArenas = 4          /* Minimum number of arenas */
+const MinAsize = 64 * K      /* Minimum arena size */
+const MinBsize = 512         /* Minimum block size */
+
+/* Smallest disk, not counting the config area */
+const MinDisk = MinAtabsize + 2*Supersize + 2*MinVidxsize + MinArenas*MinAsize
+
+/*
+ * Superblock layout, padded with zeros to Supersize:
+ *
+ *	0	uchar[16]	Supermagic
+ *	16	uint32		Superversion
+ *	20	uint32		block size
+ *	24	uint64		time
+ *	32	uint64		size
+ *	40	uint64[2]	Vid index addresses
+ *	56	uint64		Vid index size
+ *	64	uint64		Arena tab address
+ *	72	uint64		Arena tab size
+ *	80	uint64		first Arena address
+ *	88	uint64		Arena size
+ *	96	uint32		number of arenas
+ *	100	uint32		config area size
+ *	104	uint64[3]	vid of root (server, file, version)
+ *	128	uint64		Place of last snapshot
+ *	...
+ *	8188	uint32		CRC-32 (IEEE) of everything before it
+ *
+ * The format version changes whenever the layout does.
+ */
+const Supermagic = "pepys superblock"
+const Superversion = 1
+
+var (
+	Ebadmagic   = os.NewError("not a pepys superblock")
+	Ebadversion = os.NewError("unknown superblock version")
+	Ebadcrc     = os.NewError("superblock checksum mismatch")
+)
+
+var be = binary.BigEndian
+
+// Encode s into buf, which must be Supersize bytes long
+func (s *Super) Encode(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+	copy(buf[0:16], Supermagic)
+	be.PutUint32(buf[16:], Superversion)
+	be.PutUint32(buf[20:], uint32(s.Bsize))
+	be.PutUint64(buf[24:], uint64(s.Time))
+	be.PutUint64(buf[32:], s.Size)
+	be.PutUint64(buf[40:], s.Vidx[0])
+	be.PutUint64(buf[48:], s.Vidx[1])
+	be.PutUint64(buf[56:], s.Vids)
+	be.PutUint64(buf[64:], s.Atab)
+	be.PutUint64(buf[72:], s.Atas)
+	be.PutUint64(buf[80:], s.Arenas)
+	be.PutUint64(buf[88:], s.Asize)
+	be.PutUint32(buf[96:], s.Narena)
+	be.PutUint32(buf[100:], uint32(s.Config))
+	be.PutUint64(buf[104:], uint64(s.Rootvid.Server))
+	be.PutUint64(buf[112:], uint64(s.Rootvid.File))
+	be.PutUint64(buf[120:], uint64(s.Rootvid.Version))
+	be.PutUint64(buf[128:], s.Lastsnap)
+	be.PutUint32(buf[Supersize-4:], crc32.ChecksumIEEE(buf[0:Supersize-4]))
+}
+
+// Decode a superblock encoded by Encode. Only the encoding is checked;
+// whether the geometry makes sense is up to IsSane.
+func DecodeSuper(buf []byte) (*Super, os.Error) {
+	if len(buf) < Supersize {
+		return nil, os.NewError(fmt.Sprintf("short superblock (%d bytes)", len(buf)))
+	}
+	if string(buf[0:16]) != Supermagic {
+		return nil, Ebadmagic
+	}
+	if be.Uint32(buf[16:]) != Superversion {
+		return nil, Ebadversion
+	}
+	if be.Uint32(buf[Supersize-4:]) != crc32.ChecksumIEEE(buf[0:Supersize-4]) {
+		return nil, Ebadcrc
+	}
+	s := new(Super)
+	s.Bsize = int(be.Uint32(buf[20:]))
+	s.Time = int64(be.Uint64(buf[24:]))
+	s.Size = be.Uint64(buf[32:])
+	s.Vidx[0] = be.Uint64(buf[40:])
+	s.Vidx[1] = be.Uint64(buf[48:])
+	s.Vids = be.Uint64(buf[56:])
+	s.Atab = be.Uint64(buf[64:])
+	s.Atas = be.Uint64(buf[72:])
+	s.Arenas = be.Uint64(buf[80:])
+	s.Asize = be.Uint64(buf[88:])
+	s.Narena = be.Uint32(buf[96:])
+	s.Config = uint64(be.Uint32(buf[100:]))
+	s.Rootvid.Server = ServerID(be.Uint64(buf[104:]))
+	s.Rootvid.File = FileID(be.Uint64(buf[112:]))
+	s.Rootvid.Version = VersionID(be.Uint64(buf[120:]))
+	s.Lastsnap = be.Uint64(buf[128:])
+	return s, nil
+}
+
+// Where the second copy of the superblock lives on a disk of the given
+// size: in its last Supersize-aligned block
+func lastsuper(size uint64) uint64 {
+	return (size - Supersize) &^ (Supersize - 1)
+}
+
+// Where the two copies of the superblock live: the first right after the
+// config area, the second at the end of the disk
+func (s *Super) Addr() [2]uint64 {
+	return [2]uint64{s.Config, lastsuper(s.Size)}
+}
+
+// How many entries each copy of the Vid index has room for
+func (s *Super) Maxvids() uint64 {
+	return (s.Vids - Indexhdrsize) / (IndexelemSize + Bloomsize)
+}
+
+func roundup(x uint64, n uint64) uint64 {
+	return (x + n - 1) &^ (n - 1)
+}
 
 func overlap(a1 uint64, s1 uint64, a2 uint64, s2 uint64) bool {
 	return a1 < a2 && a1+s1 > a2 || a2 < a1 && a2+s2 > a1 || a1 == a2 && s1 != 0 && s2 != 0
@@ -182,195 +316,342 @@ func overlap(a1 uint64, s1 uint64, a2 uint64, s2 uint64) bool {
 func (s *Super) IsSane() os.Error {
 	// Check the sanity of the superblock
 
-	if s.time < 0 || s.time > time.Nanoseconds() {
-		return os.NewError(fmt.Sprintf("Bad time %d", s.time))
+	// the time only tells the newer copy; Sync moves it on even when
+	// the clock is behind it, so it may well be in the future
+	if s.Time < 0 {
+		return os.NewError(fmt.Sprintf("Bad time %d", s.Time))
+	}
+	if s.Bsize < MinBsize || s.Bsize&(s.Bsize-1) != 0 || s.Bsize > Supersize {
+		return os.NewError(fmt.Sprintf("Bad block size %d", s.Bsize))
 	}
-	if s.vidx[0] < Configsize+Supersize {
-		return os.NewError(fmt.Sprintf("Index overlaps conf/superblock (%#x)", s.vidx[0]))
+	if s.Config%Supersize != 0 || s.Config > MaxConfigsize {
+		return os.NewError(fmt.Sprintf("Bad config area size %d", s.Config))
 	}
-	if s.atab < Configsize+Supersize {
-		return os.NewError(fmt.Sprintf("Arena table overlaps conf/superblock (%#x)", s.atab))
+	if s.Size < s.Config+MinDisk {
+		return os.NewError(fmt.Sprintf("Disk too small %d < %d", s.Size, s.Config+MinDisk))
 	}
-	if s.arenas < Configsize+Supersize {
-		return os.NewError(fmt.Sprintf("Arenas overlap conf/superblock (%#x)", s.arenas))
+	if s.Asize < MinAsize || s.Asize%uint64(s.Bsize) != 0 {
+		return os.NewError(fmt.Sprintf("Bad arena size %d", s.Asize))
 	}
-	if overlap(s.vidx[0], s.vids, s.atab, s.atas) {
-		return os.NewError(fmt.Sprintf("Arena table and Vid Index overlap"))
+	if s.Vids < MinVidxsize {
+		return os.NewError(fmt.Sprintf("Vid Index too small %d < %d", s.Vids, MinVidxsize))
 	}
-	if overlap(s.vidx[0], s.vids, s.arenas, s.asize*uint64(s.narena)) {
-		return os.NewError(fmt.Sprintf("Vid Index and arenas overlap"))
+	if s.Narena < MinArenas {
+		return os.NewError(fmt.Sprintf("Too few arenas %d < %d", s.Narena, MinArenas))
 	}
-	if overlap(s.atab, s.atas, s.arenas, s.asize*uint64(s.narena)) {
-		return os.NewError(fmt.Sprintf("Vid Index and arenas overlap"))
+	b := uint64(s.Bsize)
+	if s.Vidx[0]%b != 0 || s.Vidx[1]%b != 0 || s.Atab%b != 0 || s.Arenas%b != 0 {
+		return os.NewError(fmt.Sprintf("Areas not aligned to blocks"))
 	}
-	if s.arenas+s.asize*uint64(s.narena) > s.size {
+	start := s.Config + Supersize
+	if s.Vidx[0] < start || s.Vidx[1] < start {
+		return os.NewError(fmt.Sprintf("Index overlaps conf/superblock (%#x, %#x)", s.Vidx[0], s.Vidx[1]))
+	}
+	if s.Atab < start {
+		return os.NewError(fmt.Sprintf("Arena table overlaps conf/superblock (%#x)", s.Atab))
+	}
+	if s.Arenas < start {
+		return os.NewError(fmt.Sprintf("Arenas overlap conf/superblock (%#x)", s.Arenas))
+	}
+	if overlap(s.Vidx[0], s.Vids, s.Vidx[1], s.Vids) {
+		return os.NewError(fmt.Sprintf("Vid Index copies overlap"))
+	}
+	for i := 0; i < 2; i++ {
+		if overlap(s.Vidx[i], s.Vids, s.Atab, s.Atas) {
+			return os.NewError(fmt.Sprintf("Arena table and Vid Index overlap"))
+		}
+		if overlap(s.Vidx[i], s.Vids, s.Arenas, s.Asize*uint64(s.Narena)) {
+			return os.NewError(fmt.Sprintf("Vid Index and arenas overlap"))
+		}
+	}
+	if overlap(s.Atab, s.Atas, s.Arenas, s.Asize*uint64(s.Narena)) {
+		return os.NewError(fmt.Sprintf("Arena table and arenas overlap"))
+	}
+	end := lastsuper(s.Size) // nothing may run into the second superblock
+	if s.Arenas+s.Asize*uint64(s.Narena) > end {
 		return os.NewError(fmt.Sprintf("Arenas don't fit"))
 	}
-	if s.atab+s.atas > s.size {
+	if Atabhdrsize+uint64(s.Narena)*Atabentsize > s.Atas {
+		return os.NewError(fmt.Sprintf("Arena table too small for %d arenas", s.Narena))
+	}
+	if s.Atab+s.Atas > end {
 		return os.NewError(fmt.Sprintf("Arena table doesn't fit"))
 	}
-	if s.vidx[0]+s.vids > s.size {
+	if s.Vidx[0]+s.Vids > end || s.Vidx[1]+s.Vids > end {
 		return os.NewError(fmt.Sprintf("Vid Index doesn't fit"))
 	}
 	return nil
 }
 
 func New(name string) (*Disk, os.Error) {
+	f, err := os.Open(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return NewFile(name, f)
+}
+
+// A disk kept on f, which is closed if it won't do
+func NewFile(name string, f File) (*Disk, os.Error) {
 	var err os.Error
 	var size int64
 
 	disk := new(Disk)
 	disk.log = log.New(os.Stderr, nil, name, log.Lok|log.Ltime)
 	disk.name = name
-	if disk.f, err = os.Open(name, os.O_RDWR, 0); err != nil {
-		return nil, err
-	}
+	disk.f = f
 	// Find end of disk
 	if size, err = disk.f.Seek(0, 2); err != nil {
+		disk.f.Close()
 		return nil, err
 	}
 	disk.size = uint64(size)
 	if disk.size < MinDisk {
+		disk.f.Close()
 		err = os.NewError(fmt.Sprintf("readsuper: %s: too small %d < %d", disk.name, disk.size, MinDisk))
 		return nil, err
 	}
-	disk.dec = gob.NewDecoder(disk.f)
-	disk.enc = gob.NewEncoder(disk.f)
 	return disk, nil
 }
 
-func (disk *Disk) ReadSuper() os.Error {
-	disk.log.Logf("readsuper [%d (%#x)] at %d (%#x)\n",
-		disk.size, disk.size, Configsize, Configsize)
-
-	pos, err := disk.f.Seek(Configsize, 0)
-	if pos != Configsize || err != nil {
-		return os.NewError(fmt.Sprintf("readsuper: %s: seek %d: %s, %s", disk.name, disk.size, Configsize, err.String()))
-	}
+func (disk *Disk) Close() os.Error {
+	return disk.f.Close()
+}
 
-	s := make([]*Super, 2)
+// The superblock in use, once read or created
+func (disk *Disk) Super() *Super {
+	return disk.super
+}
 
-	if err = disk.dec.Decode(s[0]); err != nil {
-		return err
+// Decode and check a copy of the superblock read at addr
+func (disk *Disk) checkSuper(buf []byte, addr uint64) (*Super, os.Error) {
+	s, err := DecodeSuper(buf)
+	if err == nil {
+		err = s.IsSane()
 	}
-
-	if err = s[0].IsSane(); err != nil {
-		return err
+	if err == nil && s.Size > disk.size {
+		err = os.NewError(fmt.Sprintf("disk shrank to %d from %d", disk.size, s.Size))
 	}
-	disk.log.Logf("first superblock IsSane\n")
-
-	spos := int64(s[0].size-Supersize) & int64(^(s[0].bsize - 1))
+	if err == nil && s.Addr()[0] != addr && s.Addr()[1] != addr {
+		err = os.NewError(fmt.Sprintf("superblock belongs at %#x or %#x", s.Addr()[0], s.Addr()[1]))
+	}
+	if err != nil {
+		return nil, os.NewError(fmt.Sprintf("readsuper: %s: at %d: %s", disk.name, addr, err.String()))
+	}
+	return s, nil
+}
 
+// Read and check one copy of the superblock
+func (disk *Disk) readSuper(addr uint64) (*Super, os.Error) {
 	disk.log.Logf("readsuper %s[%d (%#x)] at %d (%#x)\n",
-		disk.name, disk.size, disk.size, spos, spos)
+		disk.name, disk.size, disk.size, addr, addr)
 
-	pos, err = disk.f.Seek(spos, 0)
-	if spos != pos || err != nil {
-		return os.NewError(fmt.Sprintf("readsuper: %s: seek %d - %d", disk.name, disk.size, pos))
+	buf := make([]byte, Supersize)
+	if _, err := disk.f.ReadAt(buf, int64(addr)); err != nil {
+		return nil, os.NewError(fmt.Sprintf("readsuper: %s: read %d: %s", disk.name, addr, err.String()))
 	}
+	return disk.checkSuper(buf, addr)
+}
 
-	if err = disk.dec.Decode(s[1]); err != nil {
-		return err
+// Look for the first copy of the superblock when the second one can't
+// tell where it is: it is the first good one after a config area of
+// any size
+func (disk *Disk) findSuper() (*Super, os.Error) {
+	disk.log.Logf("looking for the first superblock\n")
+	buf := make([]byte, Supersize)
+	for addr := uint64(0); addr <= MaxConfigsize && addr+Supersize <= disk.size; addr += Supersize {
+		if _, err := disk.f.ReadAt(buf, int64(addr)); err != nil {
+			return nil, os.NewError(fmt.Sprintf("readsuper: %s: read %d: %s", disk.name, addr, err.String()))
+		}
+		if string(buf[0:len(Supermagic)]) != Supermagic {
+			continue
+		}
+		s, err := disk.checkSuper(buf, addr)
+		if err != nil {
+			disk.log.Logf("%s\n", err.String())
+			continue
+		}
+		if s.Config == addr {
+			return s, nil
+		}
 	}
-	if err = s[1].IsSane(); err != nil {
-		return err
-	}
-	disk.log.Logf("second superblock IsSane\n")
+	return nil, os.NewError(fmt.Sprintf("readsuper: %s: no superblock found", disk.name))
+}
 
-	fstcurrent := s[0].time > s[1].time
-	if fstcurrent {
-		disk.super = s[0]
-		disk.log.Logf("first superblock with time %s\n", s[0].time)
+// Read both copies of the superblock and keep the newer one. A copy that
+// is torn or otherwise bad is passed over as long as the other one is good.
+func (disk *Disk) ReadSuper() os.Error {
+	// the second copy is found from the size of the disk alone,
+	// and it tells how big the config area before the first is
+	var s0 *Super
+	var err0 os.Error
+	s1, err1 := disk.readSuper(lastsuper(disk.size))
+	if err1 == nil {
+		s0, err0 = disk.readSuper(s1.Config)
 	} else {
-		disk.super = s[1]
-		disk.log.Logf("second superblock with time %s\n", s[1].time)
+		disk.log.Logf("%s\n", err1.String())
+		s0, err0 = disk.findSuper()
+		if err0 == nil && lastsuper(s0.Size) != lastsuper(disk.size) {
+			// the disk has grown since it was made
+			s1, err1 = disk.readSuper(s0.Addr()[1])
+		}
+	}
+	if err0 != nil {
+		disk.log.Logf("%s\n", err0.String())
+	} else {
+		disk.log.Logf("first superblock IsSane\n")
+	}
+	if err1 == nil {
+		disk.log.Logf("second superblock IsSane\n")
+	}
+
+	switch {
+	case err0 != nil && err1 != nil:
+		return err0
+	case err1 != nil || err0 == nil && s0.Time > s1.Time:
+		disk.super = s0
+		disk.super.fstcurrent = true
+		disk.log.Logf("first superblock with time %d\n", s0.Time)
+	default:
+		disk.super = s1
+		disk.super.fstcurrent = false
+		disk.log.Logf("second superblock with time %d\n", s1.Time)
 	}
-	disk.super.fstcurrent = fstcurrent
 	return nil
 }
 
+// Write the superblock over the copy that is not current, which then is
 func (disk *Disk) WriteSuper() os.Error {
-	var spos int64
-
+	addr := disk.super.Addr()
+	i := 0
 	if disk.super.fstcurrent {
 		// first is current, write to second:
-		spos = int64(disk.size-Supersize) & int64(^(disk.super.bsize - 1))
-	} else {
-		// second is current, write to first:
-		spos = int64(Configsize)
+		i = 1
 	}
-	pos, err := disk.f.Seek(spos, 0)
-	if pos != spos || err != nil {
-		return os.NewError(fmt.Sprintf("writesuper: %s: seek %d: %s, %s",
-			disk.name, disk.size, spos, err.String()))
-	}
-	if err = disk.enc.Encode(disk.super); err != nil {
-		return err
+	buf := make([]byte, Supersize)
+	disk.super.Encode(buf)
+	if _, err := disk.f.WriteAt(buf, int64(addr[i])); err != nil {
+		return os.NewError(fmt.Sprintf("writesuper: %s: write %d: %s",
+			disk.name, addr[i], err.String()))
 	}
+	disk.super.fstcurrent = i == 0
 	return nil
 }
 
+// The geometry of a disk to be made
+type Geometry struct {
+	Config uint64 // size of the config area
+	Bsize  int    // block size
+	Asize  uint64 // arena size
+	Files  uint64 // files the Vid index must hold; 0 to size it by the disk
+}
 
-func (disk *Disk) CreateSuper() os.Error {
- 	s := new(Super)
-	disk.log.Logf("createsuper %s, %d (0x%x)\n", disk.name, disk.size, disk.size)
-	s.size = disk.size
-	if s.size < MinDisk {
-		return os.NewError(fmt.Sprintf("createsuper: %s: too small %d < %d",
-			disk.name, disk.size, MinDisk))
-	}
-	x := disk.size - Configsize - 2*Supersize
-	n := x / asize
-
-	disk.log.Logf("disk will hold approx. %d arenas\n", n)
-
-	x = asize * n / 20000
-
-	disk.log.Logf("disk will hold up to %d files\n", x)
-
-	s.vidx[0] = Configsize + Supersize
-
-	// Size is #of files*Index size rounded up to nearest MB
-	s.vids = x*IndexelemSize + M - 1&M - 1
+// The geometry used unless told otherwise
+func DefaultGeometry() *Geometry {
+	g := new(Geometry)
+	g.Config = Configsize
+	g.Bsize = bsize
+	g.Asize = asize
+	return g
+}
 
-	disk.log.Logf("Index size 0x%x = %d\n", s.vids, s.vids)
+// Lay out a disk of the given size. The superblock is checked, but not
+// written anywhere.
+func NewSuper(size uint64, g *Geometry) (*Super, os.Error) {
+	s := new(Super)
+	s.Time = time.Nanoseconds()
+	s.Size = size
+	s.Config = g.Config
+	s.Bsize = g.Bsize
+	s.Asize = g.Asize
+	if s.Bsize < MinBsize || s.Bsize&(s.Bsize-1) != 0 || s.Bsize > Supersize {
+		return nil, os.NewError(fmt.Sprintf("Bad block size %d", s.Bsize))
+	}
+	if s.Asize < MinAsize {
+		return nil, os.NewError(fmt.Sprintf("Arena size %d < %d", s.Asize, MinAsize))
+	}
+	if s.Asize%uint64(s.Bsize) != 0 {
+		return nil, os.NewError(fmt.Sprintf("Arena size %d not a multiple of the block size", s.Asize))
+	}
+	if s.Size < s.Config+MinDisk {
+		return nil, os.NewError(fmt.Sprintf("too small %d < %d", s.Size, s.Config+MinDisk))
+	}
+	start := s.Config + Supersize
+	end := lastsuper(s.Size)
+	x := end - start
+	n := x / s.Asize
+
+	files := g.Files
+	if files == 0 {
+		files = s.Asize * n / 20000
+	}
 
-	s.atab = s.vidx[0] + s.vids
-	s.atas = n*K + M - 1&M - 1
+	// Size is #of files*(Index+filter) size, and 1K per arena for the table,
+	// rounded up to the minimum sizes so small disks stay small
+	s.Vids = roundup(Indexhdrsize+files*(IndexelemSize+Bloomsize), MinVidxsize)
+	s.Atas = roundup(n*K, MinAtabsize)
+	if s.Atas == 0 {
+		s.Atas = MinAtabsize
+	}
+	if 2*s.Vids+s.Atas > x {
+		return nil, os.NewError(fmt.Sprintf("Vid Index for %d files doesn't fit", files))
+	}
 
-	disk.log.Logf("Arena tab 0x%x = %d\n", s.atas, s.atas)
+	s.Vidx[0] = start
+	s.Atab = s.Vidx[0] + s.Vids
+	s.Arenas = s.Atab + s.Atas
+	s.Vidx[1] = end - s.Vids
+	s.Narena = uint32((s.Vidx[1] - s.Arenas) / s.Asize)
+	if s.Narena < MinArenas {
+		return nil, os.NewError(fmt.Sprintf("room for %d arenas of %d, need %d", s.Narena, s.Asize, MinArenas))
+	}
+	// the log starts out empty, at the first arena
+	s.Lastsnap = s.Arenas
 
-	s.arenas = s.atab + s.atas
-	x = s.size - s.vids - Supersize - s.arenas
-	s.asize = asize
-	s.narena = uint32(x / asize)
-	s.bsize = bsize
+	if err := s.IsSane(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-	disk.log.Logf("configuring %d arenas of %d KB\n", s.narena, s.asize/K)
+// Lay out the disk and write both copies of its superblock and index,
+// and its arena table
+func (disk *Disk) CreateSuper(g *Geometry) os.Error {
+	disk.log.Logf("createsuper %s, %d (0x%x)\n", disk.name, disk.size, disk.size)
+	s, err := NewSuper(disk.size, g)
+	if err != nil {
+		return os.NewError(fmt.Sprintf("createsuper: %s: %s", disk.name, err.String()))
+	}
+	disk.log.Logf("Index size 0x%x = %d\n", s.Vids, s.Vids)
+	disk.log.Logf("Arena tab 0x%x = %d\n", s.Atas, s.Atas)
+	disk.log.Logf("configuring %d arenas of %d KB\n", s.Narena, s.Asize/K)
 
-	if err := s.IsSane(); err != nil {
+	disk.super = s
+	// write both copies, starting with the second
+	s.fstcurrent = true
+	if err = disk.WriteSuper(); err != nil {
 		return err
 	}
-	disk.super = s
-	return disk.WriteSuper()
+	if err = disk.WriteSuper(); err != nil {
+		return err
+	}
+	// and an empty index, over whatever was there before
+	disk.index = NewIndex(s.Maxvids())
+	if err = disk.StoreIndex(); err != nil {
+		return err
+	}
+	if err = disk.StoreIndex(); err != nil {
+		return err
+	}
+	disk.newAtab()
+	return disk.StoreAtab()
 }
 
 /*
  * Log structure
  *
- *	uchar	type
- *	ushort	length (length == 0: no data)
- *	---------------------------- 512-byte block boundary
- *	[data]	k*512 bytes (k = 0, ... 128)
- *	---------------------------- 512-byte block boundary
- *	metadata, k*512 - 3 bytes (k = 1, ...)
- *	(type, length)
- *	---------------------------- 512-byte block boundary
- *	...
- *
- *	Metadata:
- *		ushort		length
- *		uint64+uint32	Vid
- *		uchar		type (e.g., dir, file, tmp, ...)
- *		uchar		state (e.g., dirty, cached, ...)
+ * The arenas hold the log: records of data, padded to a block, with
+ * the metadata after it, also padded to a block.  The metadata says
+ * what the record is, the Vid and type and state of the file, and
+ * where the rest of the data of the version is.  See log.go.
  */
@@ -0,0 +1,359 @@
+package disk
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden images instead of checking them")
+var tmpdir = flag.String("tmpdir", "/tmp", "directory for scratch images")
+
+// The superblock in super.golden
+func goldenSuper() *Super {
+	s := new(Super)
+	s.Time = 1262304000e9
+	s.Size = 8 * G
+	s.Vidx[0] = Supersize
+	s.Vidx[1] = s.Size - Supersize - M
+	s.Vids = M
+	s.Atab = Supersize + M
+	s.Atas = M
+	s.Arenas = Supersize + 2*M
+	s.Asize = G
+	s.Narena = 6
+	s.Bsize = 512
+	s.Rootvid = Vid{Xid{1, 1}, 1}
+	s.Lastsnap = s.Arenas
+	return s
+}
+
+func readGolden(name string) ([]byte, os.Error) {
+	return ioutil.ReadFile("testdata/" + name)
+}
+
+// Encoding the known superblock gives the golden image
+func TestSuperGolden(t *testing.T) {
+	buf := make([]byte, Supersize)
+	goldenSuper().Encode(buf)
+	if *update {
+		if err := ioutil.WriteFile("testdata/super.golden", buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := readGolden("super.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, want) {
+		for i := range buf {
+			if i >= len(want) || buf[i] != want[i] {
+				t.Fatalf("encoding differs at byte %d", i)
+			}
+		}
+		t.Fatalf("golden image has %d bytes, not %d", len(want), len(buf))
+	}
+}
+
+// Decoding the golden image gives the known superblock, which encodes back
+// to the same bytes
+func TestSuperRoundtrip(t *testing.T) {
+	buf, err := readGolden("super.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := DecodeSuper(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.IsSane(); err != nil {
+		t.Fatal(err)
+	}
+	if want := goldenSuper(); !reflect.DeepEqual(s, want) {
+		t.Fatalf("decoded %+v, want %+v", s, want)
+	}
+	nbuf := make([]byte, Supersize)
+	s.Encode(nbuf)
+	if !bytes.Equal(nbuf, buf) {
+		t.Fatal("encoding the decoded superblock changes it")
+	}
+}
+
+// Damaged images are refused with the right error
+func TestSuperCorrupt(t *testing.T) {
+	buf, err := readGolden("super.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type damage struct {
+		off int
+		err os.Error
+	}
+	damages := []damage{
+		damage{0, Ebadmagic},
+		damage{19, Ebadversion},
+		damage{40, Ebadcrc},
+		damage{4000, Ebadcrc},
+		damage{Supersize - 1, Ebadcrc},
+	}
+	for _, d := range damages {
+		bad := make([]byte, len(buf))
+		copy(bad, buf)
+		bad[d.off] ^= 0x20
+		if _, err := DecodeSuper(bad); err != d.err {
+			t.Fatalf("byte %d damaged: got %v, want %v", d.off, err, d.err)
+		}
+	}
+	if _, err := DecodeSuper(buf[0:100]); err == nil {
+		t.Fatal("short superblock accepted")
+	}
+}
+
+func imageName() string {
+	return *tmpdir + "/pepys-disk.img"
+}
+
+func geometry(config uint64, bsize int, asize uint64, files uint64) *Geometry {
+	g := new(Geometry)
+	g.Config = config
+	g.Bsize = bsize
+	g.Asize = asize
+	g.Files = files
+	return g
+}
+
+// Make a fresh sparse image and a file system on it
+func makeImage(size uint64, g *Geometry) (*Disk, os.Error) {
+	f, err := os.Open(imageName(), os.O_RDWR|os.O_CREAT|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Truncate(int64(size))
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	dk, err := New(imageName())
+	if err != nil {
+		return nil, err
+	}
+	if err = dk.CreateSuper(g); err != nil {
+		dk.Close()
+		return nil, err
+	}
+	return dk, nil
+}
+
+func reopen() (*Disk, os.Error) {
+	dk, err := New(imageName())
+	if err != nil {
+		return nil, err
+	}
+	if err = dk.ReadSuper(); err != nil {
+		dk.Close()
+		return nil, err
+	}
+	if err = dk.LoadIndex(); err != nil {
+		dk.Close()
+		return nil, err
+	}
+	if err = dk.LoadAtab(); err != nil {
+		dk.Close()
+		return nil, err
+	}
+	return dk, nil
+}
+
+// Whether two superblocks would be written the same
+func sameSuper(a *Super, b *Super) bool {
+	abuf := make([]byte, Supersize)
+	bbuf := make([]byte, Supersize)
+	a.Encode(abuf)
+	b.Encode(bbuf)
+	return bytes.Equal(abuf, bbuf)
+}
+
+// Overwrite part of the image, as a crash in the middle of a write would
+func damage(addr uint64, n int) os.Error {
+	f, err := os.Open(imageName(), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteAt(make([]byte, n), int64(addr))
+	return err
+}
+
+// Images of a few megabytes have several arenas and read back as made
+func TestImageSmall(t *testing.T) {
+	type image struct {
+		size uint64
+		g *Geometry
+	}
+	images := []image{
+		image{4 * M, geometry(0, 512, 256*K, 0)},
+		image{3 * M, geometry(64*K, 4096, 128*K, 1000)},
+		image{8 * M, geometry(M, 1024, M, 0)},
+		image{MinDisk + 8*K, geometry(8*K, 512, MinAsize, 1)},
+	}
+	defer os.Remove(imageName())
+	for _, im := range images {
+		dk, err := makeImage(im.size, im.g)
+		if err != nil {
+			t.Fatalf("%d bytes: %s", im.size, err)
+		}
+		made := dk.Super()
+		dk.Close()
+		if made.Narena < MinArenas {
+			t.Fatalf("%d bytes: only %d arenas", im.size, made.Narena)
+		}
+		if made.Asize != im.g.Asize || made.Bsize != im.g.Bsize || made.Config != im.g.Config {
+			t.Fatalf("%d bytes: geometry %+v not kept in %+v", im.size, im.g, made)
+		}
+		if dk, err = reopen(); err != nil {
+			t.Fatalf("%d bytes: %s", im.size, err)
+		}
+		read := dk.Super()
+		dk.Close()
+		if !sameSuper(made, read) {
+			t.Fatalf("%d bytes: made %+v, read %+v", im.size, made, read)
+		}
+	}
+}
+
+// Disks without room for the minimum number of arenas are refused
+func TestImageTooSmall(t *testing.T) {
+	if _, err := NewSuper(MinDisk-1, geometry(0, 512, MinAsize, 0)); err == nil {
+		t.Fatal("disk smaller than MinDisk accepted")
+	}
+	if _, err := NewSuper(4*M, geometry(0, 512, G, 0)); err == nil {
+		t.Fatal("4 MB disk with 1 GB arenas accepted")
+	}
+	if _, err := NewSuper(4*M, geometry(0, 512, 4*K, 0)); err == nil {
+		t.Fatal("arenas smaller than MinAsize accepted")
+	}
+	if _, err := NewSuper(4*M, geometry(0, 100, 256*K, 0)); err == nil {
+		t.Fatal("bad block size accepted")
+	}
+}
+
+// Superblocks are written alternately, and the newer one is read back
+func TestImageAlternate(t *testing.T) {
+	defer os.Remove(imageName())
+	dk, err := makeImage(4*M, geometry(0, 512, 256*K, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dk.Close()
+	for i := uint64(1); i <= 4; i++ {
+		if dk, err = reopen(); err != nil {
+			t.Fatal(err)
+		}
+		s := dk.Super()
+		want := i - 1
+		if i == 1 {
+			// a new disk has its log start at the first arena
+			want = s.Arenas
+		}
+		if s.Lastsnap != want {
+			dk.Close()
+			t.Fatalf("write %d: read last snapshot %d", i, s.Lastsnap)
+		}
+		s.Time++
+		s.Lastsnap = i
+		err = dk.WriteSuper()
+		dk.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A disk last synced while the clock was ahead still mounts, and its
+// superblocks go on in order
+func TestImageClockBehind(t *testing.T) {
+	defer os.Remove(imageName())
+	dk, err := makeImage(4*M, geometry(0, 512, 256*K, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ahead := time.Nanoseconds() + 3600e9
+	dk.Super().Time = ahead
+	err = dk.WriteSuper()
+	dk.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 2; i++ {
+		if dk, err = reopen(); err != nil {
+			t.Fatalf("sync %d: %s", i, err)
+		}
+		err = dk.Sync()
+		dk.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dk, err = reopen(); err != nil {
+		t.Fatal(err)
+	}
+	tm := dk.Super().Time
+	dk.Close()
+	if tm != ahead+2 {
+		t.Fatalf("read superblock time %d, want %d", tm, ahead+2)
+	}
+}
+
+// A torn superblock is passed over for the other copy, whichever it is
+func TestImageTorn(t *testing.T) {
+	defer os.Remove(imageName())
+	for i := 0; i < 2; i++ {
+		dk, err := makeImage(4*M, geometry(64*K, 512, 256*K, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// make the copies differ: creating leaves the first one
+		// current, so the second gets 1 and the first 2
+		s := dk.Super()
+		for j := 1; j <= 2; j++ {
+			s.Time++
+			s.Lastsnap = uint64(j)
+			if err = dk.WriteSuper(); err != nil {
+				dk.Close()
+				t.Fatal(err)
+			}
+		}
+		addr := s.Addr()
+		dk.Close()
+		// the fields past the magic; the rest of the block is zeros
+		if err = damage(addr[i]+16, 100); err != nil {
+			t.Fatal(err)
+		}
+		// with the second copy gone, the first is found by looking
+		if dk, err = reopen(); err != nil {
+			t.Fatalf("copy %d torn: %s", i, err)
+		}
+		s = dk.Super()
+		dk.Close()
+		if want := uint64(1 + i); s.Lastsnap != want {
+			t.Fatalf("copy %d torn: read last snapshot %d, want %d", i, s.Lastsnap, want)
+		}
+	}
+}
+
+func vid(server uint64, file uint64, version int64) Vid {
+	return Vid{Xid{ServerID(server), FileID(file)}, VersionID(version)}
+}
+
+func sameXid(a Xid, b Xid) bool {
+	return a.Server == b.Server && a.File == b.File
+}
+
+func sameVid(a Vid, b Vid) bool {
+	return sameXid(a.Xid, b.Xid) && a.Version == b.Version
+}
@@ -0,0 +1,499 @@
+package disk
+
+import (
+	"os"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+ * Vid index layout, for each of the copies at Vidx[0] and Vidx[1]:
+ *
+ *	0	uchar[16]	Indexmagic
+ *	16	uint32		Indexversion
+ *	20	uint32		CRC-32 (IEEE) of the entries
+ *	24	uint64		generation, one more on every write
+ *	32	uint64		number of entries
+ *	40	uint32		CRC-32 (IEEE) of the filter
+ *	44	uint32		CRC-32 (IEEE) of the header before it
+ *	48	entries, ordered by Vid, each
+ *		uint64[3]	Vid (server, file, version)
+ *		uint64		daddr
+ *		uint32		doff
+ *		uint32		dlen
+ *	48 + Maxvids*IndexelemSize
+ *		uchar[Maxvids*Bloomsize]	counters of the filter
+ *
+ * The good copy with the higher generation is current; the other
+ * one is written next.  A copy whose filter is bad is still good:
+ * the filter is built again from the entries.
+ */
+const Indexmagic = "pepys vid index\n"
+const Indexversion = 2
+const Indexhdrsize = 48
+
+var (
+	Ebadindex  = os.NewError("no good copy of the vid index")
+	Eindexfull = os.NewError("vid index full")
+)
+
+// The Vids on a disk and where they are, ordered by Vid in an AVL tree
+type Index struct {
+	root   *treeelem
+	n      int
+	filter *bloom
+
+	gen uint64 // generation of the copy on disk last read or written
+	cur int    // which copy that is
+}
+
+type treeelem struct {
+	Indexelem
+	left   *treeelem
+	right  *treeelem
+	height int
+}
+
+func cmpxid(a *Xid, b *Xid) int {
+	switch {
+	case a.Server < b.Server:
+		return -1
+	case a.Server > b.Server:
+		return 1
+	case a.File < b.File:
+		return -1
+	case a.File > b.File:
+		return 1
+	}
+	return 0
+}
+
+func cmpvid(a *Vid, b *Vid) int {
+	if c := cmpxid(&a.Xid, &b.Xid); c != 0 {
+		return c
+	}
+	switch {
+	case a.Version < b.Version:
+		return -1
+	case a.Version > b.Version:
+		return 1
+	}
+	return 0
+}
+
+func height(t *treeelem) int {
+	if t == nil {
+		return 0
+	}
+	return t.height
+}
+
+func (t *treeelem) fix() {
+	h := height(t.left)
+	if r := height(t.right); r > h {
+		h = r
+	}
+	t.height = h + 1
+}
+
+func rotright(t *treeelem) *treeelem {
+	l := t.left
+	t.left = l.right
+	l.right = t
+	t.fix()
+	l.fix()
+	return l
+}
+
+func rotleft(t *treeelem) *treeelem {
+	r := t.right
+	t.right = r.left
+	r.left = t
+	t.fix()
+	r.fix()
+	return r
+}
+
+// Rebalance t after one of its subtrees changed height by one
+func balance(t *treeelem) *treeelem {
+	t.fix()
+	switch b := height(t.left) - height(t.right); {
+	case b > 1:
+		if height(t.left.left) < height(t.left.right) {
+			t.left = rotleft(t.left)
+		}
+		return rotright(t)
+	case b < -1:
+		if height(t.right.right) < height(t.right.left) {
+			t.right = rotright(t.right)
+		}
+		return rotleft(t)
+	}
+	return t
+}
+
+func insert(t *treeelem, e *treeelem, added *bool) *treeelem {
+	if t == nil {
+		*added = true
+		return e
+	}
+	switch c := cmpvid(&e.Vid, &t.Vid); {
+	case c < 0:
+		t.left = insert(t.left, e, added)
+	case c > 0:
+		t.right = insert(t.right, e, added)
+	default:
+		t.Addr = e.Addr
+		return t
+	}
+	return balance(t)
+}
+
+func removemin(t *treeelem) *treeelem {
+	if t.left == nil {
+		return t.right
+	}
+	t.left = removemin(t.left)
+	return balance(t)
+}
+
+func remove(t *treeelem, vid *Vid, removed *bool) *treeelem {
+	if t == nil {
+		return nil
+	}
+	switch c := cmpvid(vid, &t.Vid); {
+	case c < 0:
+		t.left = remove(t.left, vid, removed)
+	case c > 0:
+		t.right = remove(t.right, vid, removed)
+	default:
+		*removed = true
+		if t.left == nil {
+			return t.right
+		}
+		if t.right == nil {
+			return t.left
+		}
+		// the smallest element on the right takes t's place
+		m := t.right
+		for m.left != nil {
+			m = m.left
+		}
+		r := removemin(t.right)
+		m.left = t.left
+		m.right = r
+		t = m
+	}
+	return balance(t)
+}
+
+// A balanced tree of elements already in order
+func build(es []treeelem) *treeelem {
+	if len(es) == 0 {
+		return nil
+	}
+	m := len(es) / 2
+	t := &es[m]
+	t.left = build(es[0:m])
+	t.right = build(es[m+1:])
+	t.fix()
+	return t
+}
+
+// An empty index, with a filter sized for max Vids
+func NewIndex(max uint64) *Index {
+	x := new(Index)
+	x.filter = newBloom(max)
+	return x
+}
+
+// How many Vids are in the index
+func (x *Index) Len() int {
+	return x.n
+}
+
+// Add vid at addr, or move it there if it is in already
+func (x *Index) Insert(vid Vid, addr Metaaddr) {
+	e := new(treeelem)
+	e.Vid = vid
+	e.Addr = addr
+	e.height = 1
+	added := false
+	x.root = insert(x.root, e, &added)
+	if added {
+		x.n++
+		x.filter.add(&vid)
+	}
+}
+
+// Where vid is, if it is in the index
+func (x *Index) Lookup(vid Vid) (Metaaddr, bool) {
+	if !x.filter.has(&vid) {
+		return Metaaddr{}, false
+	}
+	t := x.root
+	for t != nil {
+		switch c := cmpvid(&vid, &t.Vid); {
+		case c < 0:
+			t = t.left
+		case c > 0:
+			t = t.right
+		default:
+			return t.Addr, true
+		}
+	}
+	return Metaaddr{}, false
+}
+
+// False if vid is certainly not in the index, found without walking the
+// tree; true if it may be
+func (x *Index) MayHave(vid Vid) bool {
+	return x.filter.has(&vid)
+}
+
+// Take vid out of the index, saying whether it was in
+func (x *Index) Delete(vid Vid) bool {
+	removed := false
+	x.root = remove(x.root, &vid, &removed)
+	if removed {
+		x.n--
+		x.filter.del(&vid)
+	}
+	return removed
+}
+
+func (t *treeelem) walk(fn func(e *Indexelem) bool) bool {
+	if t == nil {
+		return true
+	}
+	return t.left.walk(fn) && fn(&t.Indexelem) && t.right.walk(fn)
+}
+
+// Call fn on every element in order, until it returns false
+func (x *Index) Walk(fn func(e *Indexelem) bool) {
+	x.root.walk(fn)
+}
+
+func (t *treeelem) rangexid(xid *Xid, fn func(e *Indexelem) bool) bool {
+	if t == nil {
+		return true
+	}
+	c := cmpxid(&t.Vid.Xid, xid)
+	if c >= 0 && !t.left.rangexid(xid, fn) {
+		return false
+	}
+	if c == 0 && !fn(&t.Indexelem) {
+		return false
+	}
+	if c <= 0 {
+		return t.right.rangexid(xid, fn)
+	}
+	return true
+}
+
+// Call fn on the versions of xid, oldest first, until it returns false
+func (x *Index) Range(xid Xid, fn func(e *Indexelem) bool) {
+	x.root.rangexid(&xid, fn)
+}
+
+func (t *treeelem) check(lo *Vid, hi *Vid) (int, os.Error) {
+	if t == nil {
+		return 0, nil
+	}
+	if lo != nil && cmpvid(lo, &t.Vid) >= 0 || hi != nil && cmpvid(&t.Vid, hi) >= 0 {
+		return 0, os.NewError(fmt.Sprintf("%v out of order", t.Vid))
+	}
+	nl, err := t.left.check(lo, &t.Vid)
+	if err != nil {
+		return 0, err
+	}
+	nr, err := t.right.check(&t.Vid, hi)
+	if err != nil {
+		return 0, err
+	}
+	b := height(t.left) - height(t.right)
+	if b < -1 || b > 1 {
+		return 0, os.NewError(fmt.Sprintf("%v out of balance (%d)", t.Vid, b))
+	}
+	h := t.height
+	t.fix()
+	if t.height != h {
+		return 0, os.NewError(fmt.Sprintf("%v has height %d, not %d", t.Vid, h, t.height))
+	}
+	return nl + nr + 1, nil
+}
+
+// Check that the tree is ordered, balanced and as big as it says
+func (x *Index) IsSane() os.Error {
+	n, err := x.root.check(nil, nil)
+	if err != nil {
+		return err
+	}
+	if n != x.n {
+		return os.NewError(fmt.Sprintf("%d elements, not %d", n, x.n))
+	}
+	err = nil
+	x.Walk(func(e *Indexelem) bool {
+		if !x.filter.has(&e.Vid) {
+			err = os.NewError(fmt.Sprintf("%v missing from the filter", e.Vid))
+		}
+		return err == nil
+	})
+	return err
+}
+
+func (e *Indexelem) encode(buf []byte) {
+	be.PutUint64(buf[0:], uint64(e.Vid.Server))
+	be.PutUint64(buf[8:], uint64(e.Vid.File))
+	be.PutUint64(buf[16:], uint64(e.Vid.Version))
+	be.PutUint64(buf[24:], e.Addr.Daddr)
+	be.PutUint32(buf[32:], uint32(e.Addr.Doff))
+	be.PutUint32(buf[36:], e.Addr.Dlen)
+}
+
+func (e *Indexelem) decode(buf []byte) {
+	e.Vid.Server = ServerID(be.Uint64(buf[0:]))
+	e.Vid.File = FileID(be.Uint64(buf[8:]))
+	e.Vid.Version = VersionID(be.Uint64(buf[16:]))
+	e.Addr.Daddr = be.Uint64(buf[24:])
+	e.Addr.Doff = int32(be.Uint32(buf[32:]))
+	e.Addr.Dlen = be.Uint32(buf[36:])
+}
+
+// The index in use, once loaded or created
+func (disk *Disk) Index() *Index {
+	return disk.index
+}
+
+// Read and check copy i of the index
+func (disk *Disk) readIndex(i int) (*Index, os.Error) {
+	s := disk.super
+	addr := s.Vidx[i]
+	bad := func(why string) os.Error {
+		return os.NewError(fmt.Sprintf("readindex: %s: copy %d at %d: %s", disk.name, i, addr, why))
+	}
+
+	hdr := make([]byte, Indexhdrsize)
+	if _, err := disk.f.ReadAt(hdr, int64(addr)); err != nil {
+		return nil, bad(err.String())
+	}
+	if string(hdr[0:16]) != Indexmagic {
+		return nil, bad("bad magic")
+	}
+	if be.Uint32(hdr[16:]) != Indexversion {
+		return nil, bad("unknown version")
+	}
+	if be.Uint32(hdr[44:]) != crc32.ChecksumIEEE(hdr[0:44]) {
+		return nil, bad("header checksum mismatch")
+	}
+	n := be.Uint64(hdr[32:])
+	if n > s.Maxvids() {
+		return nil, bad(fmt.Sprintf("%d entries, room for %d", n, s.Maxvids()))
+	}
+	buf := make([]byte, int(n)*IndexelemSize)
+	if _, err := disk.f.ReadAt(buf, int64(addr+Indexhdrsize)); err != nil {
+		return nil, bad(err.String())
+	}
+	if be.Uint32(hdr[20:]) != crc32.ChecksumIEEE(buf) {
+		return nil, bad("checksum mismatch")
+	}
+
+	es := make([]treeelem, n)
+	for j := range es {
+		es[j].decode(buf[j*IndexelemSize:])
+		if j > 0 && cmpvid(&es[j-1].Vid, &es[j].Vid) >= 0 {
+			return nil, bad(fmt.Sprintf("entry %d out of order", j))
+		}
+	}
+	x := new(Index)
+	x.root = build(es)
+	x.n = len(es)
+	x.gen = be.Uint64(hdr[24:])
+	x.cur = i
+
+	x.filter = newBloom(s.Maxvids())
+	faddr := addr + Indexhdrsize + s.Maxvids()*IndexelemSize
+	_, err := disk.f.ReadAt(x.filter.c, int64(faddr))
+	if err != nil || be.Uint32(hdr[40:]) != crc32.ChecksumIEEE(x.filter.c) {
+		disk.log.Logf("readindex: %s: copy %d: bad filter, building it again\n", disk.name, i)
+		x.filter = newBloom(s.Maxvids())
+		for j := range es {
+			x.filter.add(&es[j].Vid)
+		}
+	}
+	return x, nil
+}
+
+// Read both copies of the index and keep the newer good one. The
+// superblock must have been read first.
+func (disk *Disk) LoadIndex() os.Error {
+	x0, err0 := disk.readIndex(0)
+	if err0 != nil {
+		disk.log.Logf("%s\n", err0.String())
+	}
+	x1, err1 := disk.readIndex(1)
+	if err1 != nil {
+		disk.log.Logf("%s\n", err1.String())
+	}
+
+	switch {
+	case err0 != nil && err1 != nil:
+		return Ebadindex
+	case err1 != nil || err0 == nil && x0.gen > x1.gen:
+		disk.index = x0
+	default:
+		disk.index = x1
+	}
+	disk.log.Logf("index copy %d, generation %d, %d entries\n",
+		disk.index.cur, disk.index.gen, disk.index.n)
+	return nil
+}
+
+// Write the index over the copy that is not current, which then is
+func (disk *Disk) StoreIndex() os.Error {
+	x := disk.index
+	s := disk.super
+	if uint64(x.n) > s.Maxvids() {
+		return Eindexfull
+	}
+	if uint64(len(x.filter.c)) != s.Maxvids()*Bloomsize {
+		// made for some other disk; build one that fits
+		x.filter = newBloom(s.Maxvids())
+		x.Walk(func(e *Indexelem) bool {
+			x.filter.add(&e.Vid)
+			return true
+		})
+	}
+	i := x.cur ^ 1
+	buf := make([]byte, Indexhdrsize+x.n*IndexelemSize)
+	p := buf[Indexhdrsize:]
+	x.Walk(func(e *Indexelem) bool {
+		e.encode(p)
+		p = p[IndexelemSize:]
+		return true
+	})
+
+	hdr := buf[0:Indexhdrsize]
+	copy(hdr[0:16], Indexmagic)
+	be.PutUint32(hdr[16:], Indexversion)
+	be.PutUint32(hdr[20:], crc32.ChecksumIEEE(buf[Indexhdrsize:]))
+	be.PutUint64(hdr[24:], x.gen+1)
+	be.PutUint64(hdr[32:], uint64(x.n))
+	be.PutUint32(hdr[40:], crc32.ChecksumIEEE(x.filter.c))
+	be.PutUint32(hdr[44:], crc32.ChecksumIEEE(hdr[0:44]))
+
+	// the filter goes first, then entries and header in one write;
+	// a torn write fails a checksum
+	faddr := s.Vidx[i] + Indexhdrsize + s.Maxvids()*IndexelemSize
+	if _, err := disk.f.WriteAt(x.filter.c, int64(faddr)); err != nil {
+		return os.NewError(fmt.Sprintf("storeindex: %s: write %d: %s",
+			disk.name, faddr, err.String()))
+	}
+	if _, err := disk.f.WriteAt(buf, int64(s.Vidx[i])); err != nil {
+		return os.NewError(fmt.Sprintf("storeindex: %s: write %d: %s",
+			disk.name, s.Vidx[i], err.String()))
+	}
+	x.gen++
+	x.cur = i
+	return nil
+}
@@ -0,0 +1,321 @@
+package disk
+
+import (
+	"os"
+	"rand"
+	"testing"
+)
+
+// A made up address for v, so lookups can tell they got the right one
+func addrOf(v Vid) Metaaddr {
+	var a Metaaddr
+	a.Daddr = uint64(v.Server)<<40 ^ uint64(v.File)<<20 ^ uint64(v.Version)
+	a.Doff = int32(v.File % 512)
+	a.Dlen = uint32(v.Version%4096) + 1
+	return a
+}
+
+func randomVid(r *rand.Rand) Vid {
+	return vid(uint64(r.Intn(4)), uint64(r.Intn(1000)), r.Int63n(100))
+}
+
+// A key for the Vids randomVid makes
+func key(v Vid) int64 {
+	return (int64(v.Server)*1000+int64(v.File))*100 + int64(v.Version)
+}
+
+func sameAddr(a Metaaddr, b Metaaddr) bool {
+	return a.Daddr == b.Daddr && a.Doff == b.Doff && a.Dlen == b.Dlen
+}
+
+// The elements of x, in order
+func elems(x *Index) []Indexelem {
+	es := make([]Indexelem, x.Len())
+	i := 0
+	x.Walk(func(e *Indexelem) bool {
+		if i < len(es) {
+			es[i] = *e
+		}
+		i++
+		return true
+	})
+	return es[0:i]
+}
+
+// Random inserts and deletes keep the tree balanced and agree with a map
+func TestIndexTree(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	x := NewIndex(20000)
+	in := make(map[int64]bool)
+	for i := 0; i < 20000; i++ {
+		v := randomVid(r)
+		if r.Intn(3) == 0 {
+			if x.Delete(v) != in[key(v)] {
+				t.Fatalf("delete %v: wrong answer", v)
+			}
+			in[key(v)] = false, false
+		} else {
+			x.Insert(v, addrOf(v))
+			in[key(v)] = true
+		}
+		if i%1000 == 0 {
+			if err := x.IsSane(); err != nil {
+				t.Fatalf("after %d changes: %s", i, err)
+			}
+		}
+	}
+	if err := x.IsSane(); err != nil {
+		t.Fatal(err)
+	}
+	if x.Len() != len(in) {
+		t.Fatalf("%d elements, the map has %d", x.Len(), len(in))
+	}
+	for i := 0; i < 20000; i++ {
+		v := randomVid(r)
+		a, ok := x.Lookup(v)
+		if ok != in[key(v)] || ok && !sameAddr(a, addrOf(v)) {
+			t.Fatalf("lookup %v: got %v %v", v, a, ok)
+		}
+	}
+}
+
+// The versions of one Xid come out in order, and only those
+func TestIndexRange(t *testing.T) {
+	x := NewIndex(3 * 50 * 9)
+	for s := uint64(0); s < 3; s++ {
+		for f := uint64(0); f < 50; f++ {
+			for v := int64(-5); v < 20; v += 3 {
+				x.Insert(vid(s, f, v), addrOf(vid(s, f, v)))
+			}
+		}
+	}
+	xid := Xid{1, 17}
+	last := vid(1, 17, -100)
+	n := 0
+	x.Range(xid, func(e *Indexelem) bool {
+		if !sameXid(e.Vid.Xid, xid) || e.Vid.Version <= last.Version {
+			n = -1000
+			return false
+		}
+		last = e.Vid
+		n++
+		return true
+	})
+	if n != 9 {
+		t.Fatalf("got %d versions, want 9", n)
+	}
+	n = 0
+	x.Range(xid, func(e *Indexelem) bool {
+		n++
+		return n < 4
+	})
+	if n != 4 {
+		t.Fatalf("range went on for %d versions after being stopped", n-4)
+	}
+	x.Range(Xid{5, 0}, func(e *Indexelem) bool {
+		n = -1
+		return true
+	})
+	if n == -1 {
+		t.Fatal("range of a missing xid found something")
+	}
+}
+
+func sameElems(a []Indexelem, b []Indexelem) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameVid(a[i].Vid, b[i].Vid) || !sameAddr(a[i].Addr, b[i].Addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// The index reads back as stored, from the older copy if the newer is torn
+func TestIndexStore(t *testing.T) {
+	defer os.Remove(imageName())
+	dk, err := makeImage(4*M, geometry(0, 512, 256*K, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(2))
+	x := dk.Index()
+	for x.Len() < 500 {
+		v := randomVid(r)
+		x.Insert(v, addrOf(v))
+	}
+	stored := elems(x)
+	err = dk.StoreIndex()
+	dk.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dk, err = reopen(); err != nil {
+		t.Fatal(err)
+	}
+	x = dk.Index()
+	if err = x.IsSane(); err != nil {
+		dk.Close()
+		t.Fatal(err)
+	}
+	if !sameElems(elems(x), stored) {
+		dk.Close()
+		t.Fatal("index read back differs")
+	}
+
+	// a newer copy, torn on the way to the disk
+	for x.Len() < 800 {
+		v := randomVid(r)
+		x.Insert(v, addrOf(v))
+	}
+	if err = dk.StoreIndex(); err != nil {
+		dk.Close()
+		t.Fatal(err)
+	}
+	vidx := dk.Super().Vidx
+	dk.Close()
+	// making the disk wrote the second copy and then the first, so
+	// the first store went to the second and this one to the first
+	if err = damage(vidx[0]+Indexhdrsize+200*IndexelemSize, 10); err != nil {
+		t.Fatal(err)
+	}
+	if dk, err = reopen(); err != nil {
+		t.Fatal(err)
+	}
+	x = dk.Index()
+	if !sameElems(elems(x), stored) {
+		dk.Close()
+		t.Fatal("older index not used in place of a torn one")
+	}
+
+	// more than there is room for
+	for uint64(x.Len()) <= dk.Super().Maxvids() {
+		v := vid(9, uint64(x.Len()), 0)
+		x.Insert(v, addrOf(v))
+	}
+	err = dk.StoreIndex()
+	dk.Close()
+	if err != Eindexfull {
+		t.Fatalf("storing a full index: got %v", err)
+	}
+}
+
+// The filter lets through every Vid in the index and few others, and
+// a copy with a torn filter still loads
+func TestIndexFilter(t *testing.T) {
+	const n = 10000
+	x := NewIndex(n)
+	for i := 0; i < n; i++ {
+		x.Insert(vid(1, uint64(i), 0), addrOf(vid(1, uint64(i), 0)))
+	}
+	fp := 0
+	for i := 0; i < n; i++ {
+		if !x.MayHave(vid(1, uint64(i), 0)) {
+			t.Fatalf("%v in the index but not the filter", vid(1, uint64(i), 0))
+		}
+		if x.MayHave(vid(1, uint64(i), 1)) {
+			fp++
+		}
+	}
+	if fp > n/50 {
+		t.Fatalf("%d of %d absent Vids pass the filter", fp, n)
+	}
+	for i := 0; i < n; i += 2 {
+		x.Delete(vid(1, uint64(i), 0))
+	}
+	fp = 0
+	for i := 0; i < n; i += 2 {
+		if x.MayHave(vid(1, uint64(i), 0)) {
+			fp++
+		}
+	}
+	if fp > n/50 {
+		t.Fatalf("%d of %d deleted Vids still pass the filter", fp, n/2)
+	}
+	if err := x.IsSane(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(imageName())
+	dk, err := makeImage(4*M, geometry(0, 512, 256*K, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	x = dk.Index()
+	for i := 0; i < 500; i++ {
+		x.Insert(vid(2, uint64(i), 3), addrOf(vid(2, uint64(i), 3)))
+	}
+	err = dk.StoreIndex()
+	s := dk.Super()
+	dk.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the store went to the second copy, see indexStore
+	if err = damage(s.Vidx[1]+Indexhdrsize+s.Maxvids()*IndexelemSize+100, 10); err != nil {
+		t.Fatal(err)
+	}
+	if dk, err = reopen(); err != nil {
+		t.Fatal(err)
+	}
+	x = dk.Index()
+	dk.Close()
+	if x.Len() != 500 {
+		t.Fatalf("copy with a torn filter not used: %d entries", x.Len())
+	}
+	if err = x.IsSane(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Entries in the index the benchmarks look up in
+const benchEntries = 10000000
+
+var benchIndex *Index
+
+func benchVid(i int) Vid {
+	return vid(uint64(i%7), uint64(i), int64(i%5))
+}
+
+// The index of benchEntries Vids, made once for all the benchmarks
+func bigIndex(b *testing.B) *Index {
+	b.StopTimer()
+	defer b.StartTimer()
+	if benchIndex == nil {
+		x := NewIndex(benchEntries)
+		for i := 0; i < benchEntries; i++ {
+			v := benchVid(i)
+			x.Insert(v, addrOf(v))
+		}
+		benchIndex = x
+	}
+	return benchIndex
+}
+
+// Looking up a Vid that is in the index
+func BenchmarkIndexLookupPresent(b *testing.B) {
+	x := bigIndex(b)
+	r := rand.New(rand.NewSource(3))
+	for j := 0; j < b.N; j++ {
+		if _, ok := x.Lookup(benchVid(r.Intn(benchEntries))); !ok {
+			panic("a Vid in the index not found")
+		}
+	}
+}
+
+// Looking up a Vid that is not in the index, but has others of its
+// file next to it; most never get past the filter
+func BenchmarkIndexLookupAbsent(b *testing.B) {
+	x := bigIndex(b)
+	r := rand.New(rand.NewSource(3))
+	for j := 0; j < b.N; j++ {
+		v := benchVid(r.Intn(benchEntries))
+		v.Version += 5
+		if _, ok := x.Lookup(v); ok {
+			panic("a Vid not in the index found")
+		}
+	}
+}
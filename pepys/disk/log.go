@@ -0,0 +1,490 @@
+package disk
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"hash/crc32"
+)
+
+/*
+ * Log records, in the arenas, each starting at a block boundary:
+ *
+ *	[data]		padded to a block; none for versions without data
+ *	metadata	padded to a block:
+ *	0	uint32		Logmagic
+ *	4	uchar		kind: Lchunk or Lversion
+ *	5	uchar		type (e.g., dir, file, tmp, ...)
+ *	6	uchar		state (e.g., dirty, cached, ...)
+ *	7	uchar		reserved, 0
+ *	8	uint64		sequence number of the arena
+ *	16	uint64		address of the record, where the data starts
+ *	24	uint32		offset of the metadata in the record
+ *	28	uint32		length of the data
+ *	32	uint32		CRC-32 (IEEE) of the data
+ *	36	uint32		length of the metadata
+ *	40	uint64[3]	Vid (server, file, version)
+ *	64	uint64		time
+ *	72	uint64		length of the version
+ *	80	uint32		number of extents
+ *	84	uint32		length of aux
+ *	88	uint32		reserved, 0
+ *	92	uint32		CRC-32 (IEEE) of the metadata, with this as 0
+ *	96	extents, each
+ *		uint64		address of the data
+ *		uint32		length
+ *		uint32		CRC-32 (IEEE) of the data
+ *	...	aux
+ *
+ * A version with more data than fits in a chunk has all but its last
+ * chunk written first, in Lchunk records of their own; the Lversion
+ * record has the last chunk as its data, and the others as extents.
+ * Only Lversion records go in the index, with a Metaaddr that reads
+ * the record, data and metadata, in one go.
+ */
+const Logmagic = 0x7065706c // "pepl"
+const Lmetahdrsize = 96
+const Lextsize = 16
+const Maxchunk = 128 // blocks of data in a record
+
+const (
+	Lchunk = 1 + iota
+	Lversion
+)
+
+const (
+	Mfile = iota
+	Mdir
+	Mtmp
+)
+
+const (
+	Mclean = iota
+	Mdirty
+	Mcached
+)
+
+var (
+	Etoobig   = os.NewError("record bigger than an arena")
+	Enotfound = os.NewError("vid not found")
+	Ebadrec   = os.NewError("bad log record")
+)
+
+// What the log keeps of a version of a file, besides its data
+type Meta struct {
+	Vid    Vid
+	Type   int
+	State  int
+	Time   int64
+	Length uint64 // of the data
+	Aux    []byte // kept for whoever wrote it, e.g. names and permissions
+
+	ext []extent // where the data is, but for the last chunk
+}
+
+type extent struct {
+	daddr uint64
+	len   uint32
+	crc   uint32
+}
+
+// The parts of a record that say where it is and what it holds
+type lrec struct {
+	kind  int
+	seq   uint64
+	daddr uint64
+	doff  uint32
+	dlen  uint32
+	dcrc  uint32
+	mlen  uint32
+}
+
+// Where the log writer is
+type logwriter struct {
+	arena int    // the active arena, -1 if none yet
+	off   uint64 // where the next record goes in it
+}
+
+// Pick up the log where the arena table says it is: at the end of the
+// active arena with the highest sequence number
+func (disk *Disk) startLog() {
+	w := new(logwriter)
+	w.arena = -1
+	var seq uint64
+	for i, a := range disk.atab.arenas {
+		if a.State == Aactive && a.Seq > seq {
+			seq = a.Seq
+			w.arena = i
+			w.off = a.Fill
+		}
+	}
+	disk.w = w
+}
+
+func (m *Meta) encode(r *lrec, buf []byte) {
+	be.PutUint32(buf[0:], Logmagic)
+	buf[4] = byte(r.kind)
+	buf[5] = byte(m.Type)
+	buf[6] = byte(m.State)
+	be.PutUint64(buf[8:], r.seq)
+	be.PutUint64(buf[16:], r.daddr)
+	be.PutUint32(buf[24:], r.doff)
+	be.PutUint32(buf[28:], r.dlen)
+	be.PutUint32(buf[32:], r.dcrc)
+	be.PutUint32(buf[36:], r.mlen)
+	be.PutUint64(buf[40:], uint64(m.Vid.Server))
+	be.PutUint64(buf[48:], uint64(m.Vid.File))
+	be.PutUint64(buf[56:], uint64(m.Vid.Version))
+	be.PutUint64(buf[64:], uint64(m.Time))
+	be.PutUint64(buf[72:], m.Length)
+	be.PutUint32(buf[80:], uint32(len(m.ext)))
+	be.PutUint32(buf[84:], uint32(len(m.Aux)))
+	p := buf[Lmetahdrsize:]
+	for _, e := range m.ext {
+		be.PutUint64(p[0:], e.daddr)
+		be.PutUint32(p[8:], e.len)
+		be.PutUint32(p[12:], e.crc)
+		p = p[Lextsize:]
+	}
+	copy(p, m.Aux)
+	be.PutUint32(buf[92:], crc32.ChecksumIEEE(buf[0:r.mlen]))
+}
+
+// Decode the metadata at the start of buf, checking only that it is
+// whole and well formed
+func decodeMeta(buf []byte) (*lrec, *Meta, os.Error) {
+	if len(buf) < Lmetahdrsize || be.Uint32(buf[0:]) != Logmagic {
+		return nil, nil, Ebadrec
+	}
+	r := new(lrec)
+	r.kind = int(buf[4])
+	r.seq = be.Uint64(buf[8:])
+	r.daddr = be.Uint64(buf[16:])
+	r.doff = be.Uint32(buf[24:])
+	r.dlen = be.Uint32(buf[28:])
+	r.dcrc = be.Uint32(buf[32:])
+	r.mlen = be.Uint32(buf[36:])
+	next := be.Uint32(buf[80:])
+	naux := be.Uint32(buf[84:])
+	if r.kind != Lchunk && r.kind != Lversion || r.dlen > r.doff ||
+		uint64(r.mlen) != Lmetahdrsize+uint64(next)*Lextsize+uint64(naux) || uint64(r.mlen) > uint64(len(buf)) {
+		return nil, nil, Ebadrec
+	}
+	crc := be.Uint32(buf[92:])
+	be.PutUint32(buf[92:], 0)
+	ok := crc32.ChecksumIEEE(buf[0:r.mlen]) == crc
+	be.PutUint32(buf[92:], crc)
+	if !ok {
+		return nil, nil, Ebadrec
+	}
+
+	m := new(Meta)
+	m.Type = int(buf[5])
+	m.State = int(buf[6])
+	m.Vid.Server = ServerID(be.Uint64(buf[40:]))
+	m.Vid.File = FileID(be.Uint64(buf[48:]))
+	m.Vid.Version = VersionID(be.Uint64(buf[56:]))
+	m.Time = int64(be.Uint64(buf[64:]))
+	m.Length = be.Uint64(buf[72:])
+	m.ext = make([]extent, int(next))
+	p := buf[Lmetahdrsize:]
+	for i := range m.ext {
+		m.ext[i].daddr = be.Uint64(p[0:])
+		m.ext[i].len = be.Uint32(p[8:])
+		m.ext[i].crc = be.Uint32(p[12:])
+		p = p[Lextsize:]
+	}
+	m.Aux = make([]byte, int(naux))
+	copy(m.Aux, p)
+	return r, m, nil
+}
+
+// Seal the active arena, if any, and start on a new one. The index is
+// written out every time an arena fills up, once the log it points into
+// is on the disk.
+func (disk *Disk) rollArena() os.Error {
+	w := disk.w
+	if w.arena >= 0 {
+		if err := disk.SealArena(w.arena, w.off); err != nil {
+			return err
+		}
+		w.arena = -1
+		if err := disk.f.Sync(); err != nil {
+			return err
+		}
+		if err := disk.StoreIndex(); err != nil {
+			return err
+		}
+	}
+	i, err := disk.AllocArena()
+	if err != nil {
+		return err
+	}
+	w.arena = i
+	w.off = 0
+	return nil
+}
+
+// Append a record of m with dat as its data to the log
+func (disk *Disk) appendRecord(kind int, m *Meta, dat []byte) (Metaaddr, os.Error) {
+	s := disk.super
+	b := uint64(s.Bsize)
+	r := new(lrec)
+	r.kind = kind
+	r.dlen = uint32(len(dat))
+	r.dcrc = crc32.ChecksumIEEE(dat)
+	r.doff = uint32(roundup(uint64(len(dat)), b))
+	r.mlen = uint32(Lmetahdrsize + len(m.ext)*Lextsize + len(m.Aux))
+	need := uint64(r.doff) + roundup(uint64(r.mlen), b)
+	if need > s.Asize {
+		return Metaaddr{}, Etoobig
+	}
+
+	w := disk.w
+	if w.arena < 0 || w.off+need > s.Asize {
+		if err := disk.rollArena(); err != nil {
+			return Metaaddr{}, err
+		}
+	}
+	r.seq = disk.atab.arenas[w.arena].Seq
+	r.daddr = s.Arenaaddr(w.arena) + w.off
+
+	buf := make([]byte, int(need))
+	copy(buf, dat)
+	m.encode(r, buf[r.doff:])
+	if _, err := disk.f.WriteAt(buf, int64(r.daddr)); err != nil {
+		return Metaaddr{}, os.NewError(fmt.Sprintf("append: %s: write %d: %s", disk.name, r.daddr, err.String()))
+	}
+	w.off += need
+
+	var ma Metaaddr
+	ma.Daddr = r.daddr
+	ma.Doff = int32(r.doff)
+	ma.Dlen = r.doff + r.mlen
+	return ma, nil
+}
+
+// How much data goes in one record
+func (disk *Disk) chunksize() int {
+	s := disk.super
+	n := Maxchunk * s.Bsize
+	if uint64(n) > s.Asize/2 {
+		n = int(s.Asize / 2)
+	}
+	return n
+}
+
+// How much data Append is sure to take for a version with naux bytes of
+// Aux: the extents of all but the last chunk go in its record, which has
+// to fit in an arena with the last chunk
+func (disk *Disk) MaxLength(naux int) uint64 {
+	s := disk.super
+	b := uint64(s.Bsize)
+	chunk := uint64(disk.chunksize())
+	room := s.Asize - roundup(chunk, b)
+	room -= room % b
+	if uint64(Lmetahdrsize+naux) > room {
+		return 0
+	}
+	next := (room - uint64(Lmetahdrsize+naux)) / Lextsize
+	return (next + 1) * chunk
+}
+
+// Append a version of a file, with dat as its data, to the log and put
+// it in the index. Its Length is set from dat.
+func (disk *Disk) Append(m *Meta, dat []byte) (Metaaddr, os.Error) {
+	chunk := disk.chunksize()
+	m.Length = uint64(len(dat))
+	m.ext = make([]extent, (len(dat)+chunk-1)/chunk)
+	n := 0
+	for len(dat) > chunk {
+		c := new(Meta)
+		c.Vid = m.Vid
+		c.Type = m.Type
+		c.Time = m.Time
+		ma, err := disk.appendRecord(Lchunk, c, dat[0:chunk])
+		if err != nil {
+			return Metaaddr{}, err
+		}
+		m.ext[n].daddr = ma.Daddr
+		m.ext[n].len = uint32(chunk)
+		m.ext[n].crc = crc32.ChecksumIEEE(dat[0:chunk])
+		n++
+		dat = dat[chunk:]
+	}
+	m.ext = m.ext[0:n]
+	ma, err := disk.appendRecord(Lversion, m, dat)
+	if err != nil {
+		return Metaaddr{}, err
+	}
+	disk.index.Insert(m.Vid, ma)
+	return ma, nil
+}
+
+// Where the log ends, which is where the next record goes unless the
+// arena it is in is full
+func (disk *Disk) logEnd() uint64 {
+	s := disk.super
+	w := disk.w
+	if w.arena >= 0 {
+		return s.Arenaaddr(w.arena) + w.off
+	}
+	// between arenas: at the end of the last one
+	last := -1
+	var seq uint64
+	for i, a := range disk.atab.arenas {
+		if a.State != Afree && a.Seq > seq {
+			seq = a.Seq
+			last = i
+		}
+	}
+	if last < 0 {
+		return s.Lastsnap
+	}
+	return s.Arenaaddr(last) + disk.atab.arenas[last].Fill
+}
+
+// Make what was appended so far stick: record how far the log goes,
+// get it on the disk, write the index out and, once that is on the disk
+// too, a checkpoint in the superblock saying the index has the log up
+// to its end
+func (disk *Disk) Sync() os.Error {
+	w := disk.w
+	if w.arena >= 0 {
+		if err := disk.FillArena(w.arena, w.off); err != nil {
+			return err
+		}
+	}
+	// the log first, or the index could point past its end
+	if err := disk.f.Sync(); err != nil {
+		return err
+	}
+	if err := disk.StoreIndex(); err != nil {
+		return err
+	}
+	if err := disk.f.Sync(); err != nil {
+		return err
+	}
+	s := disk.super
+	s.Lastsnap = disk.logEnd()
+	if t := time.Nanoseconds(); t > s.Time {
+		s.Time = t
+	} else {
+		s.Time++
+	}
+	if err := disk.WriteSuper(); err != nil {
+		return err
+	}
+	return disk.f.Sync()
+}
+
+// Make what was appended so far stick, but only in the log: the index and
+// the checkpoint are left as they were, and Recover finds the records
+// after it again. Much cheaper than Sync, which should still be called
+// now and then to keep recovery short.
+func (disk *Disk) SyncLog() os.Error {
+	return disk.f.Sync()
+}
+
+// Read the record at ma, data and metadata in one go
+func (disk *Disk) readRecord(ma Metaaddr) (*lrec, *Meta, []byte, os.Error) {
+	bad := func(why string) os.Error {
+		return os.NewError(fmt.Sprintf("read: %s: record at %d: %s", disk.name, ma.Daddr, why))
+	}
+	if ma.Doff < 0 || uint32(ma.Doff) > ma.Dlen {
+		return nil, nil, nil, bad("bad address")
+	}
+	buf := make([]byte, int(ma.Dlen))
+	if _, err := disk.f.ReadAt(buf, int64(ma.Daddr)); err != nil {
+		return nil, nil, nil, bad(err.String())
+	}
+	r, m, err := decodeMeta(buf[ma.Doff:])
+	if err != nil {
+		return nil, nil, nil, bad(err.String())
+	}
+	if r.daddr != ma.Daddr || r.doff != uint32(ma.Doff) {
+		return nil, nil, nil, bad("not where it says it is")
+	}
+	dat := buf[0:r.dlen]
+	if crc32.ChecksumIEEE(dat) != r.dcrc {
+		return nil, nil, nil, bad("data checksum mismatch")
+	}
+	return r, m, dat, nil
+}
+
+// The metadata of the version at ma, without its data
+func (disk *Disk) ReadMeta(ma Metaaddr) (*Meta, os.Error) {
+	buf := make([]byte, int(ma.Dlen)-int(ma.Doff))
+	if _, err := disk.f.ReadAt(buf, int64(ma.Daddr)+int64(ma.Doff)); err != nil {
+		return nil, os.NewError(fmt.Sprintf("read: %s: metadata at %d: %s", disk.name, ma.Daddr, err.String()))
+	}
+	r, m, err := decodeMeta(buf)
+	if err != nil || r.daddr != ma.Daddr {
+		return nil, os.NewError(fmt.Sprintf("read: %s: metadata at %d: bad record", disk.name, ma.Daddr))
+	}
+	return m, nil
+}
+
+// The metadata and data of the version at ma. When all the data is in
+// the record with the metadata, it takes a single read.
+func (disk *Disk) ReadVersion(ma Metaaddr) (*Meta, []byte, os.Error) {
+	_, m, last, err := disk.readRecord(ma)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(m.ext) == 0 {
+		return m, last, nil
+	}
+	dat := make([]byte, int(m.Length))
+	n := 0
+	for _, e := range m.ext {
+		if n+int(e.len) > len(dat) {
+			return nil, nil, os.NewError(fmt.Sprintf("read: %s: version at %d: extents too long", disk.name, ma.Daddr))
+		}
+		p := dat[n : n+int(e.len)]
+		if _, err := disk.f.ReadAt(p, int64(e.daddr)); err != nil {
+			return nil, nil, os.NewError(fmt.Sprintf("read: %s: extent at %d: %s", disk.name, e.daddr, err.String()))
+		}
+		if crc32.ChecksumIEEE(p) != e.crc {
+			return nil, nil, os.NewError(fmt.Sprintf("read: %s: extent at %d: checksum mismatch", disk.name, e.daddr))
+		}
+		n += int(e.len)
+	}
+	if n+len(last) != len(dat) {
+		return nil, nil, os.NewError(fmt.Sprintf("read: %s: version at %d: %d bytes, not %d",
+			disk.name, ma.Daddr, n+len(last), len(dat)))
+	}
+	copy(dat[n:], last)
+	return m, dat, nil
+}
+
+// The metadata and data of vid, found through the index
+func (disk *Disk) Get(vid Vid) (*Meta, []byte, os.Error) {
+	ma, ok := disk.index.Lookup(vid)
+	if !ok {
+		return nil, nil, Enotfound
+	}
+	return disk.ReadVersion(ma)
+}
+
+// The metadata of every version of xid, oldest first, found through
+// the index
+func (disk *Disk) History(xid Xid) ([]*Meta, os.Error) {
+	n := 0
+	disk.index.Range(xid, func(e *Indexelem) bool {
+		n++
+		return true
+	})
+	ms := make([]*Meta, n)
+	i := 0
+	var err os.Error
+	disk.index.Range(xid, func(e *Indexelem) bool {
+		ms[i], err = disk.ReadMeta(e.Addr)
+		i++
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
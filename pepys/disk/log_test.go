@@ -0,0 +1,315 @@
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// n bytes of data that differ for each seed
+func pattern(n int, seed int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + i/251 + seed*13)
+	}
+	return b
+}
+
+func newMeta(v Vid, i int) *Meta {
+	m := new(Meta)
+	m.Vid = v
+	m.Type = Mfile
+	m.State = Mdirty
+	m.Time = int64(1000 + i)
+	m.Aux = []byte(fmt.Sprintf("aux %d", i))
+	return m
+}
+
+func sameMeta(a *Meta, b *Meta) bool {
+	return sameVid(a.Vid, b.Vid) && a.Type == b.Type && a.State == b.State &&
+		a.Time == b.Time && a.Length == b.Length && bytes.Equal(a.Aux, b.Aux)
+}
+
+// The version v, with m and dat, reads back as written
+func getVersion(dk *Disk, m *Meta, dat []byte) os.Error {
+	gm, gdat, err := dk.Get(m.Vid)
+	if err != nil {
+		return err
+	}
+	if !sameMeta(gm, m) {
+		return os.NewError(fmt.Sprintf("%v: metadata read back as %v", m.Vid, gm))
+	}
+	if !bytes.Equal(gdat, dat) {
+		return os.NewError(fmt.Sprintf("%v: %d bytes of data read back wrong", m.Vid, len(dat)))
+	}
+	return nil
+}
+
+// Versions of any size are appended to the log and read back, before
+// and after the disk is reopened
+func TestLogAppend(t *testing.T) {
+	defer os.Remove(imageName())
+	dk, err := makeImage(4*M, geometry(0, 512, 256*K, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if dk != nil {
+			dk.Close()
+		}
+	}()
+	chunk := 128 * 512
+	sizes := []int{0, 1, 511, 512, 513, 4000, chunk, chunk + 1, 3*chunk + 100}
+	ms := make([]*Meta, len(sizes))
+	dats := make([][]byte, len(sizes))
+	for i, n := range sizes {
+		ms[i] = newMeta(vid(1, uint64(i+1), 1), i)
+		dats[i] = pattern(n, i)
+		ma, err := dk.Append(ms[i], dats[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ms[i].Length != uint64(n) {
+			t.Fatalf("%d bytes appended, length set to %d", n, ms[i].Length)
+		}
+		// the data and the metadata right after it
+		mlen := Lmetahdrsize + len(ms[i].Aux)
+		doff := (n + 511) &^ 511
+		if n <= chunk && (ma.Doff != int32(doff) || ma.Dlen != uint32(doff+mlen)) {
+			t.Fatalf("%d bytes appended at doff %d dlen %d", n, ma.Doff, ma.Dlen)
+		}
+		m, err := dk.ReadMeta(ma)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameMeta(m, ms[i]) {
+			t.Fatalf("%d bytes appended, metadata read back as %v", n, m)
+		}
+	}
+	if _, _, err = dk.Get(vid(1, 1, 2)); err != Enotfound {
+		t.Fatalf("getting a missing version: got %v", err)
+	}
+	for i := range ms {
+		if err = getVersion(dk, ms[i], dats[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = dk.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	dk.Close()
+	if dk, err = reopen(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range ms {
+		if err = getVersion(dk, ms[i], dats[i]); err != nil {
+			t.Fatalf("after reopening: %s", err)
+		}
+	}
+	// and the log goes on where it was
+	m := newMeta(vid(1, 1, 2), 99)
+	if _, err = dk.Append(m, pattern(100, 99)); err != nil {
+		t.Fatal(err)
+	}
+	if err = getVersion(dk, m, pattern(100, 99)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Full arenas are sealed and the log goes on in the next, until there
+// are none left
+func TestLogRoll(t *testing.T) {
+	defer os.Remove(imageName())
+	dk, err := makeImage(4*M, geometry(0, 512, 256*K, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if dk != nil {
+			dk.Close()
+		}
+	}()
+	if _, err = dk.Append(newMeta(vid(2, 1, 1), 0), make([]byte, M)); err != nil {
+		t.Fatal(err)
+	}
+	big := newMeta(vid(2, 1, 2), 0)
+	big.Aux = make([]byte, 256*K)
+	if _, err = dk.Append(big, nil); err != Etoobig {
+		t.Fatalf("appending metadata bigger than an arena: got %v", err)
+	}
+
+	var ms []*Meta
+	for i := 0; ; i++ {
+		m := newMeta(vid(2, uint64(i+2), 1), i)
+		if _, err = dk.Append(m, pattern(100*1024, i)); err == Enoarena {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		nms := make([]*Meta, len(ms)+1)
+		copy(nms, ms)
+		nms[len(ms)] = m
+		ms = nms
+	}
+	// the last one too, as the log rolled off it
+	at := dk.Atab()
+	for i := 0; i < at.Len(); i++ {
+		a := at.Arena(i)
+		if a.State != Asealed || a.Seq != uint64(i+1) || a.Fill > dk.Super().Asize {
+			t.Fatalf("with the log full, arena %d is %s", i, a.String())
+		}
+	}
+	if len(ms) < at.Len() {
+		t.Fatalf("only %d versions fit in %d arenas", len(ms), at.Len())
+	}
+
+	if err = dk.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	dk.Close()
+	if dk, err = reopen(); err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range ms {
+		if err = getVersion(dk, m, pattern(100*1024, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Versions up to MaxLength are appended, and one chunk more is refused
+func TestLogMaxLength(t *testing.T) {
+	defer os.Remove(imageName())
+	dk, err := makeImage(4*M, geometry(0, 512, MinAsize, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dk.Close()
+	chunk := uint64(dk.chunksize())
+	// room in the record for ten extents
+	naux := int(MinAsize-chunk) - Lmetahdrsize - 10*Lextsize
+	max := dk.MaxLength(naux)
+	if max != 11*chunk {
+		t.Fatalf("%d bytes of metadata: at most %d bytes of data, want %d", naux, max, 11*chunk)
+	}
+	for i, n := range []uint64{max, max - chunk/2, 1} {
+		m := newMeta(vid(4, uint64(i+1), 1), i)
+		m.Aux = make([]byte, naux)
+		if _, err = dk.Append(m, pattern(int(n), i)); err != nil {
+			t.Fatalf("appending %d bytes: %s", n, err)
+		}
+		if err = getVersion(dk, m, pattern(int(n), i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := newMeta(vid(4, 9, 1), 0)
+	m.Aux = make([]byte, naux)
+	if _, err = dk.Append(m, make([]byte, max+chunk)); err != Etoobig {
+		t.Fatalf("appending %d bytes: got %v", max+chunk, err)
+	}
+	if dk.MaxLength(int(MinAsize)) != 0 {
+		t.Fatal("metadata bigger than an arena leaves room for data")
+	}
+}
+
+// Damaged data or metadata is noticed when read
+func TestLogCorrupt(t *testing.T) {
+	defer os.Remove(imageName())
+	dk, err := makeImage(4*M, geometry(0, 512, 256*K, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mas [3]Metaaddr
+	for i := range mas {
+		if mas[i], err = dk.Append(newMeta(vid(3, uint64(i+1), 1), i), pattern(1000, i)); err != nil {
+			dk.Close()
+			t.Fatal(err)
+		}
+	}
+	if err = dk.Sync(); err != nil {
+		dk.Close()
+		t.Fatal(err)
+	}
+	dk.Close()
+	if err = damage(mas[0].Daddr+10, 4); err != nil {
+		t.Fatal(err)
+	}
+	// the time, in the metadata
+	if err = damage(mas[1].Daddr+uint64(mas[1].Doff)+68, 4); err != nil {
+		t.Fatal(err)
+	}
+	if dk, err = reopen(); err != nil {
+		t.Fatal(err)
+	}
+	defer dk.Close()
+	for i, what := range []string{"data", "metadata"} {
+		if _, _, err = dk.Get(vid(3, uint64(i+1), 1)); err == nil {
+			t.Fatalf("damaged %s read back", what)
+		}
+	}
+	if _, err = dk.ReadMeta(mas[1]); err == nil {
+		t.Fatal("damaged metadata read back")
+	}
+	// the version after them is whole
+	if _, _, err = dk.Get(vid(3, 3, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// History has every version of a file, oldest first, and nothing of
+// the files next to it
+func TestLogHistory(t *testing.T) {
+	defer os.Remove(imageName())
+	dk, err := makeImage(4*M, geometry(0, 512, 64*K, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if dk != nil {
+			dk.Close()
+		}
+	}()
+	ms := make([]*Meta, 6)
+	for i := range ms {
+		ms[i] = newMeta(vid(2, 7, int64(i+1)), i)
+		if _, err = dk.Append(ms[i], pattern(i*5000, i)); err != nil {
+			t.Fatal(err)
+		}
+		// versions of the files on either side in between
+		for _, f := range []uint64{6, 8} {
+			if _, err = dk.Append(newMeta(vid(2, f, int64(i+1)), 50+i), pattern(10, i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i == 2 {
+			if err = dk.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for pass := 0; pass < 2; pass++ {
+		h, err := dk.History(vid(2, 7, 0).Xid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(h) != len(ms) {
+			t.Fatalf("%d versions in the history, want %d", len(h), len(ms))
+		}
+		for i := range h {
+			if !sameMeta(h[i], ms[i]) {
+				t.Fatalf("version %d in the history is %v", i+1, h[i])
+			}
+		}
+		if h, err = dk.History(vid(3, 7, 0).Xid); err != nil || len(h) != 0 {
+			t.Fatalf("history of a missing file: %d versions, %v", len(h), err)
+		}
+		// and again from the log after a crash
+		dk.Close()
+		if dk, err = mount(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package disk
+
+import (
+	"os"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+ * Recovery
+ *
+ * Sync leaves a checkpoint in the superblock, Lastsnap: the index on
+ * disk has all of the log before it.  Records appended after it are
+ * only in the log, where SyncLog makes them stick, and whatever was
+ * being written when the machine went down may be torn.  So when
+ * mounting, the log is read forward from the checkpoint, arena by
+ * arena in the order of their sequence numbers, putting every whole
+ * version back in the index.  The first record that isn't whole ends
+ * the log; what follows it is garbage, and the next record goes over
+ * it.  Then a fresh checkpoint is made.
+ *
+ * Putting a version in the index again is harmless, so it doesn't
+ * matter if the index is newer than the checkpoint, as it is when it
+ * was written out after the superblock, when an arena filled up.
+ */
+
+// The arena and offset of the checkpoint
+func (disk *Disk) snappos() (int, uint64) {
+	s := disk.super
+	if s.Lastsnap < s.Arenas {
+		// made before checkpoints were kept
+		return 0, 0
+	}
+	i := int((s.Lastsnap - s.Arenas) / s.Asize)
+	off := (s.Lastsnap - s.Arenas) % s.Asize
+	if off == 0 && i > 0 && disk.atab.arenas[i-1].State != Afree {
+		// the end of the arena before, which was full
+		return i - 1, s.Asize
+	}
+	if i >= len(disk.atab.arenas) {
+		return -1, 0
+	}
+	return i, off
+}
+
+// The record starting off bytes into arena i, if a whole one does and
+// ends before lim. Ebadrec says there isn't one.
+func (disk *Disk) scanRecord(i int, off uint64, lim uint64) (*lrec, *Meta, os.Error) {
+	s := disk.super
+	b := uint64(s.Bsize)
+	seq := disk.atab.arenas[i].Seq
+	daddr := s.Arenaaddr(i) + off
+	bad := func(why string) os.Error {
+		return os.NewError(fmt.Sprintf("recover: %s: record at %d: %s", disk.name, daddr, why))
+	}
+
+	// the metadata is after at most a chunk of data
+	n := uint64(disk.chunksize()) + b
+	if n > lim-off {
+		n = lim - off
+	}
+	buf := make([]byte, int(n))
+	if _, err := disk.f.ReadAt(buf, int64(daddr)); err != nil {
+		return nil, nil, bad(err.String())
+	}
+	for doff := uint64(0); doff+Lmetahdrsize <= n; doff += b {
+		h := buf[doff:]
+		if be.Uint32(h[0:]) != Logmagic || be.Uint64(h[8:]) != seq ||
+			be.Uint64(h[16:]) != daddr || uint64(be.Uint32(h[24:])) != doff {
+			continue
+		}
+		mlen := uint64(be.Uint32(h[36:]))
+		if doff+roundup(mlen, b) > lim-off {
+			continue
+		}
+		rec := buf
+		if doff+mlen > n {
+			rec = make([]byte, int(doff+mlen))
+			if _, err := disk.f.ReadAt(rec, int64(daddr)); err != nil {
+				return nil, nil, bad(err.String())
+			}
+		}
+		r, m, err := decodeMeta(rec[doff:])
+		if err != nil || crc32.ChecksumIEEE(rec[0:r.dlen]) != r.dcrc {
+			// data that looks like metadata, or a torn record
+			continue
+		}
+		return r, m, nil
+	}
+	return nil, nil, Ebadrec
+}
+
+// Bring the index up to date with the log after a crash, and set the
+// log writer at the end of what is whole in it. The superblock, index
+// and arena table must have been read first.
+func (disk *Disk) Recover() os.Error {
+	s := disk.super
+	at := disk.atab
+	b := uint64(s.Bsize)
+	nrec, nvers := 0, 0
+	i, off := disk.snappos()
+	for i >= 0 && at.arenas[i].State != Afree {
+		a := &at.arenas[i]
+		lim := s.Asize
+		if a.State != Aactive {
+			lim = a.Fill
+		}
+		for off < lim {
+			r, m, err := disk.scanRecord(i, off, lim)
+			if err == Ebadrec {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if r.kind == Lversion {
+				var ma Metaaddr
+				ma.Daddr = r.daddr
+				ma.Doff = int32(r.doff)
+				ma.Dlen = r.doff + r.mlen
+				disk.index.Insert(m.Vid, ma)
+				nvers++
+			}
+			nrec++
+			off += uint64(r.doff) + roundup(uint64(r.mlen), b)
+		}
+
+		// on to the arena that came next, if the log got there
+		next := -1
+		for j := range at.arenas {
+			if at.arenas[j].State != Afree && at.arenas[j].Seq == a.Seq+1 {
+				next = j
+				break
+			}
+		}
+		if next < 0 {
+			if a.State == Aactive {
+				if off != a.Fill {
+					disk.log.Logf("recover: %s: log ends at %d in arena %d, not %d\n",
+						disk.name, off, i, a.Fill)
+				}
+				disk.w.arena = i
+				disk.w.off = off
+			}
+			break
+		}
+		i = next
+		off = 0
+	}
+	disk.log.Logf("recover: %s: %d records, %d versions after the checkpoint\n", disk.name, nrec, nvers)
+	return disk.Sync()
+}
+
+// Read what is on the disk, recovering from a crash if need be
+func (disk *Disk) Mount() os.Error {
+	if err := disk.ReadSuper(); err != nil {
+		return err
+	}
+	if err := disk.LoadIndex(); err != nil {
+		return err
+	}
+	if err := disk.LoadAtab(); err != nil {
+		return err
+	}
+	return disk.Recover()
+}
@@ -0,0 +1,358 @@
+package disk
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Open the image as pepysfs would, recovering after a crash
+func mount() (*Disk, os.Error) {
+	dk, err := New(imageName())
+	if err != nil {
+		return nil, err
+	}
+	if err = dk.Mount(); err != nil {
+		dk.Close()
+		return nil, err
+	}
+	return dk, nil
+}
+
+// Versions appended after the last Sync are found in the log again,
+// and the checkpoint moves on past them
+func TestLogRecover(t *testing.T) {
+	defer os.Remove(imageName())
+	dk, err := makeImage(4*M, geometry(0, 512, 64*K, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if dk != nil {
+			dk.Close()
+		}
+	}()
+	if snap := dk.Super().Lastsnap; snap != dk.Super().Arenas {
+		t.Fatalf("new disk checkpointed at %d, not at the first arena", snap)
+	}
+	ms := make([]*Meta, 10)
+	for i := range ms {
+		ms[i] = newMeta(vid(5, uint64(i+1), 1), i)
+		if _, err = dk.Append(ms[i], pattern(i*9000, i)); err != nil {
+			t.Fatal(err)
+		}
+		if i == 3 {
+			if err = dk.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the rest only made it to the log
+	dk.Close()
+	if dk, err = mount(); err != nil {
+		t.Fatal(err)
+	}
+	if n := dk.Index().Len(); n != len(ms) {
+		t.Fatalf("%d versions in the index after recovery, want %d", n, len(ms))
+	}
+	for i, m := range ms {
+		if err = getVersion(dk, m, pattern(i*9000, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := dk.Super().Lastsnap
+	dk.Close()
+	if dk, err = reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if dk.Super().Lastsnap != snap || dk.Index().Len() != len(ms) {
+		t.Fatalf("the checkpoint after recovery read back as %d with %d versions",
+			dk.Super().Lastsnap, dk.Index().Len())
+	}
+}
+
+var Ecrash = os.NewError("crashed")
+
+// A file that takes a number of writes and then no more, as if the
+// machine had gone down. If torn, the last of them is cut short at
+// a sector boundary.
+type crashfile struct {
+	*os.File
+	left int
+	torn bool
+}
+
+func (f *crashfile) WriteAt(b []byte, off int64) (int, os.Error) {
+	if f.left == 0 {
+		return 0, Ecrash
+	}
+	f.left--
+	if f.left == 0 && f.torn {
+		n, _ := f.File.WriteAt(b[0:len(b)/2&^511], off)
+		return n, Ecrash
+	}
+	return f.File.WriteAt(b, off)
+}
+
+func (f *crashfile) Sync() os.Error {
+	if f.left == 0 {
+		return Ecrash
+	}
+	return f.File.Sync()
+}
+
+// Sizes of the versions crashWork appends; 70000 takes three records
+var crashSizes = []int{100, 5000, 20000, 70000, 0, 30000}
+
+// Mount the image on f, then append versions across several arenas,
+// syncing the log alone or with a checkpoint now and then, until f stops
+// taking writes. The versions appended are marked in done, and *synced
+// counts those appended before the last Sync or SyncLog that went
+// through.
+func crashWork(f File, ms []*Meta, done []bool, synced *int) os.Error {
+	dk, err := NewFile(imageName(), f)
+	if err != nil {
+		return err
+	}
+	defer dk.Close()
+	if err = dk.Mount(); err != nil {
+		return err
+	}
+	for i, m := range ms {
+		if _, err = dk.Append(m, pattern(crashSizes[i%len(crashSizes)], i)); err != nil {
+			return err
+		}
+		done[i] = true
+		switch {
+		case i%5 == 4:
+			err = dk.Sync()
+		case i%2 == 0:
+			err = dk.SyncLog()
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		*synced = i + 1
+	}
+	return nil
+}
+
+// After a crash at any write, whole or torn, every version appended
+// before it is recovered, and none of those after
+func TestLogCrash(t *testing.T) {
+	defer os.Remove(imageName())
+	for n := 0; ; n++ {
+		for _, torn := range []bool{false, true} {
+			dk, err := makeImage(4*M, geometry(0, 512, 64*K, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dk.Close()
+			fd, err := os.Open(imageName(), os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := &crashfile{fd, n, torn}
+			if torn {
+				f.left++
+			}
+			ms := make([]*Meta, 16)
+			done := make([]bool, len(ms))
+			for i := range ms {
+				ms[i] = newMeta(vid(6, uint64(i%5+1), int64(i/5+1)), i)
+			}
+			synced := 0
+			err = crashWork(f, ms, done, &synced)
+			if err == nil {
+				// it all went through before the crash
+				return
+			}
+			if err != Ecrash && !strings.Contains(err.String(), Ecrash.String()) {
+				t.Fatal(err)
+			}
+
+			where := fmt.Sprintf("crash after %d writes", n)
+			if torn {
+				where += ", the next torn"
+			}
+			if dk, err = mount(); err != nil {
+				t.Fatalf("%s: %s", where, err)
+			}
+			if err = dk.Index().IsSane(); err != nil {
+				dk.Close()
+				t.Fatalf("%s: %s", where, err)
+			}
+			for i, m := range ms {
+				if done[i] {
+					err = getVersion(dk, m, pattern(crashSizes[i%len(crashSizes)], i))
+				} else if _, _, err = dk.Get(m.Vid); err == Enotfound {
+					err = nil
+				} else {
+					err = os.NewError(fmt.Sprintf("%v recovered, but never appended", m.Vid))
+				}
+				if err != nil {
+					dk.Close()
+					t.Fatalf("%s: %s", where, err)
+				}
+			}
+			// the log goes on over the torn tail
+			m := newMeta(vid(7, 1, 1), 0)
+			if _, err = dk.Append(m, pattern(3000, 0)); err == nil {
+				err = dk.Sync()
+			}
+			dk.Close()
+			if err != nil {
+				t.Fatalf("%s: after recovery: %s", where, err)
+			}
+			if dk, err = mount(); err != nil {
+				t.Fatalf("%s: after recovery: %s", where, err)
+			}
+			err = getVersion(dk, m, pattern(3000, 0))
+			dk.Close()
+			if err != nil {
+				t.Fatalf("%s: after recovery: %s", where, err)
+			}
+		}
+	}
+}
+
+// A write the disk has taken but not yet synced, and what it went over
+type write struct {
+	off  int64
+	b    []byte
+	old  []byte
+	next *write // the one before
+}
+
+// A file that takes a number of writes and then no more, like crashfile,
+// but whose writes since the last Sync are not all on the platter when
+// it goes down: the disk may have kept any of them, in any order.
+type lossyfile struct {
+	*os.File
+	left    int
+	pending *write // newest first
+}
+
+func (f *lossyfile) WriteAt(b []byte, off int64) (int, os.Error) {
+	if f.left == 0 {
+		return 0, Ecrash
+	}
+	f.left--
+	w := &write{off, make([]byte, len(b)), make([]byte, len(b)), f.pending}
+	copy(w.b, b)
+	if _, err := f.File.ReadAt(w.old, off); err != nil {
+		return 0, err
+	}
+	f.pending = w
+	return f.File.WriteAt(b, off)
+}
+
+func (f *lossyfile) Sync() os.Error {
+	if f.left == 0 {
+		return Ecrash
+	}
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	f.pending = nil
+	return nil
+}
+
+// Take back the writes since the last Sync, then put back those that
+// keep picks by their number, the oldest being 0, out of n
+func (f *lossyfile) crash(keep func(i int, n int) bool) os.Error {
+	fd, err := os.Open(imageName(), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	n := 0
+	for w := f.pending; w != nil; w = w.next {
+		if _, err = fd.WriteAt(w.old, w.off); err != nil {
+			return err
+		}
+		n++
+	}
+	var redo func(w *write, i int) os.Error
+	redo = func(w *write, i int) os.Error {
+		if w == nil {
+			return nil
+		}
+		if err := redo(w.next, i-1); err != nil {
+			return err
+		}
+		if keep(i, n) {
+			_, err := fd.WriteAt(w.b, w.off)
+			return err
+		}
+		return nil
+	}
+	return redo(f.pending, n-1)
+}
+
+// Which of the writes since the last Sync a crash keeps
+var keeps = []func(i int, n int) bool{
+	func(i int, n int) bool { return false },
+	func(i int, n int) bool { return i == n-1 },
+	func(i int, n int) bool { return i%2 == 0 },
+	func(i int, n int) bool { return i%2 == 1 },
+}
+
+// After a crash that loses some of the writes since the last Sync, every
+// version synced is recovered, and every version in the index reads back
+// as appended
+func TestLogLostWrites(t *testing.T) {
+	defer os.Remove(imageName())
+	for n := 0; ; n++ {
+		for k, keep := range keeps {
+			dk, err := makeImage(4*M, geometry(0, 512, 64*K, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dk.Close()
+			fd, err := os.Open(imageName(), os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := &lossyfile{fd, n, nil}
+			ms := make([]*Meta, 16)
+			done := make([]bool, len(ms))
+			for i := range ms {
+				ms[i] = newMeta(vid(6, uint64(i%5+1), int64(i/5+1)), i)
+			}
+			synced := 0
+			err = crashWork(f, ms, done, &synced)
+			if err == nil {
+				return
+			}
+			if err != Ecrash && !strings.Contains(err.String(), Ecrash.String()) {
+				t.Fatal(err)
+			}
+			where := fmt.Sprintf("crash after %d writes, losing writes as in %d", n, k)
+			if err = f.crash(keep); err != nil {
+				t.Fatalf("%s: %s", where, err)
+			}
+			if dk, err = mount(); err != nil {
+				t.Fatalf("%s: %s", where, err)
+			}
+			if err = dk.Index().IsSane(); err != nil {
+				dk.Close()
+				t.Fatalf("%s: %s", where, err)
+			}
+			for i, m := range ms {
+				err = getVersion(dk, m, pattern(crashSizes[i%len(crashSizes)], i))
+				if err == Enotfound && i >= synced {
+					err = nil
+				}
+				if err != nil {
+					dk.Close()
+					t.Fatalf("%s: %v: %s", where, m.Vid, err)
+				}
+			}
+			dk.Close()
+		}
+	}
+}
@@ -77,17 +77,39 @@ func opMethods(desc Description) string {
 func opPublicMethods (desc Description) string {
 	methods := new(bytes.Buffer)
 	methods.WriteString(`/* Public methods begin here */
-func NewPacket(buf io.Reader) *Packet {
+// Read a packet of at most msize bytes, as agreed in Tproto
+func NewPacket(buf io.Reader, msize uint32) (*Packet, os.Error) {
 	pkt := new(Packet)
 	
 	// length is including the length field
-	// do we really need this?
 	var length uint32
-	binary.Read(buf, binary.BigEndian, &length)
+	if err := binary.Read(buf, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length < 12 {
+		return nil, os.NewError("packet too short")
+	}
+	if length > msize {
+		// not even read, so the peer can't make us take any amount of memory
+		return nil, os.NewError("packet too long")
+	}
 	
-	// read out number of messages contained in packet
+	// read the rest of the packet at once, so that a short read can't leave
+	// us in the middle of a message
+	body := make([]byte, length - 4)
+	if _, err := io.ReadFull(buf, body); err != nil {
+		return nil, err
+	}
+	rd := bytes.NewBuffer(body)
+	
+	// the tag the response will carry, then the number of messages
+	// contained in packet
+	binary.Read(rd, binary.BigEndian, &pkt.Tag)
 	var nmsgs uint32
-	binary.Read(buf, binary.BigEndian, &nmsgs)
+	binary.Read(rd, binary.BigEndian, &nmsgs)
+	if nmsgs > uint32(len(body)) {
+		return nil, os.NewError("bad message count")
+	}
 	
 	// allocate message space
 	pkt.Msgs = make([]interface{}, nmsgs)
@@ -95,15 +117,18 @@ func NewPacket(buf io.Reader) *Packet {
 	var mtype uint32
 	for i := 0; i < int(nmsgs); i++ {
 		// read message type
-		binary.Read(buf, binary.BigEndian, &mtype)
+		if err := binary.Read(rd, binary.BigEndian, &mtype); err != nil {
+			return nil, err
+		}
 		switch mtype {
 `)
 	
 	for _, op := range desc {
 		methods.WriteString("\t\tcase " + op.Name + "Code:\n")
-		methods.WriteString("\t\t\tpkt.Msgs[i] = decode" + op.Name + "(buf)\n")
+		methods.WriteString("\t\t\tpkt.Msgs[i] = decode" + op.Name + "(rd)\n")
 	}
-	methods.WriteString("\t\t}\n\t}\n\treturn pkt\n}\n")
+	methods.WriteString("\t\tdefault:\n\t\t\treturn nil, os.NewError(\"bad message code\")\n")
+	methods.WriteString("\t\t}\n\t}\n\treturn pkt, nil\n}\n")
 
 	methods.WriteString(`
 func (pkt *Packet) Send(buf io.Writer) os.Error {
@@ -121,15 +146,21 @@ func (pkt *Packet) Send(buf io.Writer) os.Error {
 		methods.WriteString("\t\t\tencode" + op.Name + "(op.(*" + op.Name + "), tmpbuf)\n")
 	}
 	
+	methods.WriteString("\t\tdefault:\n\t\t\treturn os.NewError(\"bad message type \" + mtype)\n")
 	methods.WriteString("\t\t}\n\t}\n")
 	methods.WriteString(`
-	// total size if size of messages + 4 (nmsgs) + 4 (length)
-	total := uint32(len(tmpbuf.Bytes()) + 8)
-	binary.Write(buf, binary.BigEndian, total)
-	binary.Write(buf, binary.BigEndian, nmsgs)
-	buf.Write(tmpbuf.Bytes())
+	// total size if size of messages + 4 (nmsgs) + 4 (tag) + 4 (length);
+	// everything goes out in a single write so that packets sent from
+	// several goroutines don't get mixed up
+	total := uint32(len(tmpbuf.Bytes()) + 12)
+	out := new(bytes.Buffer)
+	binary.Write(out, binary.BigEndian, total)
+	binary.Write(out, binary.BigEndian, pkt.Tag)
+	binary.Write(out, binary.BigEndian, nmsgs)
+	out.Write(tmpbuf.Bytes())
 	
-	return nil
+	_, err := buf.Write(out.Bytes())
+	return err
 }`)
 
 	methods.WriteString(`
@@ -172,48 +203,72 @@ func srvProcess(desc Description) string {
 	proc.WriteString(`
 // Process incoming requests from a client
 func (conn *Connection) process() {
-	// Pepys messages begin with a total message size, followed by the number
-	// of operation included in this "group". We parse each one and execute
-	// them in-order while buffering the results. As soon as all operations
-	// execute successfully, or an operation fails, the results are sent back
-	// to the client.
-	for {
-		request := pepys.NewPacket(conn.handle)
+	// Pepys messages begin with a total message size, followed by a tag and
+	// the number of operation included in this "group". Groups are read
+	// by conn.read, and we execute their operations in-order while
+	// buffering the results. As soon as all operations execute
+	// successfully, or an operation fails, the results are sent back to
+	// the client with the tag of the group.
+	go conn.read()
+	dead := false
+	for <-conn.ready {
+		g := conn.next()
+		if g == nil {
+			continue
+		}
+		if dead {
+			conn.done()
+			continue
+		}
+		request := g.req
 		response := new(pepys.Packet)
+		response.Tag = request.Tag
 	
 		var err os.Error
 		var cresp interface{}
 		for _, op := range request.Msgs {
 			mtype := reflect.Typeof(op).String()
-			switch mtype {
+			
+			// The library takes care of fids and paths before and after
+			// the file server sees the message (see fid.go)
+			err = conn.prepare(op)
+			if err == nil {
+				switch mtype {
 `)
 
 	for _, op := range desc {
 		// Server callbacks are only for T messages
 		if op.Name[0] == 'T' {
-			proc.WriteString("\t\t\tcase \"*pepys." + op.Name + "\":\n")
-			proc.WriteString("\t\t\t\tcresp, err = conn.Srv.ops." + strings.ToUpper(op.Name[1:2]) + op.Name[2:])
+			proc.WriteString("\t\t\t\tcase \"*pepys." + op.Name + "\":\n")
+			proc.WriteString("\t\t\t\t\tcresp, err = conn.Srv.ops." + strings.ToUpper(op.Name[1:2]) + op.Name[2:])
 			proc.WriteString("(conn, op.(*pepys." + op.Name + "))\n")
 		}
 	}
 	
 	proc.WriteString(`
+				}
 			}
+			err = conn.finish(op, err)
 		
 			if err == nil {
 				response.Add(cresp)
 			} else {
 				ePkt := new(pepys.Rerror)
 				ePkt.Ename = err.String()
-				response.Add(cresp)
+				response.Add(ePkt)
 				
 				// Do not process any more messages
 				break
 			}
 		}
 	
-		// Off you go
-		response.Send(conn.handle)
+		// Off you go; once the client is gone, keep taking groups until
+		// the reader notices so that it never blocks
+		if conn.send(response) != nil {
+			conn.handle.Close()
+			dead = true
+		}
+		conn.done()
 	}
 }
 
@@ -8,35 +8,134 @@ import "encoding/binary"
 
 // General constants
 const(
-	Nmsgs	= 16,	// default max number of messages per packet
-	Iohdrsz	= 24,	// the non-data size of the Twrite messages
-	Msize	= 8192 + Iohdrsz, // default message size
+	Nmsgs	= 16	// default max number of messages per packet
+	Iohdrsz	= 32	// the non-data size of a group of one Twrite
+	Msize	= 8192 + Iohdrsz // default message size
 	Port	= 564	// default port for file servers
 )
 
 // Special values
 const (
-	Notag	= ~0,
-	Nofid	= ~0,
-	Nouid	= ~0
+	Notag	= ^uint32(0)
+	Nofid	= ^uint32(0)
+	Nouid	= ^uint32(0)
 )
 
 // Flags for the mode field in Topen messages
 const (
-	Oread   = 0x1,
-	Owrite  = 0x2,
-	Ordwr   = Oread | Owrite,
-	Oexec   = 0x4 | Oread,
-	Otrunc  = 0x10,
-	Ocexec  = 0x20,
-	Orclose = 0x40,
+	Oread   = 0x1
+	Owrite  = 0x2
+	Ordwr   = Oread | Owrite
+	Oexec   = 0x4 | Oread
+	Otrunc  = 0x10
+	Ocexec  = 0x20
+	Orclose = 0x40
+)
+
+// Ftype flags
+const (
+	Fdir       = 0x1
+	Fappend    = 0x2
+	Fversioned = 0x4
+)
+
+// Permission bits
+const (
+	Prmread  = 0x4
+	Prmwrite = 0x2
+	Prmexec  = 0x1
+	Pdir     = 0x80000000	// in Tcreate, make a directory
+)
+
+// "Don't touch" values for the fields of a Twstat message; strings are
+// left alone when empty
+const (
+	Noperm   = ^uint32(0)
+	Nolength = ^uint64(0)
+	Notime   = ^uint64(0)
+)
+
+// Error messages
+var (
+	Eperm     = os.NewError("permission denied")
+	Enotdir   = os.NewError("not a directory")
+	Enotexist = os.NewError("file does not exist")
+	Einuse    = os.NewError("file in use")
+	Eexist    = os.NewError("file exists")
+	Eisdir    = os.NewError("file is a directory")
+	Enotowner = os.NewError("not owner")
+	Eisopen   = os.NewError("file already open for I/O")
+	Excl      = os.NewError("exclusive use file already open")
+	Ename     = os.NewError("illegal name")
+	Eversion  = os.NewError("unknown protocol version")
+	Enotempty = os.NewError("directory not empty")
+	Ebadfid   = os.NewError("bad fid")
+	Efidinuse = os.NewError("fid already in use")
+	Eescape   = os.NewError("path escapes attach root")
+	Enotimpl  = os.NewError("not implemented")
 )
 
 type data []byte
+// A group of messages. A response carries the tag of its request, so that
+// a client may have several groups outstanding and flush one of them.
 type Packet struct {
+	Tag uint32
 	Msgs []interface{}
 }
 
+// The mode of Topen and Tcreate is a string of flags: r, w and x to read,
+// write and execute, t to truncate and d to remove the file on clunk.
+func ParseMode(mode string) (int, os.Error) {
+	m := 0
+	for _, c := range mode {
+		switch c {
+		case 'r':
+			m |= Oread
+		case 'w':
+			m |= Owrite
+		case 'x':
+			m |= Oexec
+		case 't':
+			m |= Otrunc
+		case 'd':
+			m |= Orclose
+		default:
+			return 0, os.NewError("bad mode " + mode)
+		}
+	}
+	return m, nil
+}
+
+func ModeString(m int) string {
+	mode := ""
+	if m & Oread != 0 {
+		mode += "r"
+	}
+	if m & Owrite != 0 {
+		mode += "w"
+	}
+	if m & Oexec == Oexec {
+		mode += "x"
+	}
+	if m & Otrunc != 0 {
+		mode += "t"
+	}
+	if m & Orclose != 0 {
+		mode += "d"
+	}
+	return mode
+}
+
+// Reading a directory returns the Rstat of each of its entries, encoded as
+// in an Rstat message but without the message code. Entries are never split
+// across reads.
+func EncodeDir(d *Rstat, buf io.Writer) os.Error {
+	return encodeRstat(d, buf)
+}
+func DecodeDir(buf io.Reader) *Rstat {
+	return decodeRstat(buf)
+}
+
 // FIXME: error checking for all the following methods
 func encodeString(val string, buf io.Writer) os.Error {
 	byt := []byte(val)
@@ -2,6 +2,7 @@ package server
 
 import "os"
 import "net"
+import "sync"
 import "pepys"
 import "reflect"
 
@@ -16,6 +17,7 @@ type Server struct {
 	// private
 	sock net.Listener
 	ops *Operations
+	walker Walker
 }
 type Connection struct {
 	// preset
@@ -23,12 +25,27 @@ type Connection struct {
 	Msize uint32
 	Nmsgs uint32
 	RemoteAddr string
+	Uname string
 	
 	// use at will
 	Aux interface{}
 	
 	// private
 	handle net.Conn
+	fids map[uint32]*Fid
+	newfid *Fid	// created by the Topen being handled
+	wlock sync.Mutex	// held while sending a response
+	lock sync.Mutex	// protects what follows
+	pending []*group	// groups read but not started, in order
+	running *group	// the group being handled, until it is answered
+	ready chan bool	// true for each group read, false once the client is gone
+}
+
+// A group read from the client and not answered yet
+type group struct {
+	req *pepys.Packet
+	flushed bool	// dropped before it was started
+	flushes []uint32	// tags of the Tflush messages waiting for it
 }
 
 // Create a pepys server with protocol "proto" at address "addr" and listen
@@ -36,8 +53,9 @@ func New(ops Operations, proto string, addr string) (*Server, os.Error) {
 	srv := new(Server)
 	
 	srv.ops = &ops;
-	srv.Nmsgs = pepys.NMSGS
-	srv.Msize = pepys.MSIZE
+	srv.walker, _ = ops.(Walker)
+	srv.Nmsgs = pepys.Nmsgs
+	srv.Msize = pepys.Msize
 	
 	// We begin implementation with a single-threaded version because incoming
 	// requests have to be handled in-order. We may extend this to a multi-
@@ -76,5 +94,107 @@ func newConnection(handle net.Conn) (conn *Connection) {
 	}
 	
 	conn.handle = handle
+	conn.fids = make(map[uint32]*Fid, 10)
+	conn.ready = make(chan bool, 64)
 	return conn
 }
+
+func (conn *Connection) send(pkt *pepys.Packet) os.Error {
+	conn.wlock.Lock()
+	defer conn.wlock.Unlock()
+	return pkt.Send(conn.handle)
+}
+
+// Answer the Tflush with the given tag
+func (conn *Connection) flushed(tag uint32) {
+	resp := new(pepys.Packet)
+	resp.Tag = tag
+	resp.Add(new(pepys.Rflush))
+	conn.send(resp)
+}
+
+// Read groups from the client and queue them for process, except for
+// Tflush messages sent on their own, which are handled at once: a group
+// that has not been started is dropped and never answered, a group being
+// handled is answered first, and the Rflush follows it.
+func (conn *Connection) read() {
+	for {
+		msize := conn.Msize
+		if msize == 0 {
+			// no Tproto yet, or it is being handled: the most it can agree on
+			msize = conn.Srv.Msize
+		}
+		request, err := pepys.NewPacket(conn.handle, msize)
+		if err != nil {
+			// the client hung up or is talking nonsense
+			conn.handle.Close()
+			conn.ready <- false
+			return
+		}
+		if len(request.Msgs) == 1 {
+			if tf, ok := request.Msgs[0].(*pepys.Tflush); ok {
+				conn.flush(request.Tag, tf)
+				continue
+			}
+		}
+
+		g := new(group)
+		g.req = request
+		conn.lock.Lock()
+		pending := make([]*group, len(conn.pending) + 1)
+		copy(pending, conn.pending)
+		pending[len(conn.pending)] = g
+		conn.pending = pending
+		conn.lock.Unlock()
+		conn.ready <- true
+	}
+}
+
+func (conn *Connection) flush(tag uint32, tf *pepys.Tflush) {
+	conn.lock.Lock()
+	if g := conn.running; g != nil && g.req.Tag == tf.Oldtag {
+		flushes := make([]uint32, len(g.flushes) + 1)
+		copy(flushes, g.flushes)
+		flushes[len(g.flushes)] = tag
+		g.flushes = flushes
+		conn.lock.Unlock()
+
+		// give the file server a chance to give up on what it is doing;
+		// this runs alongside the operations of the group
+		conn.Srv.ops.Flush(conn, tf)
+		return
+	}
+	for _, g := range conn.pending {
+		if g.req.Tag == tf.Oldtag {
+			g.flushed = true
+		}
+	}
+	conn.lock.Unlock()
+	conn.flushed(tag)
+}
+
+// The next group to handle, or nil if it was flushed
+func (conn *Connection) next() *group {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	g := conn.pending[0]
+	conn.pending = conn.pending[1:]
+	if g.flushed {
+		return nil
+	}
+	conn.running = g
+	return g
+}
+
+// The group being handled was answered; answer the flushes waiting for it
+func (conn *Connection) done() {
+	conn.lock.Lock()
+	g := conn.running
+	conn.running = nil
+	conn.lock.Unlock()
+
+	for _, tag := range g.flushes {
+		conn.flushed(tag)
+	}
+}
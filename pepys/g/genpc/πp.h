@@ -1,7 +1,7 @@
 // General constants
 enum {
 	Nmsgs	= 16,	// default max number of messages per packet
-	Iohdrsz	= 24,	// the non-data size of the Twrite messages
+	Iohdrsz	= 32,	// the non-data size of a group of one Twrite
 	Msize	= 8192 + Iohdrsz, // default message size
 	Port	= 564	// default port for file servers
 };
@@ -24,6 +24,14 @@ enum {
 	Orclose = 0x40,
 };
 
+// "Don't touch" values for the fields of a Twstat message; strings are
+// left alone when nil
+enum {
+	Noperm		= ~0
+};
+#define Nolength	(~(u64int)0)
+#define Notime		(~(u64int)0)
+
 // Ftype flags
 enum {
 	Fdir	= 0x1,
@@ -35,7 +43,8 @@ enum {
 enum {
 	Prmread		= 0x4,
 	Prmwrite	= 0x2,
-	Prmexec		= 0x1
+	Prmexec		= 0x1,
+	Pdir		= 0x80000000	// in Tcreate, make a directory
 };
 
 // ACL & Directory info (respresentations subject to future change)
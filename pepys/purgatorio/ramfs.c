@@ -63,6 +63,18 @@ ramfs_clunk(Block* blk, Message* msg)
 	
 }
 
+void
+ramfs_stat(Block* blk, Message* msg)
+{
+	
+}
+
+void
+ramfs_wstat(Block* blk, Message* msg)
+{
+	
+}
+
 /* FIXME: Move this to the generic πp library as all servers will do it.
    Then we can make the function signatures message specific instead of
    (Block*, Message*) for all. (easily done in generator)
@@ -90,6 +102,10 @@ static void
 	ramfs_remove,
 	nil,
 	ramfs_clunk,
+	nil,
+	ramfs_stat,
+	nil,
+	ramfs_wstat,
 	nil
 };
 
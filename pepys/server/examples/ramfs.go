@@ -0,0 +1,134 @@
+// ramfs example
+package main
+
+import "os"
+import "fmt"
+import "flag"
+import "pepys"
+import "pepys/server"
+
+var addr = flag.String("a", "localhost:5640", "address to listen on")
+var owner = flag.String("u", "ramfs", "owner of the root directory")
+
+// Files are kept in memory, so there is a limit to them
+const maxsize = 64 * 1024 * 1024
+
+var Etoobig = os.NewError("file too big")
+
+// Contents of a file
+type ramData struct {
+	dat []byte
+}
+
+func ramRead(f *server.File, off uint64, count uint32) ([]byte, os.Error) {
+	rd := f.Aux.(*ramData)
+	if off >= uint64(len(rd.dat)) {
+		return []byte{}, nil
+	}
+	end := off + uint64(count)
+	if end > uint64(len(rd.dat)) {
+		end = uint64(len(rd.dat))
+	}
+	// copy, the data may change under the reply
+	dat := make([]byte, end - off)
+	copy(dat, rd.dat[off:end])
+	return dat, nil
+}
+
+func ramWrite(f *server.File, off uint64, dat []byte) (uint32, os.Error) {
+	rd := f.Aux.(*ramData)
+	end := off + uint64(len(dat))
+	if end < off || end > maxsize {
+		return 0, Etoobig
+	}
+	if end > uint64(len(rd.dat)) {
+		resize(rd, end)
+		f.Length = end
+	}
+	copy(rd.dat[off:end], dat)
+	return uint32(len(dat)), nil
+}
+
+// Truncating a file changes it as a write does, so it makes a new version
+// right away; there may be no clunk of a written fid to follow
+func ramTruncate(f *server.File, length uint64) os.Error {
+	if length > maxsize {
+		return Etoobig
+	}
+	resize(f.Aux.(*ramData), length)
+	f.Length = length
+	f.Version++
+	return nil
+}
+
+// Make the data length bytes long
+func resize(rd *ramData, length uint64) {
+	if length <= uint64(cap(rd.dat)) {
+		// zero whatever comes back into view
+		old := uint64(len(rd.dat))
+		rd.dat = rd.dat[0:length]
+		for i := old; i < length; i++ {
+			rd.dat[i] = 0
+		}
+	} else {
+		n := length * 2
+		if n > maxsize {
+			n = maxsize
+		}
+		dat := make([]byte, length, n)
+		copy(dat, rd.dat)
+		rd.dat = dat
+	}
+}
+
+// Every clunk of a fid that wrote to a file makes a new version of it
+func ramClunk(f *server.File, mode int, written bool) {
+	if written {
+		f.Version++
+	}
+}
+
+func ramCreate(d *server.Dir, name string, perm uint32, uid string) (*server.File, os.Error) {
+	if perm & pepys.Pdir != 0 {
+		return &newDir(name, uid, perm).File, nil
+	}
+	return newFile(name, uid, perm), nil
+}
+
+func ramRemove(d *server.Dir, f *server.File) os.Error {
+	// nothing to free but memory
+	return nil
+}
+
+func newFile(name string, uid string, perm uint32) *server.File {
+	f := server.NewFile(name, uid, perm)
+	f.Ftype = pepys.Fversioned
+	f.Aux = new(ramData)
+	f.Read = ramRead
+	f.Write = ramWrite
+	f.Truncate = ramTruncate
+	f.Clunk = ramClunk
+	return f
+}
+
+func newDir(name string, uid string, perm uint32) *server.Dir {
+	d := server.NewDir(name, uid, perm)
+	d.Create = ramCreate
+	d.Remove = ramRemove
+	return d
+}
+
+func main() {
+	flag.Parse()
+
+	tree := server.NewTree(newDir("/", *owner, 0777))
+	srv, err := server.New(tree, "tcp", *addr)
+	if err != nil {
+		fmt.Printf("Error: %s", err)
+		os.Exit(1)
+	}
+	fmt.Printf("ramfs server is ready and listening on %s!\n", *addr)
+
+	// start processing requests
+	srv.Start()
+}
@@ -6,51 +6,55 @@ import "fmt"
 import "time"
 import "pepys"
 import "bytes"
+import "strings"
 import "pepys/server"
 
 const IOUNIT uint32 = 1024
 
-type TimeOps struct {}
-
-// A FidMap is generally useful, move to Client utility library?
-type FidMap struct {
-	fids map[int]string
-}
-func NewFidMap() *FidMap {
-	fm := new(FidMap)
-	fm.fids = make(map[int]string, 10)
-	return fm
+type TimeOps struct {
+	// metadata of the time file, changed by Twstat
+	name string
+	perm uint32
+	gid string
+	length uint64
+	mtime uint64
 }
-func (fm *FidMap) Exists(f uint32) bool {
-	_, present := fm.fids[int(f)]
-	return present
+
+// Nodes handed to the server library, timefs has a root and a file in it
+type timeNode int
+const (
+	rootNode timeNode = iota
+	fileNode
+)
+
+func (to *TimeOps) Root(conn *server.Connection, aname string) (interface{}, os.Error) {
+	return rootNode, nil
 }
-func (fm *FidMap) AddFid(f uint32, p string) bool {
-	if fm.Exists(f) {
-		return false
+
+func (to *TimeOps) Walk(conn *server.Connection, dir interface{}, name string) (interface{}, os.Error) {
+	if dir.(timeNode) != rootNode {
+		return nil, pepys.Enotdir
 	}
-	fm.fids[int(f)] = p
-	return true
-}
-func (fm *FidMap) DelFid(f uint32) bool {
-	if !fm.Exists(f) {
-		return false
+	if name != to.name {
+		return nil, pepys.Enotexist
 	}
-	fm.fids[int(f)] = "", false
-	return true
+	return fileNode, nil
 }
-func (fm *FidMap) GetFid(f uint32) string {
-	if !fm.Exists(f) {
-		return ""
+
+// Find the node behind a fid, the library has checked it exists for us
+func node(conn *server.Connection, fid uint32) (timeNode, os.Error) {
+	f := conn.GetFid(fid)
+	if f == nil {
+		return 0, pepys.Ebadfid
 	}
-	return fm.fids[int(f)]
+	return f.Node.(timeNode), nil
 }
 
 func (to *TimeOps) Proto(conn *server.Connection, arg *pepys.Tproto) (*pepys.Rproto, os.Error) {
 	// no special options supported
 	resp := new(pepys.Rproto)
-	resp.Msize = pepys.MSIZE
-	resp.Nmsgs = pepys.NMSGS
+	resp.Msize = pepys.Msize
+	resp.Nmsgs = pepys.Nmsgs
 	
 	fmt.Printf("%s:: Tproto received, sending back Rproto\n", conn.RemoteAddr)
 	return resp, nil
@@ -68,42 +72,32 @@ func (to *TimeOps) Session(conn *server.Connection, arg *pepys.Tsession) (*pepys
 func (to *TimeOps) Attach(conn *server.Connection, arg *pepys.Tattach) (*pepys.Rattach, os.Error) {	
 	resp := new(pepys.Rattach)
 	
-	// initialize fid map
-	fmap := NewFidMap()
-	conn.Aux = fmap
-	
-	fmt.Printf("conn.Aux set to %v\n", conn.Aux)
 	fmt.Printf("%s:: Tattach received, sending back Rattach for root\n", conn.RemoteAddr)
 	return resp, nil
 }
 
 func (to *TimeOps) Open(conn *server.Connection, arg *pepys.Topen) (*pepys.Ropen, os.Error) {
-	if arg.Path != "/time" {
-		return nil, os.NewError("File non-existent!")
-	}
-	if arg.Fid == 0 {
-		return nil, os.NewError("0 is an invalid fid!")
+	// the library has already resolved the path and created the new fid
+	n, err := node(conn, arg.Nfid)
+	if err != nil {
+		return nil, err
 	}
-	
-	fmap := conn.Aux.(*FidMap)
-	if fmap.Exists(arg.Fid) {
-		return nil, os.NewError("Fid is already in use!")
+	if n != fileNode {
+		return nil, pepys.Eisdir
 	}
-	fmap.AddFid(arg.Fid, arg.Path)
 	
 	resp := new(pepys.Ropen)
 	resp.Iounit = IOUNIT
-	fmt.Printf("%s:: Topen received for %s, sending back Ropen with fid=%d\n", conn.RemoteAddr, arg.Path, arg.Fid)
+	fmt.Printf("%s:: Topen received for %s, sending back Ropen with fid=%d\n", conn.RemoteAddr, arg.Path, arg.Nfid)
 	return resp, nil
 }
 
 func (to *TimeOps) Read(conn *server.Connection, arg *pepys.Tread) (*pepys.Rread, os.Error) {
-	fmap := conn.Aux.(*FidMap)
-	if !fmap.Exists(arg.Fid) {
-		return nil, os.NewError("Fid not found!")
+	if _, err := node(conn, arg.Fid); err != nil {
+		return nil, err
 	}
 	
-	t := []byte(time.LocalTime().String() + "\n")
+	t := to.now()
 	rl := len(t)
 	if int(arg.Count) < rl {
 		rl = int(arg.Count)
@@ -121,9 +115,8 @@ func (to *TimeOps) Read(conn *server.Connection, arg *pepys.Tread) (*pepys.Rread
 
 func (to *TimeOps) Close(conn *server.Connection, arg *pepys.Tclose) (*pepys.Rclose, os.Error) {
 	// we don't really care about this, always succeed if fid exists
-	fmap := conn.Aux.(*FidMap)
-	if !fmap.Exists(arg.Fid) {
-		return nil, os.NewError("Fid not found!")
+	if _, err := node(conn, arg.Fid); err != nil {
+		return nil, err
 	}
 	
 	resp := new(pepys.Rclose)
@@ -131,16 +124,91 @@ func (to *TimeOps) Close(conn *server.Connection, arg *pepys.Tclose) (*pepys.Rcl
 }
 
 func (to *TimeOps) Clunk(conn *server.Connection, arg *pepys.Tclunk) (*pepys.Rclunk, os.Error) {
-	fmap := conn.Aux.(*FidMap)
-	if !fmap.Exists(arg.Fid) {
-		return nil, os.NewError("Fid not found!")
+	// the library forgets the fid once we're done
+	if _, err := node(conn, arg.Fid); err != nil {
+		return nil, err
 	}
-	fmap.DelFid(arg.Fid)
 	
 	resp := new(pepys.Rclunk)
 	return resp, nil
 }
 
+// The contents of the time file, cut short if it has been truncated
+func (to *TimeOps) now() []byte {
+	t := []byte(time.LocalTime().String() + "\n")
+	if to.length != pepys.Nolength && uint64(len(t)) > to.length {
+		t = t[0:to.length]
+	}
+	return t
+}
+
+func (to *TimeOps) Stat(conn *server.Connection, arg *pepys.Tstat) (*pepys.Rstat, os.Error) {
+	n, err := node(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	
+	resp := new(pepys.Rstat)
+	if n == rootNode {
+		resp.Name = "/"
+		resp.Perm = 0555
+		resp.Uid = "timefs"
+		resp.Gid = "timefs"
+		resp.Muid = "timefs"
+		return resp, nil
+	}
+	resp.Name = to.name
+	resp.Perm = to.perm
+	resp.Uid = "timefs"
+	resp.Gid = to.gid
+	resp.Muid = "timefs"
+	resp.Length = uint64(len(to.now()))
+	resp.Atime = uint64(time.Nanoseconds())
+	resp.Mtime = to.mtime
+	
+	fmt.Printf("%s:: Tstat received, sending back Rstat for %s\n", conn.RemoteAddr, to.name)
+	return resp, nil
+}
+
+func (to *TimeOps) Wstat(conn *server.Connection, arg *pepys.Twstat) (*pepys.Rwstat, os.Error) {
+	n, err := node(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if n == rootNode {
+		return nil, pepys.Eperm
+	}
+	
+	// check everything first, a Twstat is either applied entirely or not at all
+	if strings.Index(arg.Name, "/") >= 0 || arg.Name == "." || arg.Name == ".." {
+		return nil, pepys.Ename
+	}
+	if arg.Perm != pepys.Noperm && arg.Perm & ^uint32(0777) != 0 {
+		return nil, os.NewError("Invalid permission bits!")
+	}
+	
+	if arg.Name != "" {
+		to.name = arg.Name
+	}
+	if arg.Perm != pepys.Noperm {
+		to.perm = arg.Perm
+	}
+	if arg.Gid != "" {
+		to.gid = arg.Gid
+	}
+	if arg.Length != pepys.Nolength {
+		to.length = arg.Length
+		to.mtime = uint64(time.Nanoseconds())
+	}
+	if arg.Mtime != pepys.Notime {
+		to.mtime = arg.Mtime
+	}
+	
+	resp := new(pepys.Rwstat)
+	fmt.Printf("%s:: Twstat received, time file is now %s\n", conn.RemoteAddr, to.name)
+	return resp, nil
+}
+
 // operations unsupported by timefs
 func (to *TimeOps) Flush(conn *server.Connection, arg *pepys.Tflush) (*pepys.Rflush, os.Error) {
 	return nil, os.NewError("Flush is not supported!")
@@ -151,10 +219,18 @@ func (to *TimeOps) Write(conn *server.Connection, arg *pepys.Twrite) (*pepys.Rwr
 func (to *TimeOps) Create(conn *server.Connection, arg *pepys.Tcreate) (*pepys.Rcreate, os.Error) {
 	return nil, os.NewError("Create is not supported!")
 }
+func (to *TimeOps) Remove(conn *server.Connection, arg *pepys.Tremove) (*pepys.Rremove, os.Error) {
+	return nil, os.NewError("Remove is not supported!")
+}
 
 func main() {
 	// create server on localhost:5640
 	to := new(TimeOps)
+	to.name = "time"
+	to.perm = 0444
+	to.gid = "timefs"
+	to.length = pepys.Nolength
+	to.mtime = uint64(time.Nanoseconds())
 	srv, err := server.New(to, "tcp", "localhost:5640")
 	if err != nil {
 		fmt.Printf("Error: %s", err)
@@ -0,0 +1,211 @@
+package server
+
+import "os"
+import "pepys"
+import "strings"
+
+// File servers that implement Walker leave fids and path names to the
+// library: it keeps a Fid for every fid the client has attached or opened,
+// and resolves the path of a Topen one element at a time, so the file server
+// only ever has to find a name in a single directory.
+type Walker interface {
+	// Return the node at the top of the tree named by aname
+	Root(conn *Connection, aname string) (interface{}, os.Error)
+	// Return the node called name in the directory node dir
+	Walk(conn *Connection, dir interface{}, name string) (interface{}, os.Error)
+}
+
+type Fid struct {
+	// preset
+	Num uint32
+	Path string	// always absolute from the attach root
+	Node interface{}	// as returned by the Walker
+
+	// use at will
+	Aux interface{}
+
+	// private
+	nodes []interface{}	// from the attach root down to Node
+	names []string	// path elements leading to Node
+}
+
+// Look up fid num on this connection, nil if the client never created it
+func (conn *Connection) GetFid(num uint32) *Fid {
+	fid, present := conn.fids[num]
+	if !present {
+		return nil
+	}
+	return fid
+}
+
+// Create fid num on this connection
+func (conn *Connection) NewFid(num uint32) (*Fid, os.Error) {
+	if num == pepys.Nofid {
+		return nil, pepys.Ebadfid
+	}
+	if _, present := conn.fids[num]; present {
+		return nil, pepys.Efidinuse
+	}
+	fid := new(Fid)
+	fid.Num = num
+	fid.Path = "/"
+	conn.fids[num] = fid
+	return fid, nil
+}
+
+// Forget fid num, the client is free to reuse it
+func (conn *Connection) DelFid(num uint32) {
+	conn.fids[num] = nil, false
+}
+
+// Called before the file server sees a message
+func (conn *Connection) prepare(op interface{}) os.Error {
+	if conn.Srv.walker == nil {
+		return nil
+	}
+	switch arg := op.(type) {
+	case *pepys.Tattach:
+		if _, present := conn.fids[arg.Fid]; present {
+			return pepys.Efidinuse
+		}
+	case *pepys.Topen:
+		return conn.walk(arg)
+	}
+	return nil
+}
+
+// Called after the file server handled a message, with its error
+func (conn *Connection) finish(op interface{}, err os.Error) os.Error {
+	switch arg := op.(type) {
+	case *pepys.Tsession:
+		if err == nil {
+			conn.Uname = arg.Uname
+		}
+	case *pepys.Tattach:
+		if err == nil && arg.Uname != "" {
+			conn.Uname = arg.Uname
+		}
+	}
+	if conn.Srv.walker == nil {
+		return err
+	}
+	switch arg := op.(type) {
+	case *pepys.Tattach:
+		if err == nil {
+			err = conn.attach(arg)
+		}
+	case *pepys.Topen:
+		// only undo what walk did, the new fid may have been in use before
+		if err != nil && conn.newfid != nil {
+			conn.DelFid(conn.newfid.Num)
+		}
+		conn.newfid = nil
+	case *pepys.Tclunk:
+		// the fid is gone even if the clunk failed, as in 9P
+		conn.DelFid(arg.Fid)
+	case *pepys.Tremove:
+		conn.DelFid(arg.Fid)
+	}
+	return err
+}
+
+// Bind the fid of a Tattach to the root of the tree
+func (conn *Connection) attach(arg *pepys.Tattach) os.Error {
+	root, err := conn.Srv.walker.Root(conn, arg.Aname)
+	if err != nil {
+		return err
+	}
+	fid, err := conn.NewFid(arg.Fid)
+	if err != nil {
+		return err
+	}
+	fid.Node = root
+	fid.nodes = []interface{}{root}
+	fid.names = []string{}
+	return nil
+}
+
+// Resolve the path of a Topen relative to its directory fid and bind the
+// result to the new fid. An absolute path starts over at the attach root;
+// "." and ".." work as usual, except that ".." may not leave the root.
+func (conn *Connection) walk(arg *pepys.Topen) os.Error {
+	dir := conn.GetFid(arg.Fid)
+	if dir == nil || dir.nodes == nil {
+		return pepys.Ebadfid
+	}
+	if _, present := conn.fids[arg.Nfid]; present {
+		return pepys.Efidinuse
+	}
+
+	elems := strings.Split(arg.Path, "/", -1)
+	nodes := make([]interface{}, len(dir.nodes), len(dir.nodes) + len(elems))
+	names := make([]string, len(dir.names), len(dir.names) + len(elems))
+	copy(nodes, dir.nodes)
+	copy(names, dir.names)
+	if strings.HasPrefix(arg.Path, "/") {
+		nodes = nodes[0:1]
+		names = names[0:0]
+	}
+
+	for _, name := range elems {
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(names) == 0 {
+				return pepys.Eescape
+			}
+			nodes = nodes[0:len(nodes) - 1]
+			names = names[0:len(names) - 1]
+		default:
+			node, err := conn.Srv.walker.Walk(conn, nodes[len(nodes) - 1], name)
+			if err != nil {
+				return err
+			}
+			nodes = nodes[0:len(nodes) + 1]
+			nodes[len(nodes) - 1] = node
+			names = names[0:len(names) + 1]
+			names[len(names) - 1] = name
+		}
+	}
+
+	fid, err := conn.NewFid(arg.Nfid)
+	if err != nil {
+		return err
+	}
+	fid.Node = nodes[len(nodes) - 1]
+	fid.Path = "/" + strings.Join(names, "/")
+	fid.nodes = nodes
+	fid.names = names
+	conn.newfid = fid
+	return nil
+}
+
+// Move fid down to node, called name, in the directory it refers to. File
+// servers use this when a Tcreate turns the fid into the new file.
+func (fid *Fid) Descend(node interface{}, name string) {
+	nodes := make([]interface{}, len(fid.nodes) + 1)
+	names := make([]string, len(fid.names) + 1)
+	copy(nodes, fid.nodes)
+	copy(names, fid.names)
+	nodes[len(fid.nodes)] = node
+	names[len(fid.names)] = name
+
+	fid.Node = node
+	fid.Path = "/" + strings.Join(names, "/")
+	fid.nodes = nodes
+	fid.names = names
+}
+
+// Point fid at node, now called name in the same directory. File servers use
+// this when a Twstat renames the file.
+func (fid *Fid) Rename(node interface{}, name string) {
+	if len(fid.names) == 0 {
+		return
+	}
+	fid.nodes[len(fid.nodes) - 1] = node
+	fid.names[len(fid.names) - 1] = name
+
+	fid.Node = node
+	fid.Path = "/" + strings.Join(fid.names, "/")
+}
@@ -0,0 +1,323 @@
+package server
+
+import "io"
+import "os"
+import "pepys"
+
+// An FS is a read-only file system to export. Names are slash separated
+// paths from its root, without a leading slash; "." is the root itself.
+type FS interface {
+	Open(name string) (FSFile, os.Error)
+}
+
+// What an FS hands back; an *os.File will do
+type FSFile interface {
+	Stat() (*os.FileInfo, os.Error)
+	Read(p []byte) (int, os.Error)
+	Readdir(count int) ([]os.FileInfo, os.Error)
+	Close() os.Error
+}
+
+// The FS of a local directory
+type DirFS string
+
+func (dir DirFS) Open(name string) (FSFile, os.Error) {
+	f, err := os.Open(string(dir) + "/" + name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// An Export serves an FS read-only to everyone. It implements Operations
+// and Walker by handing the work over to the FS.
+type Export struct {
+	fsys FS
+	uid string
+}
+
+// The state of an open fid, kept in its Aux
+type exportFid struct {
+	file FSFile
+	name string
+	pos uint64	// where the next Read of file starts
+	dir DirReader
+}
+
+// Export fsys, with its files owned by uid
+func NewExport(fsys FS, uid string) *Export {
+	ex := new(Export)
+	ex.fsys = fsys
+	ex.uid = uid
+	return ex
+}
+
+func (ex *Export) stat(fi *os.FileInfo) *pepys.Rstat {
+	st := new(pepys.Rstat)
+	if fi.IsDirectory() {
+		st.Ftype = pepys.Fdir
+	} else {
+		st.Ftype = pepys.Fversioned
+		st.Length = uint64(fi.Size)
+	}
+	// versions change whenever the contents do
+	st.Version = uint64(fi.Mtime_ns) ^ uint64(fi.Size) << 48
+	st.Perm = fi.Mode & 0555
+	st.Uid = ex.uid
+	st.Gid = ex.uid
+	st.Muid = ex.uid
+	st.Atime = uint64(fi.Atime_ns)
+	st.Mtime = uint64(fi.Mtime_ns)
+	st.Name = fi.Name
+	return st
+}
+
+// Look at a file without keeping it open
+func (ex *Export) lstat(name string) (*os.FileInfo, os.Error) {
+	f, err := ex.fsys.Open(name)
+	if err != nil {
+		return nil, pepys.Enotexist
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// The name behind a fid, and its state if it is open
+func (ex *Export) file(conn *Connection, num uint32) (string, *exportFid, os.Error) {
+	fid := conn.GetFid(num)
+	if fid == nil {
+		return "", nil, pepys.Ebadfid
+	}
+	ef, _ := fid.Aux.(*exportFid)
+	return fid.Node.(string), ef, nil
+}
+
+func (ex *Export) Root(conn *Connection, aname string) (interface{}, os.Error) {
+	if aname != "" && aname != "/" {
+		return nil, pepys.Enotexist
+	}
+	return ".", nil
+}
+
+func (ex *Export) Walk(conn *Connection, dir interface{}, name string) (interface{}, os.Error) {
+	d := dir.(string)
+	fi, err := ex.lstat(d)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDirectory() {
+		return nil, pepys.Enotdir
+	}
+	if d == "." {
+		d = name
+	} else {
+		d = d + "/" + name
+	}
+	if _, err = ex.lstat(d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (ex *Export) Proto(conn *Connection, arg *pepys.Tproto) (*pepys.Rproto, os.Error) {
+	// no options supported
+	return Negotiate(conn, arg)
+}
+
+func (ex *Export) Session(conn *Connection, arg *pepys.Tsession) (*pepys.Rsession, os.Error) {
+	resp := new(pepys.Rsession)
+	resp.Ssid = arg.Csid
+	return resp, nil
+}
+
+func (ex *Export) Attach(conn *Connection, arg *pepys.Tattach) (*pepys.Rattach, os.Error) {
+	// the library binds the fid to Root
+	return new(pepys.Rattach), nil
+}
+
+func (ex *Export) Flush(conn *Connection, arg *pepys.Tflush) (*pepys.Rflush, os.Error) {
+	// called while a group is being flushed; nothing here blocks for
+	// long, so it may as well finish
+	return new(pepys.Rflush), nil
+}
+
+func (ex *Export) Open(conn *Connection, arg *pepys.Topen) (*pepys.Ropen, os.Error) {
+	m, err := pepys.ParseMode(arg.Mode)
+	if err != nil {
+		return nil, err
+	}
+	if m & (pepys.Owrite | pepys.Otrunc | pepys.Orclose) != 0 {
+		return nil, pepys.Eperm
+	}
+	fid := conn.GetFid(arg.Nfid)
+	ef := new(exportFid)
+	ef.name = fid.Node.(string)
+	if ef.file, err = ex.fsys.Open(ef.name); err != nil {
+		return nil, err
+	}
+	fi, err := ef.file.Stat()
+	if err != nil {
+		ef.file.Close()
+		return nil, err
+	}
+	fid.Aux = ef
+
+	st := ex.stat(fi)
+	resp := new(pepys.Ropen)
+	resp.Iounit = Iounit(conn)
+	resp.Ftype = st.Ftype
+	resp.Version = st.Version
+	return resp, nil
+}
+
+// Get the file ready to read at offset: files that can seek do so, others
+// are read through or opened again
+func (ex *Export) seek(ef *exportFid, offset uint64) os.Error {
+	if offset == ef.pos {
+		return nil
+	}
+	if s, ok := ef.file.(io.Seeker); ok {
+		if _, err := s.Seek(int64(offset), 0); err != nil {
+			return err
+		}
+		ef.pos = offset
+		return nil
+	}
+	if offset < ef.pos {
+		f, err := ex.fsys.Open(ef.name)
+		if err != nil {
+			return err
+		}
+		ef.file.Close()
+		ef.file = f
+		ef.pos = 0
+	}
+	buf := make([]byte, 8192)
+	for ef.pos < offset {
+		n := offset - ef.pos
+		if n > uint64(len(buf)) {
+			n = uint64(len(buf))
+		}
+		m, err := ef.file.Read(buf[0:n])
+		ef.pos += uint64(m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ex *Export) Read(conn *Connection, arg *pepys.Tread) (*pepys.Rread, os.Error) {
+	_, ef, err := ex.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if ef == nil {
+		return nil, pepys.Eperm
+	}
+	if arg.Count > Iounit(conn) {
+		arg.Count = Iounit(conn)
+	}
+
+	resp := new(pepys.Rread)
+	fi, err := ef.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDirectory() {
+		resp.Dat, err = ef.dir.Read(arg.Offset, arg.Count, func() ([]*pepys.Rstat, os.Error) {
+			return ex.readdir(ef)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	if err = ex.seek(ef, arg.Offset); err != nil {
+		if err == os.EOF {
+			resp.Dat = []byte{}
+			return resp, nil
+		}
+		return nil, err
+	}
+	buf := make([]byte, arg.Count)
+	n := 0
+	for n < len(buf) {
+		m, err := ef.file.Read(buf[n:])
+		n += m
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	ef.pos += uint64(n)
+	resp.Dat = buf[0:n]
+	return resp, nil
+}
+
+// List a directory from the start
+func (ex *Export) readdir(ef *exportFid) ([]*pepys.Rstat, os.Error) {
+	f, err := ex.fsys.Open(ef.name)
+	if err != nil {
+		return nil, err
+	}
+	ef.file.Close()
+	ef.file = f
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sts := make([]*pepys.Rstat, len(fis))
+	for i := range fis {
+		sts[i] = ex.stat(&fis[i])
+	}
+	return sts, nil
+}
+
+func (ex *Export) Clunk(conn *Connection, arg *pepys.Tclunk) (*pepys.Rclunk, os.Error) {
+	_, ef, err := ex.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if ef != nil {
+		ef.file.Close()
+	}
+	return new(pepys.Rclunk), nil
+}
+
+func (ex *Export) Stat(conn *Connection, arg *pepys.Tstat) (*pepys.Rstat, os.Error) {
+	name, _, err := ex.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := ex.lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	st := ex.stat(fi)
+	if name == "." {
+		st.Name = "/"
+	}
+	return st, nil
+}
+
+// An Export is read-only
+func (ex *Export) Create(conn *Connection, arg *pepys.Tcreate) (*pepys.Rcreate, os.Error) {
+	return nil, pepys.Eperm
+}
+func (ex *Export) Write(conn *Connection, arg *pepys.Twrite) (*pepys.Rwrite, os.Error) {
+	return nil, pepys.Eperm
+}
+func (ex *Export) Wstat(conn *Connection, arg *pepys.Twstat) (*pepys.Rwstat, os.Error) {
+	return nil, pepys.Eperm
+}
+func (ex *Export) Remove(conn *Connection, arg *pepys.Tremove) (*pepys.Rremove, os.Error) {
+	// the fid goes away all the same
+	if _, ef, err := ex.file(conn, arg.Fid); err == nil && ef != nil {
+		ef.file.Close()
+	}
+	return nil, pepys.Eperm
+}
@@ -0,0 +1,587 @@
+package server
+
+import "os"
+import "sync"
+import "time"
+import "pepys"
+
+// A Tree is a file server made of File and Dir nodes built by its author.
+// It implements Operations and Walker, taking care of fids, permissions,
+// directory reads and metadata; the author only supplies callbacks for what
+// is particular to each file. All callbacks are made with the tree locked.
+type Tree struct {
+	Top *Dir	// root directory
+
+	// private
+	lock sync.Mutex
+	ssid uint32
+}
+
+// A node of a Tree. The metadata is sent as is in Rstat and directory
+// reads, so callbacks should keep it up to date.
+type File struct {
+	Name string
+	Uid string
+	Gid string
+	Muid string
+	Perm uint32
+	Ftype uint32
+	Version uint64
+	Length uint64
+	Atime uint64
+	Mtime uint64
+
+	// Callbacks, nil ones refuse the operation
+	Read func(f *File, off uint64, count uint32) ([]byte, os.Error)
+	Write func(f *File, off uint64, dat []byte) (uint32, os.Error)
+	Truncate func(f *File, length uint64) os.Error
+	// called before the metadata is used, to refresh it
+	Stat func(f *File) os.Error
+	// called when a fid that opened the file is clunked
+	Clunk func(f *File, mode int, written bool)
+
+	// use at will
+	Aux interface{}
+
+	// private
+	parent *Dir
+	dir *Dir	// set if the file is a directory
+}
+
+type Dir struct {
+	File
+
+	// Callbacks, nil ones refuse the operation. The framework adds and
+	// removes the entry, the callbacks only have to agree to it.
+	Create func(d *Dir, name string, perm uint32, uid string) (*File, os.Error)
+	Remove func(d *Dir, f *File) os.Error
+
+	// private
+	files []*File
+}
+
+// The state of an open fid, kept in its Aux
+type treeFid struct {
+	mode int
+	written bool
+
+	dir DirReader
+}
+
+func NewTree(root *Dir) *Tree {
+	tree := new(Tree)
+	tree.Top = root
+	return tree
+}
+
+func NewFile(name string, uid string, perm uint32) *File {
+	f := new(File)
+	f.Name = name
+	f.Uid = uid
+	f.Gid = uid
+	f.Muid = uid
+	f.Perm = perm
+	f.Atime = uint64(time.Nanoseconds())
+	f.Mtime = f.Atime
+	return f
+}
+
+func NewDir(name string, uid string, perm uint32) *Dir {
+	d := new(Dir)
+	d.File = *NewFile(name, uid, perm)
+	d.Ftype = pepys.Fdir
+	d.dir = d
+	return d
+}
+
+// Return the directory a file belongs to, nil for the root
+func (f *File) Parent() *Dir {
+	return f.parent
+}
+
+// Return the directory behind a file, nil if it isn't one
+func (f *File) Dir() *Dir {
+	return f.dir
+}
+
+// Add f to directory d
+func (d *Dir) Add(f *File) os.Error {
+	if d.Lookup(f.Name) != nil {
+		return pepys.Eexist
+	}
+	files := make([]*File, len(d.files) + 1)
+	copy(files, d.files)
+	files[len(d.files)] = f
+	d.files = files
+	f.parent = d
+	return nil
+}
+
+// Take f out of directory d
+func (d *Dir) Del(f *File) os.Error {
+	for i, g := range d.files {
+		if g == f {
+			files := make([]*File, len(d.files) - 1)
+			copy(files, d.files[0:i])
+			copy(files[i:], d.files[i + 1:])
+			d.files = files
+			f.parent = nil
+			return nil
+		}
+	}
+	return pepys.Enotexist
+}
+
+func (d *Dir) Lookup(name string) *File {
+	for _, f := range d.files {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func (d *Dir) Files() []*File {
+	return d.files
+}
+
+// Check whether uname is allowed the access in want (Prm bits) to f
+func (f *File) allowed(uname string, want uint32) bool {
+	perm := f.Perm & 7
+	if uname == f.Uid {
+		perm |= (f.Perm >> 6) & 7
+	}
+	if uname == f.Gid {
+		perm |= (f.Perm >> 3) & 7
+	}
+	return perm & want == want
+}
+
+func (f *File) stat() (*pepys.Rstat, os.Error) {
+	if f.Stat != nil {
+		if err := f.Stat(f); err != nil {
+			return nil, err
+		}
+	}
+	st := new(pepys.Rstat)
+	st.Ftype = f.Ftype
+	st.Version = f.Version
+	st.Perm = f.Perm
+	st.Uid = f.Uid
+	st.Gid = f.Gid
+	st.Muid = f.Muid
+	st.Length = f.Length
+	st.Atime = f.Atime
+	st.Mtime = f.Mtime
+	st.Name = f.Name
+	if f.dir != nil {
+		st.Length = 0
+	}
+	return st, nil
+}
+
+// The file behind a fid, and its state if it is open
+func (tree *Tree) file(conn *Connection, num uint32) (*File, *treeFid, os.Error) {
+	fid := conn.GetFid(num)
+	if fid == nil {
+		return nil, nil, pepys.Ebadfid
+	}
+	tf, _ := fid.Aux.(*treeFid)
+	return fid.Node.(*File), tf, nil
+}
+
+func (tree *Tree) Root(conn *Connection, aname string) (interface{}, os.Error) {
+	if aname != "" && aname != "/" {
+		return nil, pepys.Enotexist
+	}
+	return &tree.Top.File, nil
+}
+
+func (tree *Tree) Walk(conn *Connection, dir interface{}, name string) (interface{}, os.Error) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	d := dir.(*File).dir
+	if d == nil {
+		return nil, pepys.Enotdir
+	}
+	if !d.allowed(conn.Uname, pepys.Prmexec) {
+		return nil, pepys.Eperm
+	}
+	f := d.Lookup(name)
+	if f == nil {
+		return nil, pepys.Enotexist
+	}
+	return f, nil
+}
+
+func (tree *Tree) Proto(conn *Connection, arg *pepys.Tproto) (*pepys.Rproto, os.Error) {
+	// no options supported
+	return Negotiate(conn, arg)
+}
+
+func (tree *Tree) Session(conn *Connection, arg *pepys.Tsession) (*pepys.Rsession, os.Error) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	tree.ssid++
+	resp := new(pepys.Rsession)
+	resp.Ssid = tree.ssid
+	return resp, nil
+}
+
+func (tree *Tree) Attach(conn *Connection, arg *pepys.Tattach) (*pepys.Rattach, os.Error) {
+	// the library binds the fid to Root
+	return new(pepys.Rattach), nil
+}
+
+func (tree *Tree) Flush(conn *Connection, arg *pepys.Tflush) (*pepys.Rflush, os.Error) {
+	// called while a group is being flushed; nothing here blocks for
+	// long, so it may as well finish
+	return new(pepys.Rflush), nil
+}
+
+// Check that uname may open f with mode m and do the truncation if asked
+func (tree *Tree) open(conn *Connection, f *File, m int) os.Error {
+	want := uint32(0)
+	if m & pepys.Oread != 0 {
+		want |= pepys.Prmread
+	}
+	if m & pepys.Owrite != 0 || m & pepys.Otrunc != 0 {
+		if f.dir != nil {
+			return pepys.Eisdir
+		}
+		want |= pepys.Prmwrite
+	}
+	if m & pepys.Oexec == pepys.Oexec {
+		want |= pepys.Prmexec
+	}
+	if m & pepys.Orclose != 0 && (f.parent == nil || !f.parent.allowed(conn.Uname, pepys.Prmwrite)) {
+		return pepys.Eperm
+	}
+	if !f.allowed(conn.Uname, want) {
+		return pepys.Eperm
+	}
+	if m & pepys.Otrunc != 0 {
+		if f.Truncate == nil {
+			return pepys.Eperm
+		}
+		if err := f.Truncate(f, 0); err != nil {
+			return err
+		}
+		f.Length = 0
+		f.Muid = conn.Uname
+		f.Mtime = uint64(time.Nanoseconds())
+	}
+	return nil
+}
+
+func (tree *Tree) Open(conn *Connection, arg *pepys.Topen) (*pepys.Ropen, os.Error) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	m, err := pepys.ParseMode(arg.Mode)
+	if err != nil {
+		return nil, err
+	}
+	fid := conn.GetFid(arg.Nfid)
+	f := fid.Node.(*File)
+	if err = tree.open(conn, f, m); err != nil {
+		return nil, err
+	}
+
+	tf := new(treeFid)
+	tf.mode = m
+	fid.Aux = tf
+
+	resp := new(pepys.Ropen)
+	resp.Iounit = Iounit(conn)
+	resp.Ftype = f.Ftype
+	resp.Version = f.Version
+	return resp, nil
+}
+
+func (tree *Tree) Create(conn *Connection, arg *pepys.Tcreate) (*pepys.Rcreate, os.Error) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	fid := conn.GetFid(arg.Fid)
+	if fid == nil {
+		return nil, pepys.Ebadfid
+	}
+	if fid.Aux != nil {
+		return nil, pepys.Eisopen
+	}
+	d := fid.Node.(*File).dir
+	if d == nil {
+		return nil, pepys.Enotdir
+	}
+	if !GoodName(arg.Name) {
+		return nil, pepys.Ename
+	}
+	if d.Lookup(arg.Name) != nil {
+		return nil, pepys.Eexist
+	}
+	if !d.allowed(conn.Uname, pepys.Prmwrite) {
+		return nil, pepys.Eperm
+	}
+	m, err := pepys.ParseMode(arg.Mode)
+	if err != nil {
+		return nil, err
+	}
+	if d.Create == nil {
+		return nil, pepys.Eperm
+	}
+	if arg.Perm & pepys.Pdir != 0 && m & (pepys.Owrite | pepys.Otrunc) != 0 {
+		return nil, pepys.Eisdir
+	}
+
+	// as in 9P, directories lend their group and restrict the permissions
+	perm := arg.Perm & (^uint32(0666) | d.Perm & 0666)
+	if arg.Perm & pepys.Pdir != 0 {
+		perm = arg.Perm & (^uint32(0777) | d.Perm & 0777)
+	}
+	f, err := d.Create(d, arg.Name, perm, conn.Uname)
+	if err != nil {
+		return nil, err
+	}
+	f.Name = arg.Name
+	f.Perm = perm & 0777
+	f.Gid = d.Gid
+	if err = d.Add(f); err != nil {
+		return nil, err
+	}
+	d.Mtime = uint64(time.Nanoseconds())
+	d.Muid = conn.Uname
+
+	// the fid now refers to the new file, open with the given mode; the
+	// creator may use it whatever the permissions say
+	fid.Descend(f, f.Name)
+	tf := new(treeFid)
+	tf.mode = m
+	fid.Aux = tf
+
+	resp := new(pepys.Rcreate)
+	resp.Iounit = Iounit(conn)
+	resp.Version = f.Version
+	return resp, nil
+}
+
+func (tree *Tree) Read(conn *Connection, arg *pepys.Tread) (*pepys.Rread, os.Error) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	f, tf, err := tree.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if tf == nil || tf.mode & pepys.Oread == 0 {
+		return nil, pepys.Eperm
+	}
+	if arg.Count > Iounit(conn) {
+		arg.Count = Iounit(conn)
+	}
+
+	resp := new(pepys.Rread)
+	if f.dir != nil {
+		d := f.dir
+		resp.Dat, err = tf.dir.Read(arg.Offset, arg.Count, func() ([]*pepys.Rstat, os.Error) {
+			return d.stats()
+		})
+	} else if f.Read == nil {
+		err = pepys.Eperm
+	} else {
+		resp.Dat, err = f.Read(f, arg.Offset, arg.Count)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.Atime = uint64(time.Nanoseconds())
+	return resp, nil
+}
+
+// The entries of a directory, for DirReader
+func (d *Dir) stats() ([]*pepys.Rstat, os.Error) {
+	sts := make([]*pepys.Rstat, len(d.files))
+	for i, f := range d.files {
+		st, err := f.stat()
+		if err != nil {
+			return nil, err
+		}
+		sts[i] = st
+	}
+	return sts, nil
+}
+
+func (tree *Tree) Write(conn *Connection, arg *pepys.Twrite) (*pepys.Rwrite, os.Error) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	f, tf, err := tree.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if tf == nil || tf.mode & pepys.Owrite == 0 {
+		return nil, pepys.Eperm
+	}
+	if f.Write == nil {
+		return nil, pepys.Eperm
+	}
+	offset := arg.Offset
+	if f.Ftype & pepys.Fappend != 0 {
+		offset = f.Length
+	}
+
+	resp := new(pepys.Rwrite)
+	if resp.Count, err = f.Write(f, offset, arg.Dat); err != nil {
+		return nil, err
+	}
+	tf.written = true
+	f.Muid = conn.Uname
+	f.Mtime = uint64(time.Nanoseconds())
+	return resp, nil
+}
+
+// Take f out of the tree
+func (tree *Tree) remove(conn *Connection, f *File) os.Error {
+	d := f.parent
+	if d == nil {
+		return pepys.Eperm
+	}
+	if !d.allowed(conn.Uname, pepys.Prmwrite) {
+		return pepys.Eperm
+	}
+	if f.dir != nil && len(f.dir.files) != 0 {
+		return pepys.Enotempty
+	}
+	if d.Remove == nil {
+		return pepys.Eperm
+	}
+	if err := d.Remove(d, f); err != nil {
+		return err
+	}
+	d.Mtime = uint64(time.Nanoseconds())
+	d.Muid = conn.Uname
+	return d.Del(f)
+}
+
+func (tree *Tree) Remove(conn *Connection, arg *pepys.Tremove) (*pepys.Rremove, os.Error) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	f, tf, err := tree.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if tf != nil && f.Clunk != nil {
+		f.Clunk(f, tf.mode, tf.written)
+	}
+	if err = tree.remove(conn, f); err != nil {
+		return nil, err
+	}
+	return new(pepys.Rremove), nil
+}
+
+func (tree *Tree) Clunk(conn *Connection, arg *pepys.Tclunk) (*pepys.Rclunk, os.Error) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	f, tf, err := tree.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if tf != nil {
+		if f.Clunk != nil {
+			f.Clunk(f, tf.mode, tf.written)
+		}
+		if tf.mode & pepys.Orclose != 0 {
+			if err = tree.remove(conn, f); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return new(pepys.Rclunk), nil
+}
+
+func (tree *Tree) Stat(conn *Connection, arg *pepys.Tstat) (*pepys.Rstat, os.Error) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	f, _, err := tree.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+	return f.stat()
+}
+
+func (tree *Tree) Wstat(conn *Connection, arg *pepys.Twstat) (*pepys.Rwstat, os.Error) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	f, _, err := tree.file(conn, arg.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	// check everything first, a Twstat is either applied entirely or not at all
+	owner := conn.Uname == f.Uid
+	if arg.Name != "" && arg.Name != f.Name {
+		if f.parent == nil || !GoodName(arg.Name) {
+			return nil, pepys.Ename
+		}
+		if !f.parent.allowed(conn.Uname, pepys.Prmwrite) {
+			return nil, pepys.Eperm
+		}
+		if f.parent.Lookup(arg.Name) != nil {
+			return nil, pepys.Eexist
+		}
+	}
+	if arg.Perm != pepys.Noperm {
+		if !owner {
+			return nil, pepys.Enotowner
+		}
+		if arg.Perm & ^uint32(0777) != 0 {
+			return nil, os.NewError("bad permission bits")
+		}
+	}
+	if arg.Gid != "" && !owner {
+		return nil, pepys.Enotowner
+	}
+	if arg.Length != pepys.Nolength && arg.Length != f.Length {
+		if f.dir != nil {
+			return nil, pepys.Eisdir
+		}
+		if !f.allowed(conn.Uname, pepys.Prmwrite) {
+			return nil, pepys.Eperm
+		}
+		if f.Truncate == nil {
+			return nil, pepys.Eperm
+		}
+	}
+	if arg.Mtime != pepys.Notime && !owner {
+		return nil, pepys.Enotowner
+	}
+
+	// the truncation is the only change that can still fail
+	if arg.Length != pepys.Nolength && arg.Length != f.Length {
+		if err = f.Truncate(f, arg.Length); err != nil {
+			return nil, err
+		}
+		f.Length = arg.Length
+		f.Muid = conn.Uname
+		f.Mtime = uint64(time.Nanoseconds())
+	}
+	if arg.Name != "" {
+		f.Name = arg.Name
+	}
+	if arg.Perm != pepys.Noperm {
+		f.Perm = arg.Perm
+	}
+	if arg.Gid != "" {
+		f.Gid = arg.Gid
+	}
+	if arg.Mtime != pepys.Notime {
+		f.Mtime = arg.Mtime
+	}
+	return new(pepys.Rwstat), nil
+}
@@ -0,0 +1,84 @@
+package server
+
+import "os"
+import "bytes"
+import "pepys"
+import "strings"
+
+// Agree on the message size and count with a client, without options, for
+// file servers to answer a Tproto with
+func Negotiate(conn *Connection, arg *pepys.Tproto) (*pepys.Rproto, os.Error) {
+	resp := new(pepys.Rproto)
+	resp.Msize = conn.Srv.Msize
+	if arg.Msize < resp.Msize {
+		resp.Msize = arg.Msize
+	}
+	resp.Nmsgs = uint16(conn.Srv.Nmsgs)
+	if arg.Nmsgs < resp.Nmsgs {
+		resp.Nmsgs = arg.Nmsgs
+	}
+	if resp.Msize <= pepys.Iohdrsz || resp.Nmsgs == 0 {
+		return nil, pepys.Eversion
+	}
+	conn.Msize = resp.Msize
+	conn.Nmsgs = uint32(resp.Nmsgs)
+	return resp, nil
+}
+
+// Whether name can be the name of a file in a directory
+func GoodName(name string) bool {
+	return name != "" && name != "." && name != ".." && strings.Index(name, "/") < 0
+}
+
+// The most data a Tread or Twrite on conn can carry
+func Iounit(conn *Connection) uint32 {
+	if conn.Msize == 0 {
+		return pepys.Msize - pepys.Iohdrsz
+	}
+	return conn.Msize - pepys.Iohdrsz
+}
+
+// Directories are read from start to end: a read at offset 0 takes a fresh
+// look at the directory, other reads must continue where the last one ended.
+// File servers keep one with each fid open on a directory.
+type DirReader struct {
+	ents [][]byte
+	next int
+	offset uint64
+}
+
+// Return the entries at offset that fit in count bytes; load lists the
+// directory when a read starts over
+func (dr *DirReader) Read(offset uint64, count uint32, load func() ([]*pepys.Rstat, os.Error)) ([]byte, os.Error) {
+	if offset == 0 {
+		sts, err := load()
+		if err != nil {
+			return nil, err
+		}
+		dr.ents = make([][]byte, len(sts))
+		for i, st := range sts {
+			buf := new(bytes.Buffer)
+			pepys.EncodeDir(st, buf)
+			dr.ents[i] = buf.Bytes()
+		}
+		dr.next = 0
+		dr.offset = 0
+	}
+	if offset != dr.offset {
+		return nil, os.NewError("bad directory offset")
+	}
+
+	buf := new(bytes.Buffer)
+	for ; dr.next < len(dr.ents); dr.next++ {
+		ent := dr.ents[dr.next]
+		if buf.Len() + len(ent) > int(count) {
+			break
+		}
+		buf.Write(ent)
+	}
+	if buf.Len() == 0 && dr.next < len(dr.ents) {
+		return nil, os.NewError("read count too small for directory entry")
+	}
+	dr.offset += uint64(buf.Len())
+	return buf.Bytes(), nil
+}